@@ -1,6 +1,11 @@
 var loc = location.href.split('/')[3];
 
 $(function() {
+	// Send our CSRF token with every AJAX request
+	$.ajaxSetup({
+		headers: { 'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content') }
+	});
+
 	switch (loc) 
 	{
 		case 'settings':
@@ -8,6 +13,17 @@ $(function() {
 			DisableTwoFa();
 			VerifyTwoFa();
 			CancelTwoFa();
+			RecoveryCodes();
+			RegisterSecurityKey();
+			break;
+		case 'login':
+			LoginSecurityKey();
+			break;
+		case 'servers':
+			SendCommand();
+			break;
+		case 'policies':
+			FakeCheckboxs();
 			break;
 		case 'users':
 			ChangeUserAdminSetting();
@@ -0,0 +1,23 @@
+// SendCommand is a function that is called when a user submits
+// the command form on a server console. The command is sent to
+// the server and the response (or the reason it was denied) is
+// added to the console.
+function SendCommand()
+{
+	$('#command_form').bind('submit', function(e) {
+		e.preventDefault();
+		var command = $('#command').val();
+		$.ajax({
+			url: $(this).attr('action'),
+			type: 'POST',
+			data: { command: command },
+			error: function(xhr) {
+				$('#console').append($('<div class="denied"></div>').text('> ' + command + '\n' + xhr.responseText));
+			},
+			success: function(data) {
+				$('#console').append($('<div></div>').text('> ' + command + '\n' + data));
+				$('#command').val('');
+			}
+		});
+	});
+}
@@ -9,8 +9,9 @@ function EnableTwoFa()
 			url: '/settings/2fa/generate',
 			type: 'GET',
 			success: function(data) {
-				$('#qrcode').attr('src', 'data:image/png;base64, '+data);
-				$('.lightbox').fadeIn(500);
+				$('#qrcode').attr('src', 'data:image/png;base64, '+data.qr);
+				$('#totp_secret').text(data.secret.match(/.{1,4}/g).join(' '));
+				$('#qr').closest('.lightbox').fadeIn(500);
 			}
 		});
 	});
@@ -62,7 +63,7 @@ function VerifyTwoFa()
 				$('#twofa_verify').html('Verified <i class="fa fa-check"></i>');
 				setTimeout(function() {
 					$('.lightbox').fadeOut(500, function() {
-						location.reload();
+						ShowRecoveryCodes(data.codes);
 					});
 				}, 500);
 			}
@@ -80,3 +81,38 @@ function CancelTwoFa()
 		$('#twofa_verify').html('Verify');
 	});
 }
+
+// RecoveryCodes runs when a user clicks "New Recovery Codes"
+// on the settings page. Their old recovery codes stop working
+// and the new ones are shown.
+function RecoveryCodes()
+{
+	$('#recovery_generate').bind('click', function() {
+		if ($(this).text() != 'Are you sure?') {
+			$(this).text('Are you sure?');
+			setTimeout(function() {
+				$('#recovery_generate').text('New Recovery Codes');
+			}, 2000);
+		} else {
+			$.ajax({
+				url: '/settings/2fa/recovery',
+				type: 'POST',
+				success: function(data) {
+					ShowRecoveryCodes(data.codes);
+				}
+			});
+		}
+	});
+
+	$('#recovery_done').bind('click', function() {
+		location.reload();
+	});
+}
+
+// ShowRecoveryCodes shows a list of recovery codes to the
+// user in a lightbox.
+function ShowRecoveryCodes(codes)
+{
+	$('#recovery_codes').text(codes.join('\n'));
+	$('#recovery_lightbox').fadeIn(500);
+}
@@ -0,0 +1,144 @@
+// DecodeBase64Url turns a base64url string from the server
+// into an ArrayBuffer for the browser's credential API.
+function DecodeBase64Url(str)
+{
+	str = str.replace(/-/g, '+').replace(/_/g, '/');
+	while (str.length % 4) {
+		str += '=';
+	}
+
+	return Uint8Array.from(atob(str), function(c) { return c.charCodeAt(0) }).buffer;
+}
+
+// EncodeBase64Url turns an ArrayBuffer from the browser's
+// credential API into a base64url string for the server.
+function EncodeBase64Url(buf)
+{
+	var str = '';
+	var bytes = new Uint8Array(buf);
+	for (var i = 0; i < bytes.length; i++) {
+		str += String.fromCharCode(bytes[i]);
+	}
+
+	return btoa(str).replace(/\+/g, '-').replace(/\//g, '_').replace(/=/g, '');
+}
+
+// SecurityKeyError shows an error message under the
+// security key button.
+function SecurityKeyError(message)
+{
+	$('#webauthn_error').text(message);
+}
+
+// RegisterSecurityKey runs when a user clicks "Add Security
+// Key" on the settings page. The browser asks the user to
+// touch their key and the new credential is sent back to be
+// saved on their account.
+function RegisterSecurityKey()
+{
+	$('#webauthn_register').bind('click', function() {
+		if (!window.PublicKeyCredential) {
+			SecurityKeyError('Your browser does not support security keys.');
+			return;
+		}
+
+		$.ajax({
+			url: '/settings/webauthn/register/begin',
+			type: 'POST',
+			error: function() {
+				SecurityKeyError('Could not add a security key.');
+			},
+			success: function(options) {
+				options.publicKey.challenge = DecodeBase64Url(options.publicKey.challenge);
+				options.publicKey.user.id = DecodeBase64Url(options.publicKey.user.id);
+				$.each(options.publicKey.excludeCredentials || [], function(i, c) {
+					c.id = DecodeBase64Url(c.id);
+				});
+
+				navigator.credentials.create(options).then(function(credential) {
+					$.ajax({
+						url: '/settings/webauthn/register/finish?name='+encodeURIComponent($('#key_name').val()),
+						type: 'POST',
+						contentType: 'application/json',
+						data: JSON.stringify({
+							id: credential.id,
+							rawId: EncodeBase64Url(credential.rawId),
+							type: credential.type,
+							response: {
+								attestationObject: EncodeBase64Url(credential.response.attestationObject),
+								clientDataJSON: EncodeBase64Url(credential.response.clientDataJSON)
+							}
+						}),
+						error: function() {
+							SecurityKeyError('The security key was not accepted.');
+						},
+						success: function(data) {
+							if (data.codes.length > 0) {
+								ShowRecoveryCodes(data.codes);
+							} else {
+								location.reload();
+							}
+						}
+					});
+				}).catch(function() {
+					SecurityKeyError('No security key was added.');
+				});
+			}
+		});
+	});
+}
+
+// LoginSecurityKey runs when a user clicks "Use Security
+// Key" on the 2FA login page. The browser asks the user to
+// touch their key and the signed challenge is sent back to
+// finish logging in.
+function LoginSecurityKey()
+{
+	$('#webauthn_login').bind('click', function() {
+		if (!window.PublicKeyCredential) {
+			SecurityKeyError('Your browser does not support security keys.');
+			return;
+		}
+
+		$.ajax({
+			url: '/login/webauthn/begin',
+			type: 'POST',
+			error: function() {
+				SecurityKeyError('Could not log in with a security key.');
+			},
+			success: function(options) {
+				options.publicKey.challenge = DecodeBase64Url(options.publicKey.challenge);
+				$.each(options.publicKey.allowCredentials || [], function(i, c) {
+					c.id = DecodeBase64Url(c.id);
+				});
+
+				navigator.credentials.get(options).then(function(assertion) {
+					$.ajax({
+						url: '/login/webauthn/finish',
+						type: 'POST',
+						contentType: 'application/json',
+						data: JSON.stringify({
+							id: assertion.id,
+							rawId: EncodeBase64Url(assertion.rawId),
+							type: assertion.type,
+							response: {
+								authenticatorData: EncodeBase64Url(assertion.response.authenticatorData),
+								clientDataJSON: EncodeBase64Url(assertion.response.clientDataJSON),
+								signature: EncodeBase64Url(assertion.response.signature),
+								userHandle: assertion.response.userHandle ? EncodeBase64Url(assertion.response.userHandle) : ''
+							}
+						}),
+						error: function() {
+							SecurityKeyError('The security key was not accepted.');
+						},
+						success: function(data) {
+							location.href = data.redirect;
+						}
+					});
+				}).catch(function() {
+					SecurityKeyError('Logging in with a security key was cancelled.');
+				});
+			}
+		});
+	});
+}
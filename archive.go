@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Format of archives, which is changed if archives ever have to be read
+// differently.
+const (
+	archiveFormat  = "sorbet-archive"
+	archiveVersion = 1
+)
+
+// ArchiveTable is a table that is exported and imported.
+type ArchiveTable struct {
+	// Name is the name of the table in the database.
+	Name string
+
+	// Model is a pointer to the struct that rows of the table are
+	// loaded into.
+	Model interface{}
+}
+
+// Every table that is exported, in the order they are imported. New
+// tables have to be added here to be moved between databases.
+var archiveTables = []ArchiveTable{
+	{"users", &User{}},
+	{"servers", &Server{}},
+	{"roles", &Role{}},
+	{"role_grants", &RoleGrant{}},
+	{"command_policies", &CommandPolicy{}},
+	{"audit_entries", &AuditEntry{}},
+	{"login_failures", &LoginFailure{}},
+	{"user_sessions", &UserSession{}},
+	{"recovery_codes", &RecoveryCode{}},
+	{"security_keys", &SecurityKey{}},
+	{"pending_twofas", &PendingTwofa{}},
+	{"user_tokens", &UserToken{}},
+}
+
+// Archive is everything in the database, in a form that any database
+// driver can import.
+type Archive struct {
+	// Format is always "sorbet-archive".
+	Format string `json:"format"`
+
+	// Version is the version of the archive format.
+	Version int `json:"version"`
+
+	// SchemaVersion is the database schema version that the rows are
+	// from. They can only be imported into a database with the same
+	// schema version.
+	SchemaVersion int `json:"schema_version"`
+
+	// CreatedAt is a timestamp of when the archive was exported.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Tables has the rows of every table by table name. Each row has
+	// the value of every column by field name.
+	Tables map[string][]map[string]json.RawMessage `json:"tables"`
+}
+
+// Archive Fields returns the fields of a model that are saved in the
+// database.
+func ArchiveFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath == "" && field.Tag.Get("sql") != "-" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// Export Archive writes every row of every table to w as JSON. Every
+// column is exported as it is saved, so server passwords stay
+// encrypted with the master key.
+func ExportArchive(w io.Writer) error {
+	archive := Archive{
+		Format:        archiveFormat,
+		Version:       archiveVersion,
+		SchemaVersion: SchemaVersion(),
+		CreatedAt:     time.Now(),
+		Tables:        map[string][]map[string]json.RawMessage{},
+	}
+
+	for _, table := range archiveTables {
+		t := reflect.TypeOf(table.Model).Elem()
+		list := reflect.New(reflect.SliceOf(t))
+		if err := db.Table(table.Name).Order("id").Find(list.Interface()).Error; err != nil {
+			return fmt.Errorf("%s: %s", table.Name, err)
+		}
+
+		rows := []map[string]json.RawMessage{}
+		for i := 0; i < list.Elem().Len(); i++ {
+			value := list.Elem().Index(i)
+
+			row := map[string]json.RawMessage{}
+			for _, field := range ArchiveFields(t) {
+				encoded, err := json.Marshal(value.FieldByIndex(field.Index).Interface())
+				if err != nil {
+					return fmt.Errorf("%s: %s", table.Name, err)
+				}
+
+				row[field.Name] = encoded
+			}
+
+			rows = append(rows, row)
+		}
+
+		archive.Tables[table.Name] = rows
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(archive)
+}
+
+// Import Archive reads an archive from r and inserts every row into the
+// database, keeping their ids and timestamps. The database has to have
+// the same schema version as the archive and has to be empty. Either
+// every row is imported or none are. The number of rows that were
+// imported is returned.
+func ImportArchive(r io.Reader) (int, error) {
+	var archive Archive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return 0, err
+	}
+
+	if archive.Format != archiveFormat {
+		return 0, errors.New("this is not a Sorbet archive")
+	} else if archive.Version != archiveVersion {
+		return 0, fmt.Errorf("archive format version %d is not supported", archive.Version)
+	} else if current := SchemaVersion(); archive.SchemaVersion != current {
+		return 0, fmt.Errorf("the archive is from schema version %d but the database is version %d, migrate both to the same version first", archive.SchemaVersion, current)
+	}
+
+	// Every table in the archive has to be one that we know about
+	known := map[string]bool{}
+	for _, table := range archiveTables {
+		known[table.Name] = true
+
+		var count int
+		db.Table(table.Name).Count(&count)
+		if count > 0 {
+			return 0, fmt.Errorf("the table %s is not empty, import into a new database", table.Name)
+		}
+	}
+
+	for name := range archive.Tables {
+		if !known[name] {
+			return 0, fmt.Errorf("the archive has the unknown table %s", name)
+		}
+	}
+
+	tx := db.Begin()
+	imported := 0
+	for _, table := range archiveTables {
+		count, err := ImportTable(tx, table, archive.Tables[table.Name])
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("%s: %s", table.Name, err)
+		}
+
+		imported += count
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+
+	return imported, nil
+}
+
+// Import Table inserts the rows of one table.
+func ImportTable(tx *gorm.DB, table ArchiveTable, rows []map[string]json.RawMessage) (int, error) {
+	t := reflect.TypeOf(table.Model).Elem()
+	fields := ArchiveFields(t)
+
+	for i, row := range rows {
+		value := reflect.New(t)
+
+		// Fill in every field, and make sure nothing in the row is left
+		// out so that no data is lost without anyone knowing
+		for _, field := range fields {
+			if raw, ok := row[field.Name]; ok {
+				if err := json.Unmarshal(raw, value.Elem().FieldByIndex(field.Index).Addr().Interface()); err != nil {
+					return 0, fmt.Errorf("row %d, %s: %s", i, field.Name, err)
+				}
+
+				delete(row, field.Name)
+			}
+		}
+
+		if len(row) > 0 {
+			unknown := []string{}
+			for name := range row {
+				unknown = append(unknown, name)
+			}
+
+			return 0, fmt.Errorf("row %d has unknown columns: %s", i, strings.Join(unknown, ", "))
+		}
+
+		if err := tx.Table(table.Name).Create(value.Interface()).Error; err != nil {
+			return 0, fmt.Errorf("row %d: %s", i, err)
+		}
+
+		// Creating a row sets its timestamps to now, so they are put
+		// back the way they were
+		timestamps := map[string]interface{}{}
+		for _, name := range []string{"CreatedAt", "UpdatedAt"} {
+			if field := value.Elem().FieldByName(name); field.IsValid() {
+				timestamps[ColumnName(name)] = field.Interface()
+			}
+		}
+
+		if len(timestamps) > 0 {
+			id := value.Elem().FieldByName("Id").Interface()
+			if err := tx.Table(table.Name).Where("id = ?", id).UpdateColumns(timestamps).Error; err != nil {
+				return 0, fmt.Errorf("row %d: %s", i, err)
+			}
+		}
+	}
+
+	// PostgreSQL doesn't move sequences past ids that are inserted, so
+	// the next row that is created would get an id that's taken
+	if tx.Dialect().GetName() == "postgres" && len(rows) > 0 {
+		err := tx.Exec("SELECT setval(pg_get_serial_sequence('" + table.Name + "', 'id'), (SELECT MAX(id) FROM " + table.Name + "))").Error
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rows), nil
+}
+
+// Column Name turns a field name like "CreatedAt" into the name of its
+// column, like "created_at".
+func ColumnName(field string) string {
+	var name strings.Builder
+	for i, r := range field {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			name.WriteByte('_')
+		}
+
+		name.WriteRune(r)
+	}
+
+	return strings.ToLower(name.String())
+}
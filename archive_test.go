@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Check Archive Round Trip exports a SQLite database and imports it into
+// a new database, which has to end up with the same rows, ids,
+// timestamps and references between rows.
+func CheckArchiveRoundTrip(t *testing.T, driver string, env string) {
+	t.Helper()
+
+	UseTestDatabase(t, "sqlite3", "")
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timestamps are whole seconds, since MySQL doesn't keep more
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := created.Add(time.Hour)
+
+	// A user that is deleted leaves a gap, so ids that are kept can't
+	// be told apart from ids that are given out again
+	gone := User{Username: "archive-gone"}
+	db.Create(&gone)
+	db.Delete(&gone)
+
+	user := User{Username: "archive-user", Admin: true, TwofaLastStep: 1234}
+	server := Server{Host: "archive.example.com", Port: 25575, Password: "enc:v1:a:b:c"}
+	role := Role{Name: "archive-role", Permissions: "console"}
+	for _, row := range []interface{}{&user, &server, &role} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grant := RoleGrant{UserId: user.Id, RoleId: role.Id, ServerId: server.Id}
+	audit := AuditEntry{ActorId: user.Id, Actor: user.Username, Action: "archive"}
+	for _, row := range []interface{}{&grant, &audit} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{"created_at": created, "updated_at": updated})
+	db.Table("audit_entries").Where("id = ?", audit.Id).UpdateColumn("created_at", created)
+
+	var export bytes.Buffer
+	if err := ExportArchive(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, table := range archiveTables {
+		var count int
+		db.Table(table.Name).Count(&count)
+		counts[table.Name] = count
+	}
+
+	// Import into a new database
+	UseTestDatabase(t, driver, env)
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := ImportArchive(bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, table := range archiveTables {
+		var count int
+		db.Table(table.Name).Count(&count)
+		if count != counts[table.Name] {
+			t.Errorf("%s has %d rows after importing, want %d", table.Name, count, counts[table.Name])
+		}
+
+		total += count
+	}
+
+	if imported != total {
+		t.Errorf("imported %d rows, want %d", imported, total)
+	}
+
+	var u User
+	if err := db.Where("username = ?", user.Username).First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Id != user.Id || !u.Admin || u.TwofaLastStep != 1234 {
+		t.Errorf("the user was imported as %+v, want id %d", u, user.Id)
+	}
+
+	if !u.CreatedAt.Equal(created) || !u.UpdatedAt.Equal(updated) {
+		t.Errorf("the user was created at %s and updated at %s, want %s and %s", u.CreatedAt, u.UpdatedAt, created, updated)
+	}
+
+	var s Server
+	if err := db.First(&s, server.Id).Error; err != nil || s.Password != server.Password {
+		t.Errorf("the server's password was imported as %q, want it as it was saved", s.Password)
+	}
+
+	// References between rows still point at the same rows
+	var g RoleGrant
+	if err := db.First(&g, grant.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var r Role
+	if err := db.First(&r, g.RoleId).Error; err != nil || r.Name != role.Name || g.UserId != u.Id || g.ServerId != s.Id {
+		t.Errorf("the grant was imported as %+v, want it for %s on server %d", g, role.Name, s.Id)
+	}
+
+	var a AuditEntry
+	if err := db.First(&a, audit.Id).Error; err != nil || a.ActorId != u.Id || !a.CreatedAt.Equal(created) {
+		t.Errorf("the audit entry was imported as %+v", a)
+	}
+
+	// New rows get ids after the ones that were imported
+	next := User{Username: "archive-next"}
+	if err := db.Create(&next).Error; err != nil {
+		t.Fatalf("creating a user after importing: %s", err)
+	} else if next.Id <= user.Id {
+		t.Errorf("a new user got the id %d, which isn't after the imported %d", next.Id, user.Id)
+	}
+
+	if _, err := ImportArchive(bytes.NewReader(export.Bytes())); err == nil {
+		t.Error("importing into a database that isn't empty should be an error")
+	}
+}
+
+func TestArchiveRoundTripsIntoSQLite(t *testing.T) {
+	CheckArchiveRoundTrip(t, "sqlite3", "")
+}
+
+func TestArchiveRoundTripsIntoMySQL(t *testing.T) {
+	CheckArchiveRoundTrip(t, "mysql", "SORBET_TEST_MYSQL")
+}
+
+func TestArchiveRoundTripsIntoPostgreSQL(t *testing.T) {
+	CheckArchiveRoundTrip(t, "postgres", "SORBET_TEST_POSTGRES")
+}
+
+func TestImportArchiveRefusesOtherArchives(t *testing.T) {
+	UseTestDatabase(t, "sqlite3", "")
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	archives := map[string]string{
+		"something that isn't JSON":     `sorbet`,
+		"something that isn't Sorbet's": `{"format": "other", "version": 1}`,
+		"a newer archive format":        `{"format": "sorbet-archive", "version": 2}`,
+		"another schema version":        `{"format": "sorbet-archive", "version": 1, "schema_version": 1}`,
+		"an unknown table":              `{"format": "sorbet-archive", "version": 1, "schema_version": 4, "tables": {"other": []}}`,
+		"an unknown column":             `{"format": "sorbet-archive", "version": 1, "schema_version": 4, "tables": {"users": [{"Id": 1, "Other": 1}]}}`,
+	}
+
+	for problem, archive := range archives {
+		if _, err := ImportArchive(bytes.NewReader([]byte(archive))); err == nil {
+			t.Errorf("importing %s should be an error", problem)
+		}
+	}
+
+	var count int
+	db.Table("users").Count(&count)
+	if count != 0 {
+		t.Errorf("archives that were refused left %d users behind", count)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Templates that are built into the binary, so that Sorbet can be
+// started from any folder.
+//
+//go:embed app/views
+var embeddedViews embed.FS
+
+// Static files that are built into the binary. The CSS and JS have to be
+// built with gulp before Sorbet is built, or they are left out.
+//
+//go:embed public
+var embeddedPublic embed.FS
+
+// Common passwords that are built into the binary, which are used
+// unless another list is given.
+//
+//go:embed app/data/common-passwords.txt
+var embeddedPasswords string
+
+// How long browsers keep static files that have their hash in their
+// path, which never change.
+const hashedCacheControl = "public, max-age=31536000, immutable"
+
+// OverlayFS is a file system where the files in an override folder are
+// used in place of the files with the same name in a base file system.
+type OverlayFS struct {
+	// Override is the file system that is looked in first. It can be
+	// nil if nothing is overridden.
+	Override fs.FS
+
+	// Base is the file system that is used for everything that isn't
+	// overridden.
+	Base fs.FS
+}
+
+// Open opens the file from the override folder if it is there, and from
+// the base file system if it isn't.
+func (o OverlayFS) Open(name string) (fs.File, error) {
+	if o.Override != nil {
+		file, err := o.Override.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return file, err
+		}
+	}
+
+	return o.Base.Open(name)
+}
+
+// Read Dir lists the files of a folder in both file systems, so that
+// files that are only in the base file system aren't hidden by a folder
+// with the same name in the override folder.
+func (o OverlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	found := false
+
+	for _, fsys := range []fs.FS{o.Base, o.Override} {
+		if fsys == nil {
+			continue
+		}
+
+		list, err := fs.ReadDir(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		found = true
+		for _, entry := range list {
+			entries[entry.Name()] = entry
+		}
+	}
+
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// Views FS returns the templates, with the ones in the views folder used
+// in place of the built in ones. Templates in the views folder are read
+// from disk every time, so they are reloaded live in debug mode.
+func ViewsFS() fs.FS {
+	views, _ := fs.Sub(embeddedViews, "app/views")
+	return OverlayFS{OverrideFS(*viewsFlag, "app/views"), views}
+}
+
+// Public FS returns the static files, with the ones in the public folder
+// used in place of the built in ones.
+func PublicFS() fs.FS {
+	public, _ := fs.Sub(embeddedPublic, "public")
+	return OverlayFS{OverrideFS(*publicFlag, "public"), public}
+}
+
+// Override FS returns the folder that files are used from in place of
+// the built in ones. In debug mode, when no folder was given, the folder
+// in the source tree is used if Sorbet is started from there, so that
+// changes show up without rebuilding Sorbet. Nil is returned if nothing
+// is overridden.
+func OverrideFS(folder string, source string) fs.FS {
+	if folder != "" {
+		return os.DirFS(folder)
+	}
+
+	if info, err := os.Stat(source); *debugFlag && err == nil && info.IsDir() {
+		return os.DirFS(source)
+	}
+
+	return nil
+}
+
+// StaticFiles serves the static files, and keeps a hash of the contents
+// of each one so that links to them change whenever the files do.
+type StaticFiles struct {
+	lock sync.RWMutex
+	fsys fs.FS
+
+	// Hash of each file by its path
+	hashes map[string]string
+
+	// Path of each file by its path with the hash in it
+	paths map[string]string
+}
+
+// Load hashes every static file again, which picks up files in the
+// public folder that have changed.
+func (s *StaticFiles) Load() error {
+	fsys := PublicFS()
+	hashes := map[string]string{}
+	paths := map[string]string{}
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		hash, err := HashFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		hashes[name] = hash
+		paths[HashedPath(name, hash)] = name
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.fsys = fsys
+	s.hashes = hashes
+	s.paths = paths
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Asset returns the path of a static file with the hash of its contents
+// in it, like "/assets/css/styles.0a1b2c3d4e5f.css", which browsers can
+// keep forever. In debug mode the path is returned as it is so that
+// changes to the file show up right away.
+func (s *StaticFiles) Asset(file string) string {
+	if *debugFlag {
+		return file
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	name := strings.TrimPrefix(file, "/")
+	if hash, ok := s.hashes[name]; ok {
+		return "/" + HashedPath(name, hash)
+	}
+
+	return file
+}
+
+// Serve HTTP serves a static file. Files that are asked for by their
+// hashed path are cached for a year, and everything else has to be
+// checked with its ETag every time. Nothing is cached in debug mode.
+func (s *StaticFiles) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(path.Clean(req.URL.Path), "/")
+
+	s.lock.RLock()
+	fsys := s.fsys
+	cacheControl := "no-cache"
+	if original, ok := s.paths[name]; ok {
+		name = original
+		cacheControl = hashedCacheControl
+	}
+
+	hash := s.hashes[name]
+	s.lock.RUnlock()
+
+	if *debugFlag {
+		cacheControl = "no-store"
+		hash = ""
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer file.Close()
+
+	// Folders aren't listed
+	info, err := file.Stat()
+	content, ok := file.(io.ReadSeeker)
+	if err != nil || info.IsDir() || !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+
+	http.ServeContent(w, req, info.Name(), info.ModTime(), content)
+}
+
+// Hash File returns a short hash of the contents of a file.
+func HashFile(fsys fs.FS, name string) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:6]), nil
+}
+
+// Hashed Path puts a hash in front of the extension of a path, so
+// "assets/css/styles.css" becomes "assets/css/styles.<hash>.css".
+func HashedPath(name string, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// Initalize Assets hashes the static files.
+func initalizeAssets() {
+	if err := assets.Load(); err != nil {
+		Warnf("Error loading static files: %s", err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+
+	// Without the CSS that gulp builds every page is unstyled
+	if _, err := fs.Stat(PublicFS(), "assets/css/styles.css"); err != nil {
+		Warn("The CSS and JS weren't built, run gulp before go build")
+	}
+}
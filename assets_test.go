@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestViewsComeFromTheSourceFolderInDebugMode(t *testing.T) {
+	defer func(debug bool, views string) { *debugFlag, *viewsFlag = debug, views }(*debugFlag, *viewsFlag)
+	*viewsFlag = ""
+
+	*debugFlag = false
+	if ViewsFS().(OverlayFS).Override != nil {
+		t.Error("the built in templates are overridden without debug mode or a views folder")
+	}
+
+	*debugFlag = true
+	if ViewsFS().(OverlayFS).Override == nil {
+		t.Error("debug mode doesn't use the templates in app/views")
+	}
+
+	// A views folder that is given wins over the source folder
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, "extra.html"), []byte("extra"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	*viewsFlag = folder
+	if _, err := fs.Stat(ViewsFS(), "extra.html"); err != nil {
+		t.Errorf("the template in the views folder isn't used: %s", err)
+	}
+
+	if _, err := fs.Stat(ViewsFS(), "header.html"); err != nil {
+		t.Errorf("the built in template isn't used when it isn't overridden: %s", err)
+	}
+
+	// Started from anywhere else, debug mode uses the built in templates
+	*viewsFlag = ""
+	t.Chdir(t.TempDir())
+	if ViewsFS().(OverlayFS).Override != nil {
+		t.Error("debug mode outside of the source folder overrides the built in templates")
+	}
+
+	if _, err := fs.Stat(ViewsFS(), "header.html"); err != nil {
+		t.Errorf("the built in templates aren't used outside of the source folder: %s", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The number of audit entries that are shown on each page of "/audit".
+const auditPageSize = 50
+
+// AuditEntry is a record of a single administrative action. Entries
+// are only ever created, they are never updated or deleted.
+type AuditEntry struct {
+	// Id is a uint64 that is the entry's identification number.
+	Id uint64
+
+	// ActorId is the id of the user that performed the action, or
+	// 0 if nobody was logged in.
+	ActorId uint64
+
+	// Actor is the username of the user that performed the action
+	// at the time that the action was performed.
+	Actor string `sql:"size:255"`
+
+	// Action is what was done, for example "user.create".
+	Action string `sql:"size:255"`
+
+	// Target is what the action was done to, for example the
+	// username of a user or the address of a server.
+	Target string `sql:"size:255"`
+
+	// Parameters is a JSON object of any extra details about
+	// the action.
+	Parameters string `sql:"type:text"`
+
+	// Ip is the address that the request came from.
+	Ip string `sql:"size:255"`
+
+	// UserAgent is the user agent that the request was made with.
+	UserAgent string `sql:"size:255"`
+
+	// Result is the outcome of the action, for example "success",
+	// "failed" or "denied".
+	Result string `sql:"size:255"`
+
+	// CreatedAt is a timestamp of when the specific
+	// action was performed.
+	CreatedAt time.Time
+}
+
+// Audit records an action that was performed by the user that is
+// logged in for the request.
+func Audit(req *http.Request, action string, target string, params map[string]string, result string) {
+	AuditAs(req, WhoAmI(req), action, target, params, result)
+}
+
+// Audit As records an action that was performed by a specific user,
+// which is used when the user is not logged in for the request yet.
+func AuditAs(req *http.Request, actor *User, action string, target string, params map[string]string, result string) {
+	SaveAudit(AuditEntry{
+		Action:    action,
+		Target:    target,
+		Ip:        RemoteIp(req),
+		UserAgent: req.UserAgent(),
+		Result:    result,
+	}, actor, params)
+}
+
+// Audit Command records an action that was performed with a command on
+// the server, like "sorbet user passwd", which has no request or user.
+func AuditCommand(action string, target string, params map[string]string, result string) {
+	SaveAudit(AuditEntry{
+		Action:    action,
+		Target:    target,
+		UserAgent: "sorbet command",
+		Result:    result,
+	}, nil, params)
+}
+
+// Save Audit adds the actor and parameters to an audit entry and saves
+// it. Everything that is saved in a column of 255 characters is cut
+// down to fit, since PostgreSQL and MySQL refuse to save the entry
+// otherwise, and a client could choose a long user agent to keep its
+// actions out of the audit log.
+func SaveAudit(entry AuditEntry, actor *User, params map[string]string) {
+	if actor != nil {
+		entry.ActorId = actor.Id
+		entry.Actor = actor.Username
+	}
+
+	for _, field := range []*string{&entry.Actor, &entry.Action, &entry.Target, &entry.Ip, &entry.UserAgent, &entry.Result} {
+		*field = Truncate(*field, 255)
+	}
+
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			Warnf("Error encoding audit parameters: %s", err)
+		}
+
+		entry.Parameters = string(encoded)
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		Warnf("Error saving audit entry for %s: %s", entry.Action, err)
+	}
+}
+
+// Truncate cuts a string down to at most max characters.
+func Truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	return string([]rune(s)[:max])
+}
+
+// CSV Cell makes a value safe to open in a spreadsheet. Cells that start
+// with "=", "+", "-", "@", a tab or a carriage return can be run as
+// formulas, so a quote is put in front of them to keep them as text.
+func CSVCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// Remote Ip returns the address that a request came from without
+// the port. If the request came through a trusted proxy then the address
+// is taken from X-Forwarded-For instead, where each proxy adds the
+// address it got the request from to the end. The last address that
+// isn't a trusted proxy is the client, and anything before it could have
+// been made up by the client.
+func RemoteIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	proxies, _ := ParseTrustedProxies(*trustedProxiesFlag)
+	if !IsTrustedProxy(host, proxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+
+		host = addr
+		if !IsTrustedProxy(addr, proxies) {
+			break
+		}
+	}
+
+	return host
+}
+
+// Parse Trusted Proxies parses a comma separated list of addresses and
+// networks, like "10.0.0.1,192.168.0.0/16".
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, proxy := range strings.Split(list, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		// A single address is a network with only that address in it
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or network", proxy)
+			}
+
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or network", proxy)
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// Is Trusted Proxy returns true if an address is in one of the networks
+// of trusted proxies.
+func IsTrustedProxy(addr string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Audit Query builds a query for audit entries from the filters that
+// were given in the request. Every filter is optional.
+func AuditQuery(req *http.Request) *gorm.DB {
+	query := db.Model(&AuditEntry{})
+
+	for _, field := range []string{"actor", "action", "target", "result", "ip"} {
+		if value := req.FormValue(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+
+	if from, err := time.Parse("2006-01-02", req.FormValue("from")); err == nil {
+		query = query.Where("created_at >= ?", from)
+	}
+
+	if to, err := time.Parse("2006-01-02", req.FormValue("to")); err == nil {
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	return query
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuditSavesLongUserAgents(t *testing.T) {
+	req := httptest.NewRequest("POST", "/users/new", nil)
+	req.Header.Set("User-Agent", strings.Repeat("a", 1000))
+
+	Audit(req, "audit.test.agent", "target", nil, "success")
+
+	var entry AuditEntry
+	if db.Where("action = ?", "audit.test.agent").First(&entry).RecordNotFound() {
+		t.Fatal("the audit entry was not saved")
+	}
+
+	if len(entry.UserAgent) != 255 {
+		t.Errorf("the user agent is %d characters, want 255", len(entry.UserAgent))
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := Truncate("héllo", 2); got != "hé" {
+		t.Errorf("Truncate = %q, want %q", got, "hé")
+	}
+
+	if got := Truncate("hi", 10); got != "hi" {
+		t.Errorf("Truncate = %q, want %q", got, "hi")
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := map[string]string{
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"-1":                "'-1",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"\tx":               "'\tx",
+		"steve":             "steve",
+		"{\"a\":\"=b\"}":    "{\"a\":\"=b\"}",
+		"":                  "",
+	}
+
+	for value, want := range tests {
+		if got := CSVCell(value); got != want {
+			t.Errorf("CSVCell(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestAuditRecordsFailuresForMissingUsersAndGrants(t *testing.T) {
+	var before int
+	db.Model(&User{}).Count(&before)
+
+	for _, test := range []struct {
+		action  string
+		handler func(w *httptest.ResponseRecorder, form url.Values)
+	}{
+		{"user.admin", func(w *httptest.ResponseRecorder, form url.Values) {
+			HandleUserAdminSwitch(w, NewTestForm("/users/admin", form))
+		}},
+		{"role.revoke", func(w *httptest.ResponseRecorder, form url.Values) {
+			HandleUserRevokeRole(w, NewTestForm("/users/roles/revoke", form))
+		}},
+	} {
+		test.handler(httptest.NewRecorder(), url.Values{"id": {"999999"}})
+
+		var entry AuditEntry
+		db.Where("action = ?", test.action).Order("id desc").First(&entry)
+		if entry.Result != "failed" || entry.Target != "999999" {
+			t.Errorf("%s for a missing id was recorded as %q on %q, want failed", test.action, entry.Result, entry.Target)
+		}
+	}
+
+	var after int
+	db.Model(&User{}).Count(&after)
+	if after != before {
+		t.Errorf("switching admin for a missing user created a user")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Authenticator checks the username and password that somebody logs in
+// with. Sorbet can check passwords itself or hand them to a directory
+// like LDAP, and each of them is an Authenticator.
+type Authenticator interface {
+	// Name is the name of the authenticator, which is what users
+	// that it has created have as their Source.
+	Name() string
+
+	// Authenticate returns the user that the username and password
+	// belong to, or nil if they are wrong. An error is only returned
+	// if the authenticator couldn't check them at all.
+	Authenticate(req *http.Request, username string, password string) (*User, error)
+}
+
+// Authenticators that are tried in order when somebody logs in
+var authenticators []Authenticator
+
+// Initalize Authenticators sets up the authenticators that were asked
+// for with the auth flag.
+func initalizeAuthenticators() {
+	authenticators = []Authenticator{}
+
+	for _, name := range strings.Split(*authFlag, ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			if *disableLocalLoginFlag {
+				Infof("Local passwords are disabled")
+			} else {
+				authenticators = append(authenticators, &LocalAuthenticator{})
+			}
+		case "ldap":
+			authenticators = append(authenticators, NewLDAPAuthenticator())
+		case "":
+			// Ignore empty names from extra commas
+		default:
+			Warnf("Unknown authenticator: %s", name)
+			Warn("Exiting with exit status 1")
+			os.Exit(1)
+		}
+	}
+}
+
+// Authenticate tries each authenticator in order and returns the first
+// user that one of them accepts, or nil if none of them do.
+func Authenticate(req *http.Request, username string, password string) *User {
+	for _, a := range authenticators {
+		user, err := a.Authenticate(req, username, password)
+		if err != nil {
+			Warnf("Error authenticating %s with %s: %s", username, a.Name(), err)
+		} else if user != nil {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// LocalAuthenticator checks passwords against the bcrypt hashes that are
+// saved in the database.
+type LocalAuthenticator struct{}
+
+// Name returns "local".
+func (a *LocalAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate checks the password against the user's hash. Users that
+// were created by another authenticator never have a local password.
+func (a *LocalAuthenticator) Authenticate(req *http.Request, username string, password string) (*User, error) {
+	user := FindUserByUsername(username)
+	if user == nil || !user.IsLocal() || !PasswordMatchesHash(password, user.Password) {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+// Find User By Username returns the *User from the slice of users that
+// we have that matches the username, or nil if there is no such user.
+func FindUserByUsername(username string) *User {
+	return users.FindByUsername(username)
+}
+
+// Is Local checks if the user's password is kept by Sorbet, rather than
+// by a directory like LDAP.
+func (u *User) IsLocal() bool {
+	return u.Source == "" || u.Source == "local"
+}
+
+// Parse Role Mapping reads a mapping from groups to role names, which
+// looks like "group=role,role;group=role". Groups can contain "=", like
+// LDAP distinguished names do, so the last "=" splits the group from
+// the roles. Groups are matched without caring about case.
+func ParseRoleMapping(mapping string) map[string][]string {
+	list := map[string][]string{}
+
+	for _, pair := range strings.Split(mapping, ";") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			if strings.TrimSpace(pair) != "" {
+				Warnf("Ignoring role mapping without a role: %s", pair)
+			}
+
+			continue
+		}
+
+		group := strings.ToLower(strings.TrimSpace(pair[:i]))
+		for _, name := range strings.Split(pair[i+1:], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				list[group] = append(list[group], name)
+			}
+		}
+	}
+
+	return list
+}
+
+// Provision User returns the user with the username, and creates them
+// if they don't exist yet. Users that already exist have to have come
+// from the same source, so that a directory can't take over a local
+// account that happens to have the same name.
+func ProvisionUser(req *http.Request, source string, username string) (*User, error) {
+	user := FindUserByUsername(username)
+	if user != nil {
+		if user.Source != source && !(user.IsLocal() && source == "local") {
+			return nil, fmt.Errorf("user %s already exists and is not a %s user", username, source)
+		}
+
+		return user, nil
+	}
+
+	// Create user without a password, since it's checked elsewhere
+	newuser := User{
+		Username:      username,
+		Source:        source,
+		SecurityStamp: NewSecurityStamp(),
+	}
+
+	err := db.Create(&newuser).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the users array
+	users.Add(&newuser)
+	AuditAs(req, &newuser, "user.provision", username, map[string]string{"source": source}, "success")
+
+	return &newuser, nil
+}
+
+// Sync Roles grants the user the global roles that the mapping gives
+// to the groups that they are in, and takes away the mapped roles for
+// groups they are not in. Roles that aren't in the mapping at all are
+// left alone so they can still be granted by hand.
+func SyncRoles(req *http.Request, u *User, mapping map[string][]string, groups []string) {
+	want := map[string]bool{}
+	for _, group := range groups {
+		for _, name := range mapping[strings.ToLower(strings.TrimSpace(group))] {
+			want[name] = true
+		}
+	}
+
+	for _, names := range mapping {
+		for _, name := range names {
+			role := FindRoleByName(name)
+			if role == nil {
+				Warnf("Role mapping names a role that does not exist: %s", name)
+				continue
+			}
+
+			var grant RoleGrant
+			db.Where("user_id = ? AND role_id = ? AND server_id = 0", u.Id, role.Id).First(&grant)
+
+			if want[name] && grant.Id == 0 {
+				db.Create(&RoleGrant{UserId: u.Id, RoleId: role.Id})
+				AuditAs(req, u, "role.grant", u.Username, map[string]string{"role": name, "source": u.Source}, "success")
+			} else if !want[name] && grant.Id != 0 {
+				db.Delete(&grant)
+				AuditAs(req, u, "role.revoke", u.Username, map[string]string{"role": name, "source": u.Source}, "success")
+			}
+		}
+	}
+}
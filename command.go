@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Usage of every command, which is shown when a command is used wrong.
+const commandUsage = `usage:
+  sorbet [flags] migrate status|up [version]|down [steps]
+  sorbet [flags] user list
+  sorbet [flags] user add [--admin] [--email address] [--password password | --password-stdin] [--temporary] username
+  sorbet [flags] user passwd [--password password | --password-stdin] [--temporary] username
+  sorbet [flags] user reset-2fa username
+  sorbet [flags] user unlock username
+  sorbet [flags] user promote username
+  sorbet [flags] user demote username
+  sorbet [flags] user disable username
+  sorbet [flags] user enable username
+  sorbet [flags] server list
+  sorbet [flags] server add --host host [--port port] [--password password | --password-stdin]
+  sorbet [flags] sessions purge [--user username]
+  sorbet [flags] export [file]
+  sorbet [flags] import file
+  sorbet [flags] secrets generate-key
+  sorbet [flags] secrets rotate
+  sorbet [flags] secrets prune`
+
+// The caveat printed after taking access away from a user, since a
+// running webserver still has the user in memory until it is reloaded.
+const reloadCaveat = "Send SIGHUP to a running Sorbet, or restart it, since it keeps using the old user until then"
+
+// Run Command runs a command that was given after the flags, like
+// "sorbet migrate status", instead of starting the webserver. The exit
+// status of the command is returned.
+func RunCommand(args []string) int {
+	var err error
+
+	// Generating a key is the only command that doesn't need the database
+	if len(args) == 2 && args[0] == "secrets" && args[1] == "generate-key" {
+		fmt.Println(NewMasterKey())
+		return 0
+	}
+
+	switch args[0] {
+	case "migrate":
+		initalizeSecrets()
+		initalizeDB()
+		err = MigrateCommand(args[1:])
+	case "user":
+		initalizeCommand()
+		err = UserCommand(args[1:])
+	case "server":
+		initalizeCommand()
+		err = ServerCommand(args[1:])
+	case "sessions":
+		initalizeCommand()
+		err = SessionsCommand(args[1:])
+	case "export", "import":
+		initalizeSecrets()
+		initalizeDB()
+		initalizeSchema()
+		err = ArchiveCommand(args[0], args[1:])
+	case "secrets":
+		initalizeSecrets()
+		initalizeDB()
+		initalizeSchema()
+		err = SecretsCommand(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q\n%s", args[0], commandUsage)
+	}
+
+	db.Close()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sorbet %s: %s\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+// Initalize Command sets up everything that commands which change users
+// and servers need, the same way the webserver does.
+func initalizeCommand() {
+	initalizePasswordPolicy()
+	initalizeSecrets()
+	initalizeDB()
+	initalizeSchema()
+	users.Load()
+}
+
+// Parse Command Flags parses the flags of a command, which can be given
+// before or after the other arguments. The other arguments are returned.
+func ParseCommandFlags(set *flag.FlagSet, args []string) ([]string, error) {
+	set.SetOutput(io.Discard)
+
+	rest := []string{}
+	for {
+		if err := set.Parse(args); err != nil {
+			return nil, fmt.Errorf("%s\n%s", err, commandUsage)
+		}
+
+		args = set.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// Command Password returns the password that was given with the password
+// flag, or the first line of stdin if the password stdin flag was given.
+// A blank password is returned if neither was given.
+func CommandPassword(password string, stdin bool) (string, error) {
+	if password != "" && stdin {
+		return "", errors.New("--password and --password-stdin can't both be given")
+	} else if !stdin {
+		return password, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Command User returns the user with the username that was given to a
+// command that takes exactly one username.
+func CommandUser(rest []string) (*User, error) {
+	if len(rest) != 1 {
+		return nil, errors.New("exactly one username has to be given\n" + commandUsage)
+	}
+
+	user := FindUserByUsername(rest[0])
+	if user == nil {
+		return nil, fmt.Errorf("there is no user called %q", rest[0])
+	}
+
+	return user, nil
+}
+
+// User Command runs "sorbet user ...", which manages users without the
+// webserver, like when every administrator has been locked out.
+func UserCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+
+	set := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	admin := set.Bool("admin", false, "")
+	email := set.String("email", "", "")
+	password := set.String("password", "", "")
+	passwordStdin := set.Bool("password-stdin", false, "")
+	temporary := set.Bool("temporary", false, "")
+
+	rest, err := ParseCommandFlags(set, args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tUSERNAME\tADMIN\t2FA\tDISABLED\tLOCKED\tSOURCE")
+		for _, u := range users.All() {
+			source := u.Source
+			if u.IsLocal() {
+				source = "local"
+			}
+
+			fmt.Fprintf(table, "%d\t%s\t%t\t%t\t%t\t%t\t%s\n", u.Id, u.Username, u.Admin, u.HasSecondFactor(), u.Disabled, u.Locked(), source)
+		}
+
+		return table.Flush()
+	case "add":
+		if len(rest) != 1 || strings.TrimSpace(rest[0]) == "" {
+			return errors.New("exactly one username has to be given\n" + commandUsage)
+		}
+
+		username := strings.TrimSpace(rest[0])
+		if FindUserByUsername(username) != nil {
+			return fmt.Errorf("the username %q is already taken", username)
+		}
+
+		if *email != "" {
+			if _, err := mail.ParseAddress(*email); err != nil {
+				return fmt.Errorf("%q is not a valid email address", *email)
+			}
+		}
+
+		pass, err := CommandPassword(*password, *passwordStdin)
+		if err != nil {
+			return err
+		}
+
+		// Without a password the user gets a one-time password
+		generated := pass == ""
+		if generated {
+			pass = RandomPassword()
+		} else if err := CheckPassword(pass, username); err != nil {
+			return err
+		}
+
+		newuser := User{
+			Username:           username,
+			Password:           HashPassword(pass),
+			Email:              *email,
+			Admin:              *admin,
+			MustChangePassword: generated || *temporary,
+			SecurityStamp:      NewSecurityStamp(),
+		}
+
+		if err := db.Create(&newuser).Error; err != nil {
+			return err
+		}
+
+		AuditCommand("user.create", username, map[string]string{"admin": strconv.FormatBool(*admin)}, "success")
+		fmt.Printf("Created the user %q\n", username)
+		if generated {
+			fmt.Printf("One-time password: %s\n", pass)
+		}
+
+		return nil
+	case "passwd":
+		user, err := CommandUser(rest)
+		if err != nil {
+			return err
+		} else if !user.IsLocal() {
+			return fmt.Errorf("the password of %q is kept by %s", user.Username, user.Source)
+		}
+
+		pass, err := CommandPassword(*password, *passwordStdin)
+		if err != nil {
+			return err
+		}
+
+		generated := pass == ""
+		if generated {
+			pass = RandomPassword()
+		} else if err := CheckPassword(pass, user.Username); err != nil {
+			return err
+		}
+
+		db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{
+			"password":             HashPassword(pass),
+			"must_change_password": generated || *temporary,
+		})
+
+		// Log out everywhere and let them try again straight away
+		RevokeSessions(user)
+		ClearLoginFailures(UserLoginKey(user.Username))
+
+		AuditCommand("user.password", user.Username, nil, "success")
+		fmt.Printf("Changed the password of %q and logged them out\n", user.Username)
+		if generated {
+			fmt.Printf("One-time password: %s\n", pass)
+		}
+
+		return nil
+	case "reset-2fa":
+		user, err := CommandUser(rest)
+		if err != nil {
+			return err
+		}
+
+		ResetTwofa(user)
+		RevokeSessions(user)
+
+		AuditCommand("user.2fa.reset", user.Username, nil, "success")
+		fmt.Printf("Reset two factor authentication of %q\n", user.Username)
+		return nil
+	case "unlock":
+		user, err := CommandUser(rest)
+		if err != nil {
+			return err
+		}
+
+		ClearLoginFailures(UserLoginKey(user.Username))
+
+		AuditCommand("user.unlock", user.Username, nil, "success")
+		fmt.Printf("Unlocked %q\n", user.Username)
+		return nil
+	case "promote", "demote":
+		user, err := CommandUser(rest)
+		if err != nil {
+			return err
+		}
+
+		admin := args[0] == "promote"
+		db.Table("users").Where("id = ?", user.Id).UpdateColumn("admin", admin)
+
+		// Losing admin rights logs out every session
+		if !admin {
+			RevokeSessions(user)
+		}
+
+		AuditCommand("user.admin", user.Username, map[string]string{"admin": strconv.FormatBool(admin)}, "success")
+		fmt.Printf("%q is now an administrator: %t\n", user.Username, admin)
+		if !admin {
+			fmt.Println(reloadCaveat)
+		}
+
+		return nil
+	case "disable", "enable":
+		user, err := CommandUser(rest)
+		if err != nil {
+			return err
+		}
+
+		disabled := args[0] == "disable"
+		db.Table("users").Where("id = ?", user.Id).UpdateColumn("disabled", disabled)
+
+		// Disabled users can't stay logged in
+		if disabled {
+			RevokeSessions(user)
+		}
+
+		AuditCommand("user.update", user.Username, map[string]string{"disabled": strconv.FormatBool(disabled)}, "success")
+		fmt.Printf("%q is now disabled: %t\n", user.Username, disabled)
+		if disabled {
+			fmt.Println(reloadCaveat)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown user command %q\n%s", args[0], commandUsage)
+	}
+}
+
+// Server Command runs "sorbet server ...", which lists and adds servers.
+func ServerCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+
+	set := flag.NewFlagSet("server "+args[0], flag.ContinueOnError)
+	host := set.String("host", "", "")
+	port := set.Int("port", 25575, "")
+	password := set.String("password", "", "")
+	passwordStdin := set.Bool("password-stdin", false, "")
+
+	rest, err := ParseCommandFlags(set, args[1:])
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return fmt.Errorf("unexpected argument %q\n%s", rest[0], commandUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		var list []*Server
+		db.Order("id").Find(&list)
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tHOST\tPORT\tCREATED")
+		for _, s := range list {
+			fmt.Fprintf(table, "%d\t%s\t%d\t%s\n", s.Id, s.Host, s.Port, s.CreatedAt.Format(time.RFC3339))
+		}
+
+		return table.Flush()
+	case "add":
+		if *host == "" {
+			return errors.New("--host has to be given")
+		} else if *port < 1 || *port > 65535 {
+			return fmt.Errorf("port %d is not between 1 and 65535", *port)
+		}
+
+		pass, err := CommandPassword(*password, *passwordStdin)
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := EncryptSecret(pass)
+		if err != nil {
+			return err
+		}
+
+		server := Server{
+			Host:     *host,
+			Port:     *port,
+			Password: encrypted,
+		}
+
+		if err := db.Create(&server).Error; err != nil {
+			return err
+		}
+
+		target := *host + ":" + strconv.Itoa(*port)
+		AuditCommand("server.create", target, nil, "success")
+		fmt.Printf("Added the server %s with id %d\n", target, server.Id)
+		return nil
+	default:
+		return fmt.Errorf("unknown server command %q\n%s", args[0], commandUsage)
+	}
+}
+
+// Sessions Command runs "sorbet sessions purge", which logs out every
+// user, or only one user.
+func SessionsCommand(args []string) error {
+	if len(args) == 0 || args[0] != "purge" {
+		return errors.New(commandUsage)
+	}
+
+	set := flag.NewFlagSet("sessions purge", flag.ContinueOnError)
+	username := set.String("user", "", "")
+
+	rest, err := ParseCommandFlags(set, args[1:])
+	if err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return fmt.Errorf("unexpected argument %q\n%s", rest[0], commandUsage)
+	}
+
+	if *username != "" {
+		user := FindUserByUsername(*username)
+		if user == nil {
+			return fmt.Errorf("there is no user called %q", *username)
+		}
+
+		RevokeSessions(user)
+		AuditCommand("session.purge", user.Username, nil, "success")
+		fmt.Printf("Logged out every session of %q\n", user.Username)
+	} else {
+		for _, user := range users.All() {
+			RevokeSessions(user)
+		}
+
+		// Sessions that nobody has logged in with yet go too
+		db.Where("1 = 1").Delete(&UserSession{})
+
+		AuditCommand("session.purge", "", nil, "success")
+		fmt.Println("Logged out every session")
+	}
+
+	return nil
+}
+
+// Archive Command runs "sorbet export [file]", which writes everything
+// in the database to a file or stdout, or "sorbet import file", which
+// loads an export into a new database.
+func ArchiveCommand(command string, args []string) error {
+	if len(args) > 1 || (command == "import" && len(args) == 0) {
+		return errors.New(commandUsage)
+	}
+
+	if command == "export" {
+		if len(args) == 0 || args[0] == "-" {
+			return ExportArchive(os.Stdout)
+		}
+
+		file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+
+		err = ExportArchive(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Exported the database to %s\n", args[0])
+		}
+
+		return err
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, err := ImportArchive(file)
+	if err != nil {
+		return err
+	}
+
+	AuditCommand("database.import", args[0], map[string]string{"rows": strconv.Itoa(count)}, "success")
+	fmt.Printf("Imported %d rows from %s\n", count, args[0])
+	return nil
+}
+
+// Secrets Command runs "sorbet secrets rotate", which wraps every server
+// password with a new master key, or "sorbet secrets prune", which
+// removes the master keys that no password is wrapped with anymore.
+// "sorbet secrets generate-key" is run by Run Command since it doesn't
+// need the database.
+func SecretsCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(commandUsage)
+	}
+
+	// Master keys from the key file are changed here. Keys that were
+	// given as flags have to be changed in the config instead.
+	fromFile := *masterKeyFlag == ""
+	keys, err := LoadMasterKeys()
+	if err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return errors.New("there is no master key")
+	}
+
+	switch args[0] {
+	case "rotate":
+		// The old keys are kept, since a running Sorbet keeps wrapping
+		// passwords with them until it is reloaded
+		old := keys
+		if fromFile {
+			keys = append([][]byte{securecookie.GenerateRandomKey(32)}, keys...)
+			if err := SaveMasterKeys(*masterKeyFileFlag, keys); err != nil {
+				return err
+			}
+
+			SetMasterKeys(keys)
+		}
+
+		// Every password is rewrapped or none are, and the new key is
+		// only kept if they were
+		tx := db.Begin()
+		count, err := RewrapServerSecrets(tx)
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+
+		if err != nil && fromFile {
+			SetMasterKeys(old)
+			if e := SaveMasterKeys(*masterKeyFileFlag, old); e != nil {
+				err = fmt.Errorf("%s, and the old master keys couldn't be saved again: %s", err, e)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		AuditCommand("secrets.rotate", "", map[string]string{"servers": strconv.Itoa(count)}, "success")
+		fmt.Printf("Wrapped %d server passwords with master key %s\n", count, MasterKeyId(keys[0]))
+		fmt.Println("Send SIGHUP to a running Sorbet, or restart it, to use the new key, and then run \"sorbet secrets prune\" to remove the old keys")
+		return nil
+	case "prune":
+		// Only prune once a running Sorbet can't have wrapped a password
+		// with an old key since the last rotation
+		var list []*Server
+		if err := db.Find(&list).Error; err != nil {
+			return err
+		}
+
+		for _, server := range list {
+			if SecretMasterKeyId(server.Password) != MasterKeyId(keys[0]) {
+				return fmt.Errorf("the password of server %s isn't wrapped with master key %s, reload every running Sorbet and run \"sorbet secrets rotate\" again", server, MasterKeyId(keys[0]))
+			}
+		}
+
+		if !fromFile {
+			fmt.Println("Every server password is wrapped with the master key, so old-master-keys can be removed")
+			return nil
+		}
+
+		if err := SaveMasterKeys(*masterKeyFileFlag, keys[:1]); err != nil {
+			return err
+		}
+
+		SetMasterKeys(keys[:1])
+
+		AuditCommand("secrets.prune", "", map[string]string{"keys": strconv.Itoa(len(keys) - 1)}, "success")
+		fmt.Printf("Removed %d old master keys\n", len(keys)-1)
+		return nil
+	default:
+		return fmt.Errorf("unknown secrets command %q\n%s", args[0], commandUsage)
+	}
+}
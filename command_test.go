@@ -0,0 +1,304 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// With Test Stdin runs a command with stdin reading the given input,
+// like a password piped into "--password-stdin".
+func WithTestStdin(t *testing.T, input string, run func() error) error {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WriteString(input)
+	w.Close()
+
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = r
+	defer r.Close()
+
+	return run()
+}
+
+// Find Test User Row loads a user straight from the database, since
+// commands don't change the users in memory.
+func FindTestUserRow(t *testing.T, username string) User {
+	t.Helper()
+
+	var user User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("finding user %s: %s", username, err)
+	}
+
+	return user
+}
+
+func TestUserCommandAddsUsers(t *testing.T) {
+	err := UserCommand([]string{"add", "--admin", "--email", "cli@example.com", "--password", "Correct-Horse-Battery-9", "cli-add"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := FindTestUserRow(t, "cli-add")
+	if !user.Admin || user.Email != "cli@example.com" || user.MustChangePassword {
+		t.Errorf("the user was added as %+v", user)
+	}
+
+	if !PasswordMatchesHash("Correct-Horse-Battery-9", user.Password) {
+		t.Error("the user can't log in with the password they were given")
+	}
+
+	// Flags can come after the username, and without a password the
+	// user has to change the one-time password they are given
+	if err := UserCommand([]string{"add", "cli-generated", "--email", "generated@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if user := FindTestUserRow(t, "cli-generated"); !user.MustChangePassword || user.Admin {
+		t.Errorf("the user with a one-time password was added as %+v", user)
+	}
+
+	users.Load()
+
+	problems := map[string][]string{
+		"a username that is taken":     {"add", "--password", "Correct-Horse-Battery-9", "cli-add"},
+		"no username":                  {"add", "--password", "Correct-Horse-Battery-9"},
+		"an email address that is bad": {"add", "--email", "not an address", "cli-bad-email"},
+		"a password that is too weak":  {"add", "--password", "short", "cli-weak"},
+		"both kinds of password":       {"add", "--password", "Correct-Horse-Battery-9", "--password-stdin", "cli-both"},
+		"an unknown flag":              {"add", "--no-such-flag", "cli-flag"},
+		"an unknown command":           {"frobnicate", "cli-add"},
+		"no command":                   {},
+	}
+
+	for problem, args := range problems {
+		if err := UserCommand(args); err == nil {
+			t.Errorf("%s should be an error", problem)
+		}
+	}
+}
+
+func TestUserCommandChangesPasswords(t *testing.T) {
+	user := NewTestUser(t, "cli-passwd", false)
+	cookies := LogInTestUser(t, user)
+
+	err := WithTestStdin(t, "Another-Horse-Battery-8\n", func() error {
+		return UserCommand([]string{"passwd", "--password-stdin", "--temporary", "cli-passwd"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := FindTestUserRow(t, "cli-passwd")
+	if !PasswordMatchesHash("Another-Horse-Battery-8", row.Password) {
+		t.Error("the password from stdin wasn't saved")
+	}
+
+	if !row.MustChangePassword {
+		t.Error("a temporary password doesn't have to be changed")
+	}
+
+	if IsLoggedIn(httptest.NewRecorder(), AsTestUser(httptest.NewRequest("GET", "/", nil), cookies)) {
+		t.Error("changing the password didn't log the user out")
+	}
+
+	if err := UserCommand([]string{"passwd", "cli-no-such-user"}); err == nil {
+		t.Error("changing the password of a user that doesn't exist should be an error")
+	}
+}
+
+func TestUserCommandPromotesDemotesDisablesAndEnables(t *testing.T) {
+	user := NewTestUser(t, "cli-access", false)
+
+	steps := []struct {
+		command  string
+		admin    bool
+		disabled bool
+	}{
+		{"promote", true, false},
+		{"disable", true, true},
+		{"demote", false, true},
+		{"enable", false, false},
+	}
+
+	for _, step := range steps {
+		cookies := LogInTestUser(t, FindUser(user.Id))
+		if err := UserCommand([]string{step.command, "cli-access"}); err != nil {
+			t.Fatalf("%s: %s", step.command, err)
+		}
+
+		row := FindTestUserRow(t, "cli-access")
+		if row.Admin != step.admin || row.Disabled != step.disabled {
+			t.Errorf("after %s the user is admin %t and disabled %t, want %t and %t", step.command, row.Admin, row.Disabled, step.admin, step.disabled)
+		}
+
+		// Taking access away logs the user out
+		loggedIn := IsLoggedIn(httptest.NewRecorder(), AsTestUser(httptest.NewRequest("GET", "/", nil), cookies))
+		if revoked := step.command == "demote" || step.command == "disable"; loggedIn == revoked {
+			t.Errorf("after %s the user is logged in: %t", step.command, loggedIn)
+		}
+	}
+}
+
+func TestUserCommandUnlocksAndResetsTwofa(t *testing.T) {
+	user := NewTestUser(t, "cli-locked", false)
+	db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{"twofa": true, "twofa_secret": "secret"})
+	users.Update(user.Id, func(v *User) {
+		v.Twofa = true
+		v.TwofaSecret = "secret"
+	})
+
+	req := httptest.NewRequest("POST", "/login", nil)
+	for i := 0; i < 20 && !FindUser(user.Id).Locked(); i++ {
+		RecordLoginFailure(req, FindUser(user.Id), []string{UserLoginKey(user.Username)})
+	}
+
+	if !FindUser(user.Id).Locked() {
+		t.Fatal("the user couldn't be locked")
+	}
+
+	if err := UserCommand([]string{"unlock", "cli-locked"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if FindUser(user.Id).Locked() {
+		t.Error("the user is still locked")
+	}
+
+	if err := UserCommand([]string{"reset-2fa", "cli-locked"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if row := FindTestUserRow(t, "cli-locked"); row.Twofa || row.TwofaSecret != "" {
+		t.Errorf("two factor authentication is still on: %t", row.Twofa)
+	}
+}
+
+func TestServerCommandEncryptsPasswords(t *testing.T) {
+	err := WithTestStdin(t, "rcon-password", func() error {
+		return ServerCommand([]string{"add", "--host", "cli.example.com", "--port", "25576", "--password-stdin"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server Server
+	if err := db.Where("host = ?", "cli.example.com").First(&server).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsEncrypted(server.Password) {
+		t.Error("the password was saved in plain text")
+	} else if password, err := DecryptSecret(server.Password); err != nil || password != "rcon-password" {
+		t.Errorf("the password decrypts to %q, %v", password, err)
+	}
+
+	if err := ServerCommand([]string{"list"}); err != nil {
+		t.Error(err)
+	}
+
+	problems := map[string][]string{
+		"no host":            {"add", "--port", "25576"},
+		"a port that is bad": {"add", "--host", "cli.example.com", "--port", "70000"},
+		"an extra argument":  {"add", "--host", "cli.example.com", "extra"},
+		"an unknown command": {"remove"},
+	}
+
+	for problem, args := range problems {
+		if err := ServerCommand(args); err == nil {
+			t.Errorf("%s should be an error", problem)
+		}
+	}
+}
+
+func TestSessionsCommandPurgesSessions(t *testing.T) {
+	first := NewTestUser(t, "cli-purge-1", false)
+	second := NewTestUser(t, "cli-purge-2", false)
+	firstCookies := LogInTestUser(t, first)
+	secondCookies := LogInTestUser(t, second)
+
+	loggedIn := func(cookies []*http.Cookie) bool {
+		return IsLoggedIn(httptest.NewRecorder(), AsTestUser(httptest.NewRequest("GET", "/", nil), cookies))
+	}
+
+	if err := SessionsCommand([]string{"purge", "--user", "cli-purge-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if loggedIn(firstCookies) || !loggedIn(secondCookies) {
+		t.Error("purging one user's sessions should only log that user out")
+	}
+
+	if err := SessionsCommand([]string{"purge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if loggedIn(secondCookies) {
+		t.Error("purging every session left a user logged in")
+	}
+
+	var count int
+	db.Model(&UserSession{}).Count(&count)
+	if count != 0 {
+		t.Errorf("there are %d sessions left after purging every session", count)
+	}
+
+	if err := SessionsCommand([]string{"purge", "--user", "cli-no-such-user"}); err == nil {
+		t.Error("purging the sessions of a user that doesn't exist should be an error")
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	UseTestDatabase(t, "sqlite3", "")
+
+	steps := []struct {
+		args    []string
+		version int
+	}{
+		{[]string{"status"}, 0},
+		{[]string{"up", "2"}, 2},
+		{[]string{"up"}, LatestSchemaVersion()},
+		{[]string{"down"}, LatestSchemaVersion() - 1},
+		{[]string{"down", "2"}, LatestSchemaVersion() - 3},
+		{[]string{"status"}, LatestSchemaVersion() - 3},
+		{[]string{"up"}, LatestSchemaVersion()},
+	}
+
+	for _, step := range steps {
+		if err := MigrateCommand(step.args); err != nil {
+			t.Fatalf("migrate %v: %s", step.args, err)
+		}
+
+		if version := SchemaVersion(); version != step.version {
+			t.Errorf("after migrate %v the schema is version %d, want %d", step.args, version, step.version)
+		}
+	}
+
+	problems := map[string][]string{
+		"no command":              {},
+		"an unknown command":      {"sideways"},
+		"a version that is bad":   {"up", "latest"},
+		"a negative step":         {"down", "-1"},
+		"a version that is newer": {"status"},
+	}
+
+	// A database that a newer Sorbet migrated can't be changed
+	db.Create(&SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future"})
+
+	for problem, args := range problems {
+		if err := MigrateCommand(args); err == nil {
+			t.Errorf("%s should be an error", problem)
+		}
+	}
+
+	if err := MigrateCommand([]string{"down"}); err == nil {
+		t.Error("undoing a migration of a newer schema should be an error")
+	}
+}
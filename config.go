@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Prefix of the environment variables that settings are read from. The
+// rest of the name is the flag name in uppercase with dashes turned
+// into underscores, so "--ldap-url" is SORBET_LDAP_URL.
+const envPrefix = "SORBET_"
+
+// Initalize Config fills in every setting that wasn't given as a flag.
+// Flags win over environment variables, which win over the config file,
+// which wins over the defaults. Every problem with the settings is
+// logged before exiting, so they can all be fixed at once.
+func initalizeConfig() {
+	// Remember which flags were given so they aren't overwritten
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	problems := []string{}
+
+	// The config file can be given in the environment too
+	path := *configFlag
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if path != "" {
+		settings, err := LoadConfig(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		for _, name := range SortedKeys(settings) {
+			if !given[name] {
+				problems = append(problems, SetFlag(path, name, settings[name])...)
+			}
+		}
+	}
+
+	// Environment variables
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if ok && !given[f.Name] && f.Name != "config" {
+			problems = append(problems, SetFlag("environment", f.Name, value)...)
+		}
+	})
+
+	problems = append(problems, ValidateConfig()...)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			Warnf("Config error: %s", problem)
+		}
+
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+}
+
+// Load Config reads a TOML config file and returns its settings by flag
+// name. Tables are joined to their keys with a dash and underscores are
+// turned into dashes, so "min_length" in the "[password]" table sets
+// "--password-min-length".
+func LoadConfig(path string) (map[string]string, error) {
+	var file map[string]interface{}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	settings := map[string]string{}
+	FlattenConfig("", file, settings)
+	return settings, nil
+}
+
+// Flatten Config adds every value in a TOML table to the settings, with
+// the names of nested tables in front of their keys.
+func FlattenConfig(prefix string, table map[string]interface{}, settings map[string]string) {
+	for key, value := range table {
+		name := prefix + strings.Replace(strings.ToLower(key), "_", "-", -1)
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			FlattenConfig(name+"-", value, settings)
+		case []interface{}:
+			// Lists are given to flags as comma separated strings
+			list := make([]string, len(value))
+			for i, v := range value {
+				list[i] = fmt.Sprint(v)
+			}
+
+			settings[name] = strings.Join(list, ",")
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Set Flag sets a flag to a value from a config source. A problem is
+// returned if there is no such flag or the value can't be parsed.
+func SetFlag(source string, name string, value string) []string {
+	if flag.Lookup(name) == nil || name == "config" {
+		return []string{fmt.Sprintf("%s: unknown setting %q", source, name)}
+	}
+
+	if err := flag.Set(name, value); err != nil {
+		return []string{fmt.Sprintf("%s: invalid value %q for %q: %s", source, value, name, err)}
+	}
+
+	return nil
+}
+
+// Env Name returns the environment variable that a flag is read from.
+func EnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Sorted Keys returns the keys of the settings in order, so that
+// problems are always reported in the same order.
+func SortedKeys(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate Config checks that the settings make sense together and
+// returns every problem that it finds.
+func ValidateConfig() []string {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// Webserver
+	check(*portFlag > 0 && *portFlag < 65536, "port %d is not between 1 and 65535", *portFlag)
+	check(*shutdownTimeoutFlag >= 0, "shutdown-timeout can't be negative")
+	if _, err := ParseTrustedProxies(*trustedProxiesFlag); err != nil {
+		check(false, "trusted-proxies: %v", err)
+	}
+	if *baseUrlFlag != "" {
+		u, err := url.Parse(*baseUrlFlag)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "base-url %q is not an http or https URL", *baseUrlFlag)
+	}
+
+	// TLS
+	check((*tlsCertFlag == "") == (*tlsKeyFlag == ""), "tls-cert and tls-key have to be given together")
+	check(*tlsCertFlag == "" || *acmeDomainsFlag == "", "tls-cert and acme-domains can't both be given")
+	check(*redirectPortFlag >= 0 && *redirectPortFlag < 65536, "redirect-port %d is not between 0 and 65535", *redirectPortFlag)
+	check(*redirectPortFlag == 0 || *redirectPortFlag != *portFlag, "redirect-port can't be the same as port")
+	check(*hstsMaxAgeFlag >= 0, "hsts-max-age can't be negative")
+
+	// Secrets
+	if *masterKeyFlag != "" {
+		_, err := DecodeMasterKey(*masterKeyFlag)
+		check(err == nil, "master-key: %v", err)
+	}
+	check(*oldMasterKeysFlag == "" || *masterKeyFlag != "", "old-master-keys can only be given with master-key")
+	check(*masterKeyFlag != "" || *masterKeyFileFlag != "", "master-key-file can't be blank without master-key")
+
+	// Database
+	driver := strings.ToLower(*driverFlag)
+	check(strings.Contains(driver, "sqlite") || strings.Contains(driver, "postgres") || driver == "mysql", "driver %q is not sqlite, postgres or mysql", *driverFlag)
+	check(*databaseFlag != "", "database can't be blank")
+
+	// Paths
+	check(*viewsFlag == "" || IsDir(*viewsFlag), "views folder %q does not exist", *viewsFlag)
+	check(*publicFlag == "" || IsDir(*publicFlag), "public folder %q does not exist", *publicFlag)
+
+	// Sessions
+	check(*keyFileFlag != "", "keyfile can't be blank")
+	check(*sessionAgeFlag > 0, "session-max-age has to be more than 0")
+
+	// Authentication
+	for _, name := range strings.Split(*authFlag, ",") {
+		name = strings.TrimSpace(name)
+		check(name == "local" || name == "ldap", "auth %q is not local or ldap", name)
+	}
+	check(*oidcIssuerFlag == "" || *oidcClientIdFlag != "", "oidc-client-id is needed when oidc-issuer is given")
+	check(!*disableLocalLoginFlag || *oidcIssuerFlag != "" || strings.Contains(*authFlag, "ldap"), "disable-local-login leaves no way to log in")
+
+	// Passwords
+	check(*passwordMinLengthFlag > 0 && *passwordMinLengthFlag <= maxPasswordLength, "password-min-length %d is not between 1 and %d", *passwordMinLengthFlag, maxPasswordLength)
+
+	// Notifications
+	check(*notifierFlag == "display" || *notifierFlag == "smtp", "notifier %q is not display or smtp", *notifierFlag)
+	check(*inviteExpiryFlag > 0, "invite-expiry has to be more than 0")
+	check(*resetExpiryFlag > 0, "reset-expiry has to be more than 0")
+
+	// Login
+	check(*lockoutThresholdFlag > 0, "lockout-threshold has to be more than 0")
+	check(*lockoutIpThresholdFlag > 0, "lockout-ip-threshold has to be more than 0")
+	check(*lockoutDurationFlag > 0, "lockout-duration has to be more than 0")
+
+	return problems
+}
+
+// Is Dir checks if a path is a folder that exists.
+func IsDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
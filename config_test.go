@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write Test Config writes a TOML config file into a temporary folder
+// and returns its path.
+func WriteTestConfig(t *testing.T, config string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sorbet.toml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigFlattensTables(t *testing.T) {
+	path := WriteTestConfig(t, `
+port = 8080
+Base_Url = "https://sorbet.example.com"
+
+[password]
+min_length = 12
+
+[ldap]
+url = "ldaps://ldap.example.com"
+
+[ldap.user]
+filter = "(uid=%s)"
+
+[acme]
+domains = ["sorbet.example.com", "www.sorbet.example.com"]
+`)
+
+	settings, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"port":                "8080",
+		"base-url":            "https://sorbet.example.com",
+		"password-min-length": "12",
+		"ldap-url":            "ldaps://ldap.example.com",
+		"ldap-user-filter":    "(uid=%s)",
+		"acme-domains":        "sorbet.example.com,www.sorbet.example.com",
+	}
+
+	if len(settings) != len(want) {
+		t.Errorf("the config has %d settings, want %d: %v", len(settings), len(want), settings)
+	}
+
+	for name, value := range want {
+		if settings[name] != value {
+			t.Errorf("%s is %q, want %q", name, settings[name], value)
+		}
+	}
+
+	if _, err := LoadConfig(WriteTestConfig(t, "port = ")); err == nil {
+		t.Error("a config file that isn't TOML should be an error")
+	}
+}
+
+func TestSetFlagReportsProblems(t *testing.T) {
+	if problems := SetFlag("sorbet.toml", "no-such-setting", "1"); len(problems) != 1 {
+		t.Errorf("an unknown setting gave the problems %v, want one", problems)
+	}
+
+	if problems := SetFlag("sorbet.toml", "config", "other.toml"); len(problems) != 1 {
+		t.Errorf("setting the config file from a config gave the problems %v, want one", problems)
+	}
+
+	defer func(port int) { *portFlag = port }(*portFlag)
+	if problems := SetFlag("sorbet.toml", "port", "not a port"); len(problems) != 1 {
+		t.Errorf("a port that isn't a number gave the problems %v, want one", problems)
+	}
+}
+
+func TestFlagsWinOverTheEnvironmentWhichWinsOverTheConfigFile(t *testing.T) {
+	defer func(config string, port int, address string, length int) {
+		*configFlag, *portFlag, *interfaceFlag, *passwordMinLengthFlag = config, port, address, length
+	}(*configFlag, *portFlag, *interfaceFlag, *passwordMinLengthFlag)
+
+	*configFlag = WriteTestConfig(t, `
+port = 7003
+interface = "127.0.0.3"
+
+[password]
+min_length = 13
+`)
+
+	// The port is given three ways, the interface two ways and the
+	// password length only in the config file
+	if err := flag.Set("port", "7001"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SORBET_PORT", "7002")
+	t.Setenv("SORBET_INTERFACE", "127.0.0.2")
+
+	initalizeConfig()
+
+	if *portFlag != 7001 {
+		t.Errorf("port is %d, want the flag's 7001", *portFlag)
+	}
+
+	if *interfaceFlag != "127.0.0.2" {
+		t.Errorf("interface is %s, want the environment's 127.0.0.2", *interfaceFlag)
+	}
+
+	if *passwordMinLengthFlag != 13 {
+		t.Errorf("password-min-length is %d, want the config file's 13", *passwordMinLengthFlag)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"html/template"
+	"net/http"
+)
+
+const (
+	// The name of the form field that CSRF tokens are sent in.
+	csrfField = "csrf_token"
+
+	// The name of the header that CSRF tokens are sent in by AJAX
+	// requests.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Paths that are never given a CSRF token, since they are only ever
+// asked for by health checks that don't keep cookies and can't change
+// anything.
+var csrfExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// Session store for CSRF tokens. This is kept separate from the user
+// session so that handing out a token to someone that is not logged
+// in yet does not look like a partly authenticated session, and so
+// that it does not fill the database with sessions for visitors.
+var csrfStore *sessions.CookieStore
+
+// CSRF Token returns the CSRF token for the request. If the request
+// does not have a token yet then a new one is created and saved.
+func CSRFToken(w http.ResponseWriter, req *http.Request) string {
+	session, _ := csrfStore.Get(req, "csrf")
+
+	token, ok := session.Values["token"].(string)
+	if !ok || token == "" {
+		token = RotateCSRFToken(w, req)
+	}
+
+	return token
+}
+
+// Rotate CSRF Token gives the request a new CSRF token and saves it.
+// It is called when someone logs in, so that a token that was handed
+// out before they logged in can't be used once they have.
+func RotateCSRFToken(w http.ResponseWriter, req *http.Request) string {
+	session, _ := csrfStore.Get(req, "csrf")
+
+	token := base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	session.Values["token"] = token
+	session.Options.HttpOnly = true
+
+	err := session.Save(req, w)
+	if err != nil {
+		Warnf("Error saving CSRF session: %s", err)
+	}
+
+	return token
+}
+
+// CSRF Protect wraps a handler so that every request has a CSRF token,
+// and every request that can change something (anything other than a
+// GET, HEAD or OPTIONS request) is rejected unless it sends that token
+// back in the "csrf_token" form field or the "X-CSRF-Token" header.
+// Health checks are passed straight through without a token.
+func CSRFProtect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if csrfExempt[req.URL.Path] && (req.Method == "GET" || req.Method == "HEAD") {
+			handler.ServeHTTP(w, req)
+		} else {
+			token := CSRFToken(w, req)
+
+			switch req.Method {
+			case "GET", "HEAD", "OPTIONS":
+				handler.ServeHTTP(w, req)
+			default:
+				sent := req.Header.Get(csrfHeader)
+				if sent == "" {
+					sent = req.PostFormValue(csrfField)
+				}
+
+				if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+					Warnf("Rejected %s %s from %s: invalid CSRF token", req.Method, req.URL.Path, RemoteIp(req))
+					http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				} else {
+					handler.ServeHTTP(w, req)
+				}
+			}
+		}
+	})
+}
+
+// CSRF Field returns a hidden form field with the CSRF token for the
+// request, which is added to every form that POSTs.
+func CSRFField(req *http.Request) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(CSRFTokenFor(req)) + `"/>`)
+}
+
+// CSRF Token For returns the CSRF token that CSRFProtect has already
+// given to the request. It is used by templates, which can't save the
+// session themselves.
+func CSRFTokenFor(req *http.Request) string {
+	session, _ := csrfStore.Get(req, "csrf")
+
+	token, _ := session.Values["token"].(string)
+	return token
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Get Test CSRF Token asks CSRFProtect for a page and returns the token
+// and the cookies that it handed out.
+func GetTestCSRFToken(t *testing.T, cookies []*http.Cookie) (string, []*http.Cookie) {
+	t.Helper()
+
+	var token string
+	handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = CSRFTokenFor(req)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, AsTestUser(httptest.NewRequest("GET", "/login", nil), cookies))
+	if token == "" {
+		t.Fatal("CSRFProtect didn't hand out a token")
+	}
+
+	if len(w.Result().Cookies()) > 0 {
+		cookies = w.Result().Cookies()
+	}
+
+	return token, cookies
+}
+
+func TestCSRFProtectNeedsTheToken(t *testing.T) {
+	handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	token, cookies := GetTestCSRFToken(t, nil)
+
+	post := func(form url.Values, header string) int {
+		req := AsTestUser(NewTestForm("/settings", form), cookies)
+		if header != "" {
+			req.Header.Set(csrfHeader, header)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(url.Values{}, ""); code != http.StatusForbidden {
+		t.Errorf("a POST without a token answered %d, want 403", code)
+	}
+
+	if code := post(url.Values{csrfField: {"wrong"}}, ""); code != http.StatusForbidden {
+		t.Errorf("a POST with the wrong token answered %d, want 403", code)
+	}
+
+	if code := post(url.Values{csrfField: {token}}, ""); code != http.StatusOK {
+		t.Errorf("a POST with the token answered %d, want 200", code)
+	}
+
+	if code := post(url.Values{}, token); code != http.StatusOK {
+		t.Errorf("a POST with the token in the header answered %d, want 200", code)
+	}
+
+	// A token is only good with the cookie that it was handed out with
+	other, _ := GetTestCSRFToken(t, nil)
+	if code := post(url.Values{csrfField: {other}}, ""); code != http.StatusForbidden {
+		t.Errorf("a POST with someone else's token answered %d, want 403", code)
+	}
+}
+
+func TestLogInRotatesTheCSRFToken(t *testing.T) {
+	user := NewTestUser(t, "csrf-rotate", false)
+	before, cookies := GetTestCSRFToken(t, nil)
+
+	w := httptest.NewRecorder()
+	LogIn(w, AsTestUser(httptest.NewRequest("POST", "/login", nil), cookies), user)
+
+	// The CSRF cookie is handed out again with the user session
+	var csrf []*http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "csrf" {
+			csrf = append(csrf, cookie)
+		}
+	}
+
+	if len(csrf) == 0 {
+		t.Fatal("logging in didn't hand out a CSRF cookie")
+	}
+
+	after, _ := GetTestCSRFToken(t, csrf[len(csrf)-1:])
+	if after == before {
+		t.Error("logging in should hand out a new CSRF token")
+	}
+}
@@ -4,14 +4,13 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
-	"github.com/lukevers/golem"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"strings"
 )
 
 var (
-	db gorm.DB
+	db *gorm.DB
 )
 
 func initalizeDB() {
@@ -45,45 +44,59 @@ func initalizeDB() {
 	}
 
 	// Open connection
+	var err error
 	db, err = gorm.Open(*driverFlag, *databaseFlag)
 	if err != nil {
-		golem.Warnf("Error connecting to database: %s", err)
-		golem.Warn("Exiting with exit status 1")
+		Warnf("Error connecting to database: %s", err)
+		Warn("Exiting with exit status 1")
 		os.Exit(1)
 	}
 
 	// Test connection
 	err = db.DB().Ping()
 	if err != nil {
-		golem.Warnf("Error pinging database: %s", err)
-		golem.Warn("Exiting with exit status 1")
+		Warnf("Error pinging database: %s", err)
+		Warn("Exiting with exit status 1")
 		os.Exit(1)
 	}
+}
 
-	// Migrate database
-	if *debugFlag {
-		golem.Verb("Running database auto migrate")
+// Initalize Defaults creates the default roles, command policies and
+// server if they don't exist yet. The schema has to be migrated first.
+func initalizeDefaults() {
+	// Make sure that all of our default roles exist. If a
+	// role has been changed we leave it alone.
+	for _, role := range defaultRoles {
+		db.FirstOrCreate(&role, Role{Name: role.Name})
 	}
 
-	db.AutoMigrate(User{}, Server{})
-
-	// Check to see if we have any users created.
-	// If we don't have any users at all then we
-	// need to make a default user.
-	db.FirstOrCreate(&User{
-		Username:    "admin",
-		Password:    HashPassword("admin"),
-		Admin:       true,
-		Twofa:       false,
-		TwofaSecret: "",
-	}, &User{})
+	// Check to see if we have any command policies. If we
+	// don't have any policies at all then we create the
+	// default policies for our default roles.
+	var policies int
+	db.Model(&CommandPolicy{}).Count(&policies)
+	if policies == 0 {
+		for name, list := range defaultCommandPolicies {
+			var role Role
+			db.Where("name = ?", name).First(&role)
+			for _, policy := range list {
+				policy.RoleId = role.Id
+				db.Create(&policy)
+			}
+		}
+	}
 
 	// Check to see if we have a server yet. If
-	// we don't have a server, then we need to 
+	// we don't have a server, then we need to
 	// make that server!
+	password, err := EncryptSecret("password")
+	if err != nil {
+		Warnf("Error encrypting the default server password: %s", err)
+	}
+
 	db.FirstOrCreate(&Server{
-		Host:    "localhost",
+		Host:     "localhost",
 		Port:     25575,
-		Password: "password",
+		Password: password,
 	}, &Server{})
 }
@@ -2,17 +2,103 @@ package main
 
 import (
 	"flag"
+	"time"
 )
 
 var (
 	// General flags
-	debugFlag = flag.Bool("debug", false, "Use during development, not production")
+	debugFlag  = flag.Bool("debug", false, "Use during development, not production")
+	configFlag = flag.String("config", "", "TOML file that settings are read from")
+
+	// Path flags
+	viewsFlag  = flag.String("views", "", "Folder with templates that are used in place of the built in ones")
+	publicFlag = flag.String("public", "", "Folder with static files that are used in place of the built in ones")
 
 	// Webserver flags
 	portFlag      = flag.Int("port", 6015, "Port for webserver to bind to")
 	interfaceFlag = flag.String("interface", "127.0.0.1", "Interface for webserver to bind to")
+	baseUrlFlag   = flag.String("base-url", "", "URL that Sorbet is visited at, used in links")
+
+	shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests to finish when stopping")
+	trustedProxiesFlag  = flag.String("trusted-proxies", "", "Comma separated addresses or networks of proxies whose X-Forwarded-For is used")
+
+	// Health check flags
+	healthDetailsFlag = flag.Bool("health-details", false, "Show errors, uptime and server addresses on /healthz and /readyz")
+	readyServersFlag  = flag.Bool("ready-servers", false, "Only be ready when every server can be reached")
+
+	// TLS flags
+	tlsCertFlag       = flag.String("tls-cert", "", "PEM certificate chain to serve HTTPS with, reloaded when it changes")
+	tlsKeyFlag        = flag.String("tls-key", "", "PEM private key of the TLS certificate")
+	acmeDomainsFlag   = flag.String("acme-domains", "", "Comma separated list of domains to get certificates for with ACME")
+	acmeEmailFlag     = flag.String("acme-email", "", "Contact address for the ACME account")
+	acmeCacheFlag     = flag.String("acme-cache", "acme", "Folder that ACME certificates and keys are kept in")
+	acmeDirectoryFlag = flag.String("acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "Directory URL of the ACME server")
+	redirectPortFlag  = flag.Int("redirect-port", 0, "Port to redirect HTTP to HTTPS on, and answer ACME challenges on")
+	hstsMaxAgeFlag    = flag.Duration("hsts-max-age", 365*24*time.Hour, "How long browsers only visit over HTTPS, 0 to not send HSTS")
+	secureCookiesFlag = flag.Bool("secure-cookies", false, "Only send cookies over HTTPS even without TLS, for use behind a proxy")
 
 	// Database flags
-	driverFlag   = flag.String("driver", "sqlite", "Database driver")
-	databaseFlag = flag.String("database", "sorbet.db", "Database string")
+	driverFlag      = flag.String("driver", "sqlite", "Database driver")
+	databaseFlag    = flag.String("database", "sorbet.db", "Database string")
+	autoMigrateFlag = flag.Bool("auto-migrate", true, "Apply database migrations when Sorbet starts")
+
+	// Session flags
+	keyFileFlag    = flag.String("keyfile", "sorbet.key", "File that session keys are kept in")
+	rotateKeysFlag = flag.Bool("rotate-keys", false, "Add a new session key to the key file on start")
+	sessionAgeFlag = flag.Duration("session-max-age", 30*24*time.Hour, "How long a session can go unused before it expires")
+
+	// Secret flags
+	masterKeyFlag     = flag.String("master-key", "", "Base64 encoded 32 byte key that server passwords are encrypted with")
+	oldMasterKeysFlag = flag.String("old-master-keys", "", "Comma separated list of master keys that were used before the current one")
+	masterKeyFileFlag = flag.String("master-key-file", "sorbet.master.key", "File that master keys are kept in if no master key is given")
+
+	// 2FA flags
+	totpIssuerFlag = flag.String("totp-issuer", "Sorbet", "Name that authenticator apps show for 2FA tokens")
+
+	// WebAuthn flags
+	webauthnIdFlag     = flag.String("webauthn-id", "localhost", "Domain name that security keys are registered for")
+	webauthnOriginFlag = flag.String("webauthn-origin", "", "Full URL that Sorbet is visited at, for security keys")
+
+	// Authentication flags
+	authFlag                  = flag.String("auth", "local", "Comma separated list of authenticators to try, local and ldap")
+	ldapUrlFlag               = flag.String("ldap-url", "ldap://localhost:389", "Address of the LDAP directory")
+	ldapStartTLSFlag          = flag.Bool("ldap-starttls", false, "Upgrade the LDAP connection with StartTLS")
+	ldapBindDnFlag            = flag.String("ldap-bind-dn", "", "DN to bind as when searching for users")
+	ldapBindPasswordFlag      = flag.String("ldap-bind-password", "", "Password to bind with when searching for users")
+	ldapBaseDnFlag            = flag.String("ldap-base-dn", "", "DN to search for users under")
+	ldapUserFilterFlag        = flag.String("ldap-user-filter", "(uid=%s)", "Filter that finds a user, %s is the username")
+	ldapUsernameAttributeFlag = flag.String("ldap-username-attribute", "uid", "Attribute that usernames are taken from")
+	ldapGroupAttributeFlag    = flag.String("ldap-group-attribute", "memberOf", "Attribute that lists a user's groups")
+	ldapGroupsFlag            = flag.String("ldap-groups", "", "Roles to grant to LDAP groups, like \"group=role,role;group=role\"")
+
+	// Single sign-on flags
+	oidcIssuerFlag        = flag.String("oidc-issuer", "", "URL of the OpenID Connect issuer to log in with")
+	oidcClientIdFlag      = flag.String("oidc-client-id", "", "OpenID Connect client id")
+	oidcClientSecretFlag  = flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcRedirectUrlFlag   = flag.String("oidc-redirect-url", "", "URL of \"/login/oidc/callback\" that the issuer sends users back to")
+	oidcScopesFlag        = flag.String("oidc-scopes", "openid,profile,email", "Comma separated list of scopes to ask for")
+	oidcNameFlag          = flag.String("oidc-name", "Single Sign-On", "Name of the identity provider on the login page")
+	oidcUsernameClaimFlag = flag.String("oidc-username-claim", "preferred_username", "Claim that usernames are taken from")
+	oidcRolesClaimFlag    = flag.String("oidc-roles-claim", "groups", "Claim that lists a user's groups")
+	oidcRolesFlag         = flag.String("oidc-roles", "", "Roles to grant to OIDC groups, like \"group=role,role;group=role\"")
+	disableLocalLoginFlag = flag.Bool("disable-local-login", false, "Don't let users log in with passwords that Sorbet keeps")
+
+	// Password flags
+	passwordMinLengthFlag = flag.Int("password-min-length", 10, "Shortest password that users can choose")
+	passwordListFlag      = flag.String("password-list", "", "File of common passwords that users can't choose, in place of the built in list")
+	setupPasswordFlag     = flag.Bool("setup-password", false, "Create the first administrator with a one-time password instead of using \"/setup\"")
+
+	// Notification flags
+	notifierFlag     = flag.String("notifier", "display", "How invitations and reset links are delivered, display or smtp")
+	smtpAddrFlag     = flag.String("smtp-addr", "localhost:25", "Host and port of the mail server")
+	smtpFromFlag     = flag.String("smtp-from", "sorbet@localhost", "Address that emails are sent from")
+	smtpUsernameFlag = flag.String("smtp-username", "", "Username for the mail server")
+	smtpPasswordFlag = flag.String("smtp-password", "", "Password for the mail server")
+	inviteExpiryFlag = flag.Duration("invite-expiry", 72*time.Hour, "How long invitation links work for")
+	resetExpiryFlag  = flag.Duration("reset-expiry", time.Hour, "How long password reset links work for")
+
+	// Login flags
+	lockoutThresholdFlag   = flag.Int("lockout-threshold", 5, "Failed logins in a row before an account is locked")
+	lockoutIpThresholdFlag = flag.Int("lockout-ip-threshold", 20, "Failed logins in a row before an address is locked")
+	lockoutDurationFlag    = flag.Duration("lockout-duration", 15*time.Minute, "How long accounts and addresses stay locked")
 )
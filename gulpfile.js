@@ -102,6 +102,7 @@ var js_files = js_bower.concat([
 	'server.js',
 	'settings.js',
 	'users.js',
+	'webauthn.js',
 	'main.js',
 
 	// -- End JS files from assets -- //
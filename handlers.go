@@ -1,15 +1,19 @@
 package main
 
 import (
-	"code.google.com/p/rsc/qr"
-	"crypto/rand"
-	"encoding/base32"
+	"crypto/subtle"
 	"encoding/base64"
-	"github.com/dgryski/dgoogauth"
-	"github.com/lukevers/golem"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
 	"net/http"
+	"net/mail"
+	"regexp"
+	"rsc.io/qr"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Handle "/" web
@@ -19,7 +23,7 @@ func HandleRoot(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if IsLoggedIn(w, req) {
-		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "index", WhoAmI(req))
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "index", servers.All())
 	} else {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	}
@@ -27,13 +31,10 @@ func HandleRoot(w http.ResponseWriter, req *http.Request) {
 
 // Handle "/logout" web
 func HandleLogout(w http.ResponseWriter, req *http.Request) {
-	// Remove cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:   "user",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	// Remove session and cookie
+	session, _ := store.Get(req, "user")
+	session.Options.MaxAge = -1
+	session.Save(req, w)
 
 	// Redirect to "/"
 	http.Redirect(w, req, "/", http.StatusSeeOther)
@@ -45,19 +46,100 @@ func HandleLogin(w http.ResponseWriter, req *http.Request) {
 		templates = RefreshTemplates(req)
 	}
 
-	if IsLoggedIn(w, req) {
+	if SetupNeeded() {
+		http.Redirect(w, req, "/setup", http.StatusSeeOther)
+	} else if IsLoggedIn(w, req) {
 		http.Redirect(w, req, "/", http.StatusSeeOther)
 	} else {
 		// Check if we have been partly authenticated yet
 		session, _ := store.Get(req, "user")
 		if session.IsNew {
-			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "login", nil)
+			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "login", map[string]interface{}{
+				"Password": len(authenticators) > 0,
+				"OIDC":     OIDC,
+				"Forgot":   CanSendLinks(),
+			})
 		} else {
 			http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
 		}
 	}
 }
 
+// Handle "/setup" web which is where the first administrator is
+// created.
+func HandleSetup(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	if !SetupNeeded() {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "setup", map[string]string{
+			"Token": req.FormValue("token"),
+		})
+	}
+}
+
+// Handle POSTS to "/setup" which creates the first administrator if
+// the setup token is right.
+func HandleSetupForm(w http.ResponseWriter, req *http.Request) {
+	// Only ever create one first administrator
+	setupLock.Lock()
+	defer setupLock.Unlock()
+
+	if setupToken == "" {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Parse our form so we can get values from req.Form
+		err := req.ParseForm()
+		if err != nil {
+			Warnf("Error parsing form: %s", err)
+		}
+
+		token := req.FormValue("token")
+		username := strings.TrimSpace(req.FormValue("username"))
+		password := req.FormValue("password")
+
+		// Check everything that was sent
+		problem := ""
+		if subtle.ConstantTimeCompare([]byte(token), []byte(setupToken)) != 1 {
+			problem = "The setup token is wrong, check the log for the right one."
+		} else if username == "" {
+			problem = "Choose a username."
+		} else if password != req.FormValue("confirm") {
+			problem = "The passwords don't match."
+		} else if err := CheckPassword(password, username); err != nil {
+			problem = err.Error() + "."
+		}
+
+		if problem != "" {
+			// Show the form again with what went wrong
+			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "setup", map[string]string{
+				"Token":    token,
+				"Username": username,
+				"Error":    problem,
+			})
+		} else {
+			// Create user
+			admin := User{
+				Username:      username,
+				Password:      HashPassword(password),
+				Admin:         true,
+				SecurityStamp: NewSecurityStamp(),
+			}
+
+			db.Create(&admin)
+			users.Add(&admin)
+			setupToken = ""
+			AuditAs(req, &admin, "setup", username, nil, "success")
+
+			// Log in as the new administrator
+			LogIn(w, req, &admin)
+		}
+	}
+}
+
 // Handle "/login/2fa" web
 func HandleLogin2FA(w http.ResponseWriter, req *http.Request) {
 	if *debugFlag {
@@ -69,7 +151,7 @@ func HandleLogin2FA(w http.ResponseWriter, req *http.Request) {
 	} else {
 		session, _ := store.Get(req, "user")
 		if session.Values["temp"] == "true" {
-			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "login_2fa", nil)
+			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "login_2fa", WhoAmI(req))
 		} else {
 			http.Redirect(w, req, "/login", http.StatusSeeOther)
 		}
@@ -80,93 +162,190 @@ func HandleLogin2FA(w http.ResponseWriter, req *http.Request) {
 func HandleLoginForm2FA(w http.ResponseWriter, req *http.Request) {
 	// Check if we have been partly authenticated yet
 	session, _ := store.Get(req, "user")
-	if session.IsNew {
+	user := WhoAmI(req)
+	if session.IsNew || user == nil {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else if keys := LoginKeys(req, user.Username); LoginLocked(keys) {
+		// Don't even try the token while we're locked out
+		http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
 	} else {
 		// Parse our form so we can get values from req.Form
-		err = req.ParseForm()
+		err := req.ParseForm()
 		if err != nil {
-			golem.Warnf("Error parsing form: %s", err)
+			Warnf("Error parsing form: %s", err)
 		}
 
 		// Get token from input
-		token := req.Form["token"][0]
-
-		// Get user
-		user := WhoAmI(req)
+		token := req.FormValue("token")
 
-		// Configure token
-		otpc := &dgoogauth.OTPConfig{
-			Secret:      user.TwofaSecret,
-			WindowSize:  3,
-			HotpCounter: 0,
-		}
+		// Validate token, which can only be used once
+		val := user.Twofa && UseTotp(user, token)
 
-		// Validate token
-		val, err := otpc.Authenticate(token)
-		if err != nil {
-			golem.Warnf("Error authenticating token: %s", err)
+		// If the token isn't right then it might be a recovery code
+		if !val && UseRecoveryCode(user, token) {
+			val = true
+			AuditAs(req, user, "2fa.recovery.use", user.Username, map[string]string{
+				"left": strconv.Itoa(user.RecoveryCodesLeft()),
+			}, "success")
 		}
 
 		if val {
 			// Validated
-			session, _ := store.Get(req, "user")
+			ClearLoginFailures(UserLoginKey(user.Username))
 			session.Values["temp"] = "false"
 			session.Save(req, w)
+			RecordLogin(req, user)
 
 			// Redirect
 			http.Redirect(w, req, "/", http.StatusSeeOther)
 		} else {
 			// Not validated
+			time.Sleep(RecordLoginFailure(req, user, keys))
 			http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
 		}
 	}
 }
 
-// Handle POSTS to "/login" web.
-func HandleLoginForm(w http.ResponseWriter, req *http.Request) {
-	// Parse our form so we can get values from req.Form
-	err = req.ParseForm()
-	if err != nil {
-		golem.Warnf("Error parsing form: %s", err)
-	}
+// Handle POSTS to "/login/webauthn/begin" which starts logging in
+// with a security key for a partly authenticated session.
+func HandleBeginSecurityKeyLogin(w http.ResponseWriter, req *http.Request) {
+	// Check if we have been partly authenticated yet
+	session, _ := store.Get(req, "user")
+	user := WhoAmI(req)
+	if session.IsNew || user == nil || session.Values["temp"] != "true" {
+		http.Error(w, "Log in with your password first", http.StatusForbidden)
+	} else if LoginLocked(LoginKeys(req, user.Username)) {
+		http.Error(w, "Too many failed logins, try again later", http.StatusForbidden)
+	} else {
+		// Create the options for the browser
+		options, data, err := webAuthn.BeginLogin(user)
+		if err != nil {
+			Warnf("Error starting security key login: %s", err)
+			http.Error(w, "Could not log in with a security key", http.StatusBadRequest)
+		} else {
+			// Keep the ceremony in the session until it's finished
+			SaveWebAuthnSession(session, "webauthn_login", data)
+			session.Save(req, w)
 
-	// Get username/password from input
-	username := req.Form["username"][0]
-	password := req.Form["password"][0]
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(options)
+		}
+	}
+}
 
-	// Query database for user
-	var user User
-	db.Table("users").Where("username = ?", username).First(&user)
+// Handle POSTS to "/login/webauthn/finish" which checks the signed
+// assertion from a security key and finishes logging in.
+func HandleFinishSecurityKeyLogin(w http.ResponseWriter, req *http.Request) {
+	// Check if we have been partly authenticated yet
+	session, _ := store.Get(req, "user")
+	user := WhoAmI(req)
+	if session.IsNew || user == nil || session.Values["temp"] != "true" {
+		http.Error(w, "Log in with your password first", http.StatusForbidden)
+	} else if keys := LoginKeys(req, user.Username); LoginLocked(keys) {
+		http.Error(w, "Too many failed logins, try again later", http.StatusForbidden)
+	} else {
+		// Get the ceremony we started
+		data, err := LoadWebAuthnSession(session, "webauthn_login")
 
-	// Check if usernames match up
-	if user.Username == username {
-		// Check if passwords match up
-		if PasswordMatchesHash(password, user.Password) {
-			// Create new session
-			session, _ := store.New(req, "user")
-			session.Values["username"] = username
+		var credential *webauthn.Credential
+		if err == nil {
+			credential, err = webAuthn.FinishLogin(user, data, req)
+		}
 
-			// Save session
+		if err != nil {
+			// Not validated
+			Warnf("Error finishing security key login: %s", err)
+			session.Save(req, w)
+			time.Sleep(RecordLoginFailure(req, user, keys))
+			http.Error(w, "Security key was not accepted", http.StatusForbidden)
+		} else {
+			// Validated
+			UpdateSecurityKey(credential)
+			ClearLoginFailures(UserLoginKey(user.Username))
+			session.Values["temp"] = "false"
 			session.Save(req, w)
+			RecordLogin(req, user)
 
-			// Check if 2fa is enabled
-			if user.Twofa {
-				session.Values["temp"] = "true"
-				session.Save(req, w)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"redirect": "/",
+			})
+		}
+	}
+}
 
-				// Redirect, check 2fa
-				http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
-			} else {
-				// Redirect, logged in ok
-				http.Redirect(w, req, "/", http.StatusSeeOther)
-			}
+// Handle "/login/oidc" web which sends the user to the identity
+// provider to log in.
+func HandleOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	if OIDC == nil {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		url, err := OIDC.Start(w, req)
+		if err != nil {
+			Warnf("Error starting OIDC login: %s", err)
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+		} else {
+			http.Redirect(w, req, url, http.StatusFound)
+		}
+	}
+}
+
+// Handle "/login/oidc/callback" web which is where the identity
+// provider sends the user back to after they have logged in.
+func HandleOIDCCallback(w http.ResponseWriter, req *http.Request) {
+	if OIDC == nil {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Check what the identity provider sent back
+		claims, err := OIDC.Finish(w, req)
+
+		// Find the user, or create them if they don't exist yet
+		var user *User
+		if err == nil {
+			user, err = OIDC.Provision(req, claims)
+		}
+
+		if err != nil {
+			Warnf("Error logging in with OIDC: %s", err)
+			AuditAs(req, nil, "login.oidc", OIDC.Username(claims), map[string]string{"error": err.Error()}, "failed")
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+		} else {
+			// Update roles and log in
+			SyncRoles(req, user, OIDC.Roles, OIDC.Groups(claims))
+			AuditAs(req, user, "login.oidc", user.Username, nil, "success")
+			LogIn(w, req, user)
 		}
 	}
+}
+
+// Handle POSTS to "/login" web.
+func HandleLoginForm(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
 
-	// If you have gotten this far then you have not been
-	// authenticated. Sorry.
-	http.Redirect(w, req, "/login", http.StatusSeeOther)
+	// Get username/password from input
+	username := req.FormValue("username")
+	password := req.FormValue("password")
+
+	// Check if we're locked out before checking the password, and
+	// then check if usernames and passwords match up
+	keys := LoginKeys(req, username)
+	var user *User
+	if LoginLocked(keys) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else if user = Authenticate(req, username, password); user != nil {
+		// Log in
+		ClearLoginFailures(UserLoginKey(username))
+		LogIn(w, req, user)
+	} else {
+		// If you have gotten this far then you have not been
+		// authenticated. Sorry.
+		time.Sleep(RecordLoginFailure(req, FindUserByUsername(username), keys))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	}
 }
 
 // Handle "/settings" web
@@ -189,40 +368,217 @@ func HandleSettings(w http.ResponseWriter, req *http.Request) {
 func HandleUpdateSettings(w http.ResponseWriter, req *http.Request) {
 	if !IsLoggedIn(w, req) {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else if u := WhoAmI(req); u == nil {
+		// Another request logged the user out in the meantime
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	} else {
 		// Parse our form so we can get values from req.Form
-		err = req.ParseForm()
+		err := req.ParseForm()
 		if err != nil {
-			golem.Warnf("Error parsing form: %s", err)
+			Warnf("Error parsing form: %s", err)
 		}
 
-		username := req.Form["username"][0]
-		password := req.Form["password"][0]
+		username := req.FormValue("username")
+		email := strings.TrimSpace(req.FormValue("email"))
+		password := req.FormValue("password")
 
-		// Figure out who the user is
-		u := WhoAmI(req)
+		// Get the user from the database too
 		var user User
 		db.Table("users").Where("id = ?", u.Id).Find(&user)
 
-		// Update user in database if not empty
-		if username != "" {
-			user.Username = username
+		// Keep track of what changed for the audit log
+		changed := map[string]string{}
+
+		// Users from a directory like LDAP have their username and
+		// password kept there, so they can't be changed here.
+		if !u.IsLocal() {
+			username = ""
+			password = ""
 		}
 
-		// Update password in database if not empty
+		// Check the new password against the policy before anything
+		// is changed.
+		name := username
+		if name == "" {
+			name = user.Username
+		}
+
+		var problem error
 		if password != "" {
-			user.Password = HashPassword(password)
+			problem = CheckPassword(password, name)
 		}
 
-		// Update user in memory
-		u.Username = user.Username
-		u.Password = user.Password
+		// Email addresses are optional but have to be real ones
+		var bad error
+		if email != "" {
+			_, bad = mail.ParseAddress(email)
+		}
 
-		// Save user
-		db.Save(&user)
+		if problem != nil {
+			AuditAs(req, u, "settings.update", user.Username, map[string]string{"error": problem.Error()}, "failed")
+			http.Redirect(w, req, "/settings?error=password", http.StatusSeeOther)
+		} else if bad != nil {
+			http.Redirect(w, req, "/settings?error=email", http.StatusSeeOther)
+		} else {
+			// Update user in database if not empty
+			if username != "" && username != user.Username {
+				changed["username"] = user.Username + " -> " + username
+				user.Username = username
+			}
 
-		// Redirect back to "/settings" when we're done here.
-		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+			// Update email in database if it changed
+			if u.IsLocal() && email != user.Email {
+				changed["email"] = user.Email + " -> " + email
+				user.Email = email
+			}
+
+			// Update password in database if not empty
+			if password != "" {
+				changed["password"] = "changed"
+				user.Password = HashPassword(password)
+			}
+
+			// Save user, which fails if the username is taken
+			if err := db.Save(&user).Error; err != nil {
+				Warnf("Error saving settings of %s: %s", u.Username, err)
+				http.Redirect(w, req, "/settings?error=save", http.StatusSeeOther)
+			} else {
+				// Update user in memory
+				users.Update(u.Id, func(v *User) {
+					v.Username = user.Username
+					v.Email = user.Email
+					v.Password = user.Password
+				})
+
+				// Log out every other session if the password changed
+				if password != "" {
+					InvalidateSessions(w, req, u)
+				}
+				AuditAs(req, u, "settings.update", user.Username, changed, "success")
+
+				// Redirect back to "/settings" when we're done here.
+				http.Redirect(w, req, "/settings", http.StatusSeeOther)
+			}
+		}
+	}
+}
+
+// Handle "/settings/password" web which is where users choose a new
+// password when they have to.
+func HandleChangePassword(w http.ResponseWriter, req *http.Request) {
+	if !IsLoggedIn(w, req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Refresh the templates
+		if *debugFlag {
+			templates = RefreshTemplates(req)
+		}
+
+		// Execute template
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "password", WhoAmI(req))
+	}
+}
+
+// Handles POST requests to "/settings/password" which changes the
+// users password if the new one is allowed.
+func HandleChangePasswordForm(w http.ResponseWriter, req *http.Request) {
+	if !IsLoggedIn(w, req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else if u := WhoAmI(req); u == nil {
+		// Another request logged the user out in the meantime
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Parse our form so we can get values from req.Form
+		err := req.ParseForm()
+		if err != nil {
+			Warnf("Error parsing form: %s", err)
+		}
+
+		password := req.FormValue("password")
+
+		if !u.IsLocal() {
+			http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		} else if password != req.FormValue("confirm") {
+			http.Redirect(w, req, "/settings/password?error=confirm", http.StatusSeeOther)
+		} else if PasswordMatchesHash(password, u.Password) {
+			http.Redirect(w, req, "/settings/password?error=same", http.StatusSeeOther)
+		} else if err := CheckPassword(password, u.Username); err != nil {
+			AuditAs(req, u, "password.change", u.Username, map[string]string{"error": err.Error()}, "failed")
+			http.Redirect(w, req, "/settings/password?error=policy", http.StatusSeeOther)
+		} else {
+			// Update user in database
+			hash := HashPassword(password)
+			db.Table("users").Where("id = ?", u.Id).UpdateColumns(map[string]interface{}{
+				"password":             hash,
+				"must_change_password": false,
+			})
+
+			// Update user in memory
+			users.Update(u.Id, func(v *User) {
+				v.Password = hash
+				v.MustChangePassword = false
+			})
+
+			// Log out every other session
+			InvalidateSessions(w, req, u)
+			AuditAs(req, u, "password.change", u.Username, nil, "success")
+
+			http.Redirect(w, req, "/", http.StatusSeeOther)
+		}
+	}
+}
+
+// Handle "/settings/sessions" web which lists every session that
+// the user is logged in with.
+func HandleSessions(w http.ResponseWriter, req *http.Request) {
+	if !IsLoggedIn(w, req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Refresh the templates
+		if *debugFlag {
+			templates = RefreshTemplates(req)
+		}
+
+		// Get every session for the user
+		var list []UserSession
+		db.Where("user_id = ? AND expires_at > ?", WhoAmI(req).Id, time.Now()).Order("last_activity_at desc").Find(&list)
+
+		session, _ := store.Get(req, "user")
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "sessions", map[string]interface{}{
+			"Sessions": list,
+			"Current":  session.ID,
+		})
+	}
+}
+
+// Handles POST requests to "/settings/sessions/revoke" which logs out
+// one of the users other sessions, or all of them if the id is "all".
+func HandleRevokeSession(w http.ResponseWriter, req *http.Request) {
+	if !IsLoggedIn(w, req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		// Parse our form so we can get values from req.Form
+		err := req.ParseForm()
+		if err != nil {
+			Warnf("Error parsing form: %s", err)
+		}
+
+		user := WhoAmI(req)
+		session, _ := store.Get(req, "user")
+
+		// Only ever delete sessions that belong to the user, and
+		// never the session that is being used right now.
+		query := db.Where("user_id = ? AND token <> ?", user.Id, session.ID)
+		if req.FormValue("id") == "all" {
+			query.Delete(&UserSession{})
+			Audit(req, "session.revoke", user.Username, map[string]string{"session": "all"}, "success")
+		} else if id, err := strconv.ParseUint(req.FormValue("id"), 10, 64); err == nil {
+			query.Where("id = ?", id).Delete(&UserSession{})
+			Audit(req, "session.revoke", user.Username, map[string]string{"session": req.FormValue("id")}, "success")
+		}
+
+		// Redirect back to "/settings/sessions" when we're done here.
+		http.Redirect(w, req, "/settings/sessions", http.StatusSeeOther)
 	}
 }
 
@@ -235,36 +591,29 @@ func HandleGenerate2FA(w http.ResponseWriter, req *http.Request) {
 		if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
 			http.Redirect(w, req, "/settings", http.StatusSeeOther)
 		} else {
-			// Get random secret
-			sec := make([]byte, 6)
-			_, err = rand.Read(sec)
-			if err != nil {
-				golem.Warnf("Error creating random secret key: %s", err)
-			}
+			// Get user
+			u := WhoAmI(req)
 
-			// Encode secret to base32 string
-			secret := base32.StdEncoding.EncodeToString(sec)
+			// Create a new secret that is kept until we verify 2fa is set
+			pending := StartPendingTwofa(u)
 
 			// Create auth string to be encoded as a QR image
-			//
-			// https://code.google.com/p/google-authenticator/wiki/KeyUriFormat
-			// otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example
-			//
-			auth_string := "otpauth://totp/KittensIRC?secret=" + secret + "&issuer=KittensIRC"
+			auth_string := TotpUri(*totpIssuerFlag, u.Username, pending.Secret)
 
 			// Encode the QR image
 			code, err := qr.Encode(auth_string, qr.L)
 			if err != nil {
-				golem.Warnf("Error encoding qr code: %s", err)
+				Warnf("Error encoding qr code: %s", err)
 			}
 
-			// Set temporary session values until we verify 2fa is set
-			session, _ := store.Get(req, "user")
-			session.Values["secret"] = secret
-			session.Save(req, w)
-
-			// Write base64 encoded QR image
-			w.Write([]byte(base64.StdEncoding.EncodeToString(code.PNG())))
+			// Write base64 encoded QR image along with the secret for
+			// apps that can't scan QR codes.
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"qr":     base64.StdEncoding.EncodeToString(code.PNG()),
+				"secret": pending.Secret,
+				"uri":    auth_string,
+			})
 		}
 	}
 }
@@ -278,53 +627,58 @@ func HandleVerify2FA(w http.ResponseWriter, req *http.Request) {
 		if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
 			http.Redirect(w, req, "/settings", http.StatusSeeOther)
 		} else {
-			// Get our session
-			session, _ := store.Get(req, "user")
-			secret := session.Values["secret"]
-
 			// Parse our form so we can get values from req.Form
-			err = req.ParseForm()
+			err := req.ParseForm()
 			if err != nil {
-				golem.Warnf("Error parsing form: %s", err)
+				Warnf("Error parsing form: %s", err)
 			}
 
 			// Get token from input
-			token := req.Form["token"][0]
+			token := req.FormValue("token")
 
-			// Get user
+			// Get user and the secret they are setting up
 			u := WhoAmI(req)
-
-			// Configure token
-			otpc := &dgoogauth.OTPConfig{
-				Secret:      secret.(string),
-				WindowSize:  3,
-				HotpCounter: 0,
-			}
+			pending := FindPendingTwofa(u)
 
 			// Validate token
-			val, err := otpc.Authenticate(token)
-			if err != nil {
-				golem.Warnf("Error authenticating token: %s", err)
+			step := int64(-1)
+			if pending != nil {
+				step = CheckTotp(pending.Secret, token, -1)
 			}
 
-			if val {
-				// Update user
-				u.Twofa = true
-				u.TwofaSecret = secret.(string)
-
-				// Update user in database
+			if pending == nil {
+				// Return error
+				http.Error(w, "2FA setup has expired, start again", http.StatusExpectationFailed)
+			} else if step >= 0 {
+				// Update user in database, and remember the token so
+				// it can't be used again to log in.
 				var user User
 				db.Table("users").Where("id = ?", u.Id).Find(&user)
 				user.Twofa = true
-				user.TwofaSecret = secret.(string)
+				user.TwofaSecret = pending.Secret
+				user.TwofaLastStep = step
 				db.Save(&user)
-
-				// Remove secret from session
-				session.Values["secret"] = ""
-				session.Save(req, w)
-
-				// Return success
-				http.Redirect(w, req, "/settings", http.StatusSeeOther)
+				Audit(req, "2fa.enable", user.Username, nil, "success")
+
+				// Update user in memory
+				users.Update(u.Id, func(v *User) {
+					v.Twofa = true
+					v.TwofaSecret = pending.Secret
+					v.TwofaLastStep = step
+				})
+
+				// Log out every other session
+				InvalidateSessions(w, req, u)
+
+				// Throw away the pending secret
+				db.Delete(pending)
+
+				// Return success with the recovery codes, which are
+				// only ever shown this once.
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string][]string{
+					"codes": GenerateRecoveryCodes(u),
+				})
 			} else {
 				// Return error
 				http.Error(w, "Wrong token", http.StatusExpectationFailed)
@@ -346,15 +700,11 @@ func HandleDisable2FA(w http.ResponseWriter, req *http.Request) {
 			u := WhoAmI(req)
 
 			// Update user
-			u.Twofa = false
-			u.TwofaSecret = ""
+			DisableTotp(u)
+			Audit(req, "2fa.disable", u.Username, nil, "success")
 
-			// Update user in database
-			var user User
-			db.Table("users").Where("id = ?", u.Id).Find(&user)
-			user.Twofa = false
-			user.TwofaSecret = ""
-			db.Save(&user)
+			// Log out every other session
+			InvalidateSessions(w, req, u)
 
 			// Return success
 			http.Redirect(w, req, "/settings", http.StatusSeeOther)
@@ -362,192 +712,1142 @@ func HandleDisable2FA(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// Handle "/users" web
-func HandleUsers(w http.ResponseWriter, req *http.Request) {
-	if *debugFlag {
-		templates = RefreshTemplates(req)
-	}
-
-	// Check if logged in
+// Handles POST AJAX requests to "/settings/webauthn/register/begin"
+// which starts adding a security key to a users account.
+func HandleBeginSecurityKey(w http.ResponseWriter, req *http.Request) {
 	if !IsLoggedIn(w, req) {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	} else {
-		// Get the user
-		user := WhoAmI(req)
-
-		// Check if user is admin
-		if !user.Admin {
-			http.Redirect(w, req, "/", http.StatusSeeOther)
+		if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+			http.Redirect(w, req, "/settings", http.StatusSeeOther)
 		} else {
-			templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "users", &users)
+			// Get user
+			u := WhoAmI(req)
+
+			// Create the options for the browser
+			options, data, err := webAuthn.BeginRegistration(u, webauthn.WithExclusions(SecurityKeyExclusions(u)))
+			if err != nil {
+				Warnf("Error starting security key registration: %s", err)
+				http.Error(w, "Could not add a security key", http.StatusInternalServerError)
+			} else {
+				// Keep the ceremony in the session until it's finished
+				session, _ := store.Get(req, "user")
+				SaveWebAuthnSession(session, "webauthn_register", data)
+				session.Save(req, w)
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(options)
+			}
 		}
 	}
 }
 
-// Handle "/users/new" web POSTs
-func HandleNewUser(w http.ResponseWriter, req *http.Request) {
-	if *debugFlag {
-		templates = RefreshTemplates(req)
-	}
-
-	// Check if logged in
+// Handles POST AJAX requests to "/settings/webauthn/register/finish"
+// which checks the new credential from the browser and saves it as a
+// security key.
+func HandleFinishSecurityKey(w http.ResponseWriter, req *http.Request) {
 	if !IsLoggedIn(w, req) {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	} else {
-		// Get the user
-		user := WhoAmI(req)
-
-		// Check if user is admin
-		if !user.Admin {
-			http.Redirect(w, req, "/", http.StatusSeeOther)
+		if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+			http.Redirect(w, req, "/settings", http.StatusSeeOther)
 		} else {
-			// Parse our form so we can get values from req.Form
-			err = req.ParseForm()
-			if err != nil {
-				golem.Warnf("Error parsing form: %s", err)
+			// Get user
+			u := WhoAmI(req)
+
+			// Get the ceremony we started
+			session, _ := store.Get(req, "user")
+			data, err := LoadWebAuthnSession(session, "webauthn_register")
+			session.Save(req, w)
+
+			var credential *webauthn.Credential
+			if err == nil {
+				credential, err = webAuthn.FinishRegistration(u, data, req)
 			}
 
-			// Parse admin from string to bool
-			admin, err := strconv.ParseBool(req.Form["admin"][0])
-			if err != nil {
-				golem.Warnf("Error parsing admin from string to bool: %s", err)
+			name := strings.TrimSpace(req.URL.Query().Get("name"))
+			if name == "" {
+				name = "Security key"
 			}
 
-			// Check if username is set
-			username := strings.Trim(req.Form["username"][0], " ")
-			password := strings.Trim(req.Form["password"][0], " ")
-			if username == "" {
-				// Redirect back to "/users"
-				http.Redirect(w, req, "/users", http.StatusSeeOther)
+			if err != nil {
+				Warnf("Error finishing security key registration: %s", err)
+				Audit(req, "2fa.key.add", u.Username, map[string]string{"name": name, "error": err.Error()}, "failed")
+				http.Error(w, "Could not add the security key", http.StatusBadRequest)
 			} else {
-				// Check if password is set
-				if password == "" {
-					// Redirect back to "/users"
-					http.Redirect(w, req, "/users", http.StatusSeeOther)
-				} else {
-					// Create user
-					newuser := User{
-						Username:    username,
-						Password:    HashPassword(password),
-						Admin:       admin,
-						Twofa:       false,
-						TwofaSecret: "",
-					}
-
-					// Insert new user into database
-					db.Create(&newuser)
-
-					// Save new user
-					db.Save(&newuser)
-
-					// Update the users array
-					users = append(users, &newuser)
-
-					// Redirect back to "/users" when we're done here
-					http.Redirect(w, req, "/users", http.StatusSeeOther)
+				// Users get recovery codes with their first second factor
+				first := !u.HasSecondFactor()
+
+				// Save the key
+				db.Create(NewSecurityKey(u, name, credential))
+				Audit(req, "2fa.key.add", u.Username, map[string]string{"name": name}, "success")
+
+				// Log out every other session
+				InvalidateSessions(w, req, u)
+
+				codes := []string{}
+				if first {
+					codes = GenerateRecoveryCodes(u)
 				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string][]string{
+					"codes": codes,
+				})
 			}
 		}
 	}
 }
 
-// Handle POSTs to "/user/admin" which switches a users administrative
-// settings.
-func HandleUserAdminSwitch(w http.ResponseWriter, req *http.Request) {
-	if *debugFlag {
-		templates = RefreshTemplates(req)
-	}
-
-	// Check if logged in
+// Handles POST requests to "/settings/webauthn/delete" which removes
+// a security key from a users account.
+func HandleDeleteSecurityKey(w http.ResponseWriter, req *http.Request) {
 	if !IsLoggedIn(w, req) {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	} else {
-		// Check if user is admin
-		if !WhoAmI(req).Admin {
-			http.Redirect(w, req, "/", http.StatusSeeOther)
-		} else {
-			// Parse our form so we can get values from req.Form
-			err = req.ParseForm()
-			if err != nil {
-				golem.Warnf("Error parsing form: %s", err)
-			}
+		// Parse our form so we can get values from req.Form
+		err := req.ParseForm()
+		if err != nil {
+			Warnf("Error parsing form: %s", err)
+		}
 
-			// Get the user we're switching admin values for
-			id, err := strconv.ParseUint(req.Form["id"][0], 10, 16)
-			if err != nil {
-				golem.Warnf("Error converting id: %s", err)
+		// Get user
+		u := WhoAmI(req)
+
+		// Only ever delete keys that belong to the user
+		var key SecurityKey
+		db.Where("id = ? AND user_id = ?", req.FormValue("id"), u.Id).First(&key)
+		if key.Id != 0 {
+			db.Delete(&key)
+			Audit(req, "2fa.key.delete", u.Username, map[string]string{"name": key.Name}, "success")
+
+			// Recovery codes are useless without a second factor
+			if !u.HasSecondFactor() {
+				db.Where("user_id = ?", u.Id).Delete(&RecoveryCode{})
 			}
 
-			// Update in database
-			var user User
-			db.Table("users").Where("id = ?", id).First(&user)
-			user.Admin = !user.Admin
-			db.Save(&user)
+			// Log out every other session
+			InvalidateSessions(w, req, u)
+		}
 
-			// Update in memory
-			for _, v := range users {
-				if id == v.Id {
-					v.Admin = !v.Admin
-				}
+		// Redirect back to "/settings" when we're done here.
+		http.Redirect(w, req, "/settings", http.StatusSeeOther)
+	}
+}
+
+// Handles POST AJAX requests to "/settings/2fa/recovery" which
+// throws away a users recovery codes and gives them new ones.
+func HandleRecoveryCodes(w http.ResponseWriter, req *http.Request) {
+	if !IsLoggedIn(w, req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	} else {
+		if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+			http.Redirect(w, req, "/settings", http.StatusSeeOther)
+		} else {
+			// Get user
+			u := WhoAmI(req)
+
+			if !u.HasSecondFactor() {
+				http.Error(w, "2FA is not enabled", http.StatusExpectationFailed)
+			} else {
+				Audit(req, "2fa.recovery.generate", u.Username, nil, "success")
+
+				// Return the new recovery codes
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string][]string{
+					"codes": GenerateRecoveryCodes(u),
+				})
 			}
+		}
+	}
+}
 
-			// Return success
+// Handle "/users" web
+func HandleUsers(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	// Get every role that has been granted
+	var grants []*RoleGrant
+	db.Order("user_id, server_id").Find(&grants)
+
+	templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "users", map[string]interface{}{
+		"Users":   users.All(),
+		"Roles":   roles.All(),
+		"Servers": servers.All(),
+		"Grants":  grants,
+	})
+}
+
+// Handle "/users/invite" web POSTs which creates an invitation link
+// that lets somebody choose their own password for a new user.
+func HandleInviteUser(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	username := strings.TrimSpace(req.FormValue("username"))
+	email := strings.TrimSpace(req.FormValue("email"))
+	admin, _ := strconv.ParseBool(req.FormValue("admin"))
+
+	if username == "" {
+		Audit(req, "user.invite", username, map[string]string{"error": "username is blank"}, "failed")
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else if FindUserByUsername(username) != nil {
+		Audit(req, "user.invite", username, map[string]string{"error": "username is taken"}, "failed")
+		http.Redirect(w, req, "/users?error=username", http.StatusSeeOther)
+	} else if me := WhoAmI(req); admin && (me == nil || !me.Admin) {
+		Audit(req, "user.invite", username, map[string]string{"error": "only administrators can make administrators"}, "failed")
+		http.Redirect(w, req, "/users?error=admin", http.StatusSeeOther)
+	} else {
+		// Create the invitation
+		token := NewUserToken(&UserToken{
+			Purpose:     TokenInvite,
+			Username:    username,
+			Email:       email,
+			Admin:       admin,
+			CreatedById: WhoAmI(req).Id,
+		}, *inviteExpiryFlag)
+
+		SendTokenLink(w, req, email, username, "You have been invited to Sorbet",
+			"You have been invited to Sorbet as "+username+". Choose your password with this link:",
+			TokenLink(TokenInvite, token))
+		Audit(req, "user.invite", username, map[string]string{"email": email, "admin": strconv.FormatBool(admin)}, "success")
+	}
+}
+
+// Handle "/users/reset" web POSTs which creates a link that lets a
+// user choose a new password.
+func HandleResetUser(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, _ := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	user := FindUser(id)
+	if user == nil || !user.IsLocal() {
+		RedirectBack(w, req)
+	} else if !WhoAmI(req).CanManage(user) {
+		Audit(req, "user.reset", user.Username, map[string]string{"error": "only administrators can change administrators"}, "failed")
+		RedirectBack(w, req)
+	} else {
+		// Create the reset link
+		token := NewUserToken(&UserToken{
+			Purpose:     TokenReset,
+			UserId:      user.Id,
+			Email:       user.Email,
+			CreatedById: WhoAmI(req).Id,
+		}, *resetExpiryFlag)
+
+		SendTokenLink(w, req, user.Email, user.Username, "Reset your Sorbet password",
+			"Choose a new password for "+user.Username+" with this link:",
+			TokenLink(TokenReset, token))
+		Audit(req, "user.reset", user.Username, map[string]string{"email": user.Email}, "success")
+	}
+}
+
+// Send Token Link delivers a link with the notifier and shows whoever
+// created it if it was sent, or the link itself to hand over if it
+// couldn't be.
+func SendTokenLink(w http.ResponseWriter, req *http.Request, email string, username string, subject string, message string, link string) {
+	sent, err := notifier.Notify(email, subject, message, link)
+	if err != nil {
+		Warnf("Error sending link to %s: %s", email, err)
+	}
+
+	// Refresh the templates
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	data := map[string]interface{}{
+		"Username": username,
+		"Email":    email,
+		"Sent":     sent,
+	}
+
+	// Only show the link if it wasn't delivered
+	if !sent {
+		data["Link"] = link
+	}
+
+	templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "link", data)
+}
+
+// Handle "/invite/{token}" web which is where somebody that has been
+// invited chooses their password.
+func HandleInvite(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	t := FindUserToken(TokenInvite, mux.Vars(req)["token"])
+	if t == nil {
+		http.Redirect(w, req, "/login?error=link", http.StatusSeeOther)
+	} else {
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "token", map[string]string{
+			"Title":    "Welcome to Sorbet",
+			"Username": t.Username,
+			"Action":   "/invite/" + mux.Vars(req)["token"],
+		})
+	}
+}
+
+// Handle POSTS to "/invite/{token}" which creates the user that was
+// invited with the password that they chose.
+func HandleInviteForm(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	token := mux.Vars(req)["token"]
+	password := req.FormValue("password")
+
+	t := FindUserToken(TokenInvite, token)
+	problem := ""
+	if t == nil {
+		problem = "This invitation has expired or has already been used."
+	} else if FindUserByUsername(t.Username) != nil {
+		problem = "The username " + t.Username + " has been taken since you were invited."
+	} else if password != req.FormValue("confirm") {
+		problem = "The passwords don't match."
+	} else if err := CheckPassword(password, t.Username); err != nil {
+		problem = err.Error() + "."
+	} else if !t.Use() {
+		problem = "This invitation has expired or has already been used."
+	}
+
+	if problem != "" {
+		// Show the form again with what went wrong
+		data := map[string]string{
+			"Title":  "Welcome to Sorbet",
+			"Action": "/invite/" + token,
+			"Error":  problem,
+		}
+
+		if t != nil {
+			data["Username"] = t.Username
+		}
+
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "token", data)
+	} else {
+		// Create user
+		newuser := User{
+			Username:      t.Username,
+			Email:         t.Email,
+			Password:      HashPassword(password),
+			Admin:         t.Admin,
+			SecurityStamp: NewSecurityStamp(),
+		}
+
+		db.Create(&newuser)
+
+		// Update the users array
+		users.Add(&newuser)
+		AuditAs(req, &newuser, "user.invite.accept", newuser.Username, nil, "success")
+
+		// Log in as the new user
+		LogIn(w, req, &newuser)
+	}
+}
+
+// Handle "/reset/{token}" web which is where a user chooses a new
+// password with a reset link.
+func HandleReset(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	t := FindUserToken(TokenReset, mux.Vars(req)["token"])
+	var user *User
+	if t != nil {
+		user = FindUser(t.UserId)
+	}
+
+	if user == nil {
+		http.Redirect(w, req, "/login?error=link", http.StatusSeeOther)
+	} else {
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "token", map[string]string{
+			"Title":    "Reset your password",
+			"Username": user.Username,
+			"Action":   "/reset/" + mux.Vars(req)["token"],
+		})
+	}
+}
+
+// Handle POSTS to "/reset/{token}" which changes the user's password
+// to the one that they chose.
+func HandleResetForm(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	token := mux.Vars(req)["token"]
+	password := req.FormValue("password")
+
+	t := FindUserToken(TokenReset, token)
+	var user *User
+	if t != nil {
+		user = FindUser(t.UserId)
+	}
+
+	problem := ""
+	if user == nil {
+		problem = "This link has expired or has already been used."
+	} else if password != req.FormValue("confirm") {
+		problem = "The passwords don't match."
+	} else if err := CheckPassword(password, user.Username); err != nil {
+		problem = err.Error() + "."
+	} else if !t.Use() {
+		problem = "This link has expired or has already been used."
+	}
+
+	if problem != "" {
+		// Show the form again with what went wrong
+		data := map[string]string{
+			"Title":  "Reset your password",
+			"Action": "/reset/" + token,
+			"Error":  problem,
+		}
+
+		if user != nil {
+			data["Username"] = user.Username
+		}
+
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "token", data)
+	} else {
+		// Update user in database
+		hash := HashPassword(password)
+		db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{
+			"password":             hash,
+			"must_change_password": false,
+		})
+
+		// Update user in memory
+		users.Update(user.Id, func(v *User) {
+			v.Password = hash
+			v.MustChangePassword = false
+		})
+
+		// Log out every session and let them try logging in again
+		InvalidateSessions(w, req, user)
+		ClearLoginFailures(UserLoginKey(user.Username))
+		AuditAs(req, user, "password.reset", user.Username, nil, "success")
+
+		http.Redirect(w, req, "/login?reset=done", http.StatusSeeOther)
+	}
+}
+
+// Handle "/login/forgot" web which is where users can ask for a link
+// to reset their password.
+func HandleForgot(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "forgot", nil)
+}
+
+// Handle POSTS to "/login/forgot" which emails a reset link to the user
+// if they have an email address. The same thing is shown either way so
+// nobody can find out which users exist.
+func HandleForgotForm(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	username := strings.TrimSpace(req.FormValue("username"))
+	user := FindUserByUsername(username)
+
+	// Don't send anything to locked accounts or addresses
+	if CanSendLinks() && user != nil && user.IsLocal() && user.Email != "" && !LoginLocked(LoginKeys(req, username)) {
+		token := NewUserToken(&UserToken{
+			Purpose: TokenReset,
+			UserId:  user.Id,
+			Email:   user.Email,
+		}, *resetExpiryFlag)
+
+		sent, err := notifier.Notify(user.Email, "Reset your Sorbet password",
+			"Somebody asked to reset the password for "+user.Username+". If it was you then choose a new password with this link:",
+			TokenLink(TokenReset, token))
+		if err != nil {
+			Warnf("Error sending link to %s: %s", user.Email, err)
+		}
+
+		AuditAs(req, user, "password.forgot", user.Username, map[string]string{"sent": strconv.FormatBool(sent)}, "success")
+	}
+
+	http.Redirect(w, req, "/login?reset=sent", http.StatusSeeOther)
+}
+
+// Handle "/users/new" web POSTs
+func HandleNewUser(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	// Parse admin from string to bool
+	admin, err := strconv.ParseBool(req.Form["admin"][0])
+	if err != nil {
+		Warnf("Error parsing admin from string to bool: %s", err)
+	}
+
+	// Check if username is set
+	username := strings.Trim(req.Form["username"][0], " ")
+	password := strings.Trim(req.Form["password"][0], " ")
+	if username == "" {
+		// Redirect back to "/users"
+		Audit(req, "user.create", username, map[string]string{"error": "username is blank"}, "failed")
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else {
+		// Check if password is allowed
+		if err := CheckPassword(password, username); err != nil {
+			// Redirect back to "/users"
+			Audit(req, "user.create", username, map[string]string{"error": err.Error()}, "failed")
+			http.Redirect(w, req, "/users?error=password", http.StatusSeeOther)
+		} else if FindUserByUsername(username) != nil {
+			// Redirect back to "/users"
+			Audit(req, "user.create", username, map[string]string{"error": "username is taken"}, "failed")
+			http.Redirect(w, req, "/users?error=username", http.StatusSeeOther)
+		} else if me := WhoAmI(req); admin && (me == nil || !me.Admin) {
+			// Redirect back to "/users"
+			Audit(req, "user.create", username, map[string]string{"error": "only administrators can make administrators"}, "failed")
+			http.Redirect(w, req, "/users?error=admin", http.StatusSeeOther)
+		} else {
+			// Create user, who has to choose their own password
+			// since we know this one.
+			newuser := User{
+				Username:           username,
+				Password:           HashPassword(password),
+				MustChangePassword: true,
+				Admin:              admin,
+				Twofa:              false,
+				TwofaSecret:        "",
+				SecurityStamp:      NewSecurityStamp(),
+			}
+
+			// Insert new user into database
+			db.Create(&newuser)
+
+			// Save new user
+			db.Save(&newuser)
+
+			// Update the users array
+			users.Add(&newuser)
+			Audit(req, "user.create", username, map[string]string{"admin": strconv.FormatBool(admin)}, "success")
+
+			// Redirect back to "/users" when we're done here
 			http.Redirect(w, req, "/users", http.StatusSeeOther)
 		}
 	}
 }
 
+// Handle POSTs to "/user/admin" which switches a users administrative
+// settings.
+func HandleUserAdminSwitch(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	// Get the user we're switching admin values for
+	var user User
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		Warnf("Error converting id: %s", err)
+		Audit(req, "user.admin", req.FormValue("id"), map[string]string{"error": "id is not a number"}, "failed")
+	} else if db.Table("users").Where("id = ?", id).First(&user).RecordNotFound() {
+		Audit(req, "user.admin", req.FormValue("id"), map[string]string{"error": "user does not exist"}, "failed")
+	} else if me := WhoAmI(req); me == nil || !me.Admin {
+		Audit(req, "user.admin", user.Username, map[string]string{"error": "only administrators can make administrators"}, "failed")
+	} else {
+		// Update in database
+		user.Admin = !user.Admin
+		err := db.Save(&user).Error
+		if err != nil {
+			Warnf("Error switching admin for user %s: %s", user.Username, err)
+			Audit(req, "user.admin", user.Username, map[string]string{"error": err.Error()}, "failed")
+		} else {
+			Audit(req, "user.admin", user.Username, map[string]string{"admin": strconv.FormatBool(user.Admin)}, "success")
+
+			// Update in memory, and log out every session of the user if
+			// they are no longer an administrator
+			v := users.Update(id, func(v *User) {
+				v.Admin = user.Admin
+			})
+
+			if v != nil && !v.Admin {
+				InvalidateSessions(w, req, v)
+			}
+		}
+	}
+
+	// Return success
+	http.Redirect(w, req, "/users", http.StatusSeeOther)
+}
+
+// Redirect Back sends an admin back to the user page that a form was
+// sent from, or to "/users" if it wasn't sent from one.
+func RedirectBack(w http.ResponseWriter, req *http.Request) {
+	back := req.FormValue("back")
+	if !regexp.MustCompile(`^/users/[0-9]+$`).MatchString(back) {
+		back = "/users"
+	}
+
+	http.Redirect(w, req, back, http.StatusSeeOther)
+}
+
+// Handle "/users/{id}" web which is where admins edit a single user.
+func HandleUser(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	id, _ := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	user := FindUser(id)
+	if user == nil {
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else {
+		// Get every role that has been granted to the user
+		var grants []*RoleGrant
+		db.Where("user_id = ?", user.Id).Order("server_id").Find(&grants)
+
+		// Count the sessions the user is logged in with
+		var sessions int
+		db.Model(&UserSession{}).Where("user_id = ? AND expires_at > ?", user.Id, time.Now()).Count(&sessions)
+
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "user", map[string]interface{}{
+			"User":     user,
+			"Grants":   grants,
+			"Sessions": sessions,
+			"Self":     user.Id == WhoAmI(req).Id,
+		})
+	}
+}
+
+// Handle POSTs to "/users/{id}" which renames a user, changes their
+// email address and disables or enables them.
+func HandleUpdateUser(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, _ := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	user := FindUser(id)
+	back := "/users/" + mux.Vars(req)["id"]
+
+	username := strings.TrimSpace(req.FormValue("username"))
+	email := strings.TrimSpace(req.FormValue("email"))
+	disabled, _ := strconv.ParseBool(req.FormValue("disabled"))
+
+	if user == nil {
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else if username == "" {
+		http.Redirect(w, req, back+"?error=username", http.StatusSeeOther)
+	} else if other := FindUserByUsername(username); other != nil && other.Id != user.Id {
+		Audit(req, "user.update", user.Username, map[string]string{"error": "username is taken"}, "failed")
+		http.Redirect(w, req, back+"?error=taken", http.StatusSeeOther)
+	} else if _, err := mail.ParseAddress(email); email != "" && err != nil {
+		http.Redirect(w, req, back+"?error=email", http.StatusSeeOther)
+	} else if disabled && user.Id == WhoAmI(req).Id {
+		http.Redirect(w, req, back+"?error=self", http.StatusSeeOther)
+	} else if !WhoAmI(req).CanManage(user) {
+		Audit(req, "user.update", user.Username, map[string]string{"error": "only administrators can change administrators"}, "failed")
+		http.Redirect(w, req, back+"?error=admin", http.StatusSeeOther)
+	} else {
+		// Keep track of what changed for the audit log
+		changed := map[string]string{}
+
+		// Users from a directory keep the name from the directory
+		if !user.IsLocal() {
+			username = user.Username
+		} else if username != user.Username {
+			changed["username"] = user.Username + " -> " + username
+		}
+
+		if email != user.Email {
+			changed["email"] = user.Email + " -> " + email
+		}
+
+		if disabled != user.Disabled {
+			changed["disabled"] = strconv.FormatBool(disabled)
+		}
+
+		// Update user in database, which fails if someone else took
+		// the username in the meantime
+		err := db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{
+			"username": username,
+			"email":    email,
+			"disabled": disabled,
+		}).Error
+
+		if err != nil {
+			Warnf("Error updating user %s: %s", user.Username, err)
+			Audit(req, "user.update", user.Username, map[string]string{"error": err.Error()}, "failed")
+			http.Redirect(w, req, back+"?error=save", http.StatusSeeOther)
+		} else {
+			// Update user in memory
+			users.Update(user.Id, func(v *User) {
+				v.Username = username
+				v.Email = email
+				v.Disabled = disabled
+			})
+
+			// Log out every session of a user that has been disabled
+			if disabled {
+				InvalidateSessions(w, req, user)
+			}
+
+			Audit(req, "user.update", username, changed, "success")
+			http.Redirect(w, req, back, http.StatusSeeOther)
+		}
+	}
+}
+
+// Handle POSTs to "/users/{id}/password" which gives a user a temporary
+// password that they have to change when they next log in.
+func HandleUserPassword(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, _ := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+	user := FindUser(id)
+	back := "/users/" + mux.Vars(req)["id"]
+	password := req.FormValue("password")
+
+	if user == nil || !user.IsLocal() {
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else if !WhoAmI(req).CanManage(user) {
+		Audit(req, "user.password", user.Username, map[string]string{"error": "only administrators can change administrators"}, "failed")
+		http.Redirect(w, req, back+"?error=admin", http.StatusSeeOther)
+	} else if err := CheckPassword(password, user.Username); err != nil {
+		Audit(req, "user.password", user.Username, map[string]string{"error": err.Error()}, "failed")
+		http.Redirect(w, req, back+"?error=password", http.StatusSeeOther)
+	} else {
+		// Update user in database
+		hash := HashPassword(password)
+		db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{
+			"password":             hash,
+			"must_change_password": true,
+		})
+
+		// Update user in memory
+		users.Update(user.Id, func(v *User) {
+			v.Password = hash
+			v.MustChangePassword = true
+		})
+
+		// Log out every session of the user
+		InvalidateSessions(w, req, user)
+		ClearLoginFailures(UserLoginKey(user.Username))
+		Audit(req, "user.password", user.Username, nil, "success")
+
+		http.Redirect(w, req, back+"?done=password", http.StatusSeeOther)
+	}
+}
+
 // Handle POSTs to "/user/delete" which deletes a user completely
 func HandleUserDelete(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	// Parse accept from string to bool
+	accept, err := strconv.ParseBool(req.Form["accept"][0])
+	if err != nil {
+		Warnf("Error parsing accept from string to bool: %s", err)
+	}
+
+	if !accept {
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	} else {
+		// Get the user we're deleting
+		username := req.Form["username"][0]
+		result := "failed"
+
+		// Delete user from memory
+		if u := users.FindByUsername(username); u != nil && WhoAmI(req).CanManage(u) && users.Remove(u.Id) != nil {
+			id := u.Id
+			// Delete user from database
+			db.Unscoped().Table("users").Where("id = ?", id).Delete(&User{})
+			// Delete the roles the user had been granted
+			db.Where("user_id = ?", id).Delete(&RoleGrant{})
+			// Delete every session of the user
+			db.Where("user_id = ?", id).Delete(&UserSession{})
+			// Delete the user's 2fa secrets, recovery codes, security keys
+			// and reset links
+			db.Where("user_id = ?", id).Delete(&RecoveryCode{})
+			db.Where("user_id = ?", id).Delete(&PendingTwofa{})
+			db.Where("user_id = ?", id).Delete(&SecurityKey{})
+			db.Where("user_id = ?", id).Delete(&UserToken{})
+			result = "success"
+		}
+
+		Audit(req, "user.delete", username, nil, result)
+
+		// Redirect when we're done here
+		http.Redirect(w, req, "/users", http.StatusSeeOther)
+	}
+}
+
+// Handle POSTs to "/users/roles/grant" which grants a role to a user
+// either globally or on a single server.
+func HandleUserGrantRole(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	// Get the user, role and server that we're granting
+	user, _ := strconv.ParseUint(req.FormValue("user"), 10, 64)
+	role, _ := strconv.ParseUint(req.FormValue("role"), 10, 64)
+	server, _ := strconv.ParseUint(req.FormValue("server"), 10, 64)
+
+	// Make sure everything we're granting actually exists. A server
+	// of 0 means the role is granted globally.
+	params := map[string]string{
+		"role":   req.FormValue("role"),
+		"server": req.FormValue("server"),
+	}
+
+	if FindUser(user) == nil || FindRole(role) == nil || (server != 0 && FindServer(server) == nil) {
+		Warnf("Error granting role %d to user %d on server %d", role, user, server)
+		Audit(req, "role.grant", req.FormValue("user"), params, "failed")
+	} else {
+		grant := RoleGrant{
+			UserId:   user,
+			RoleId:   role,
+			ServerId: server,
+		}
+
+		// Only create the grant if the user does not have it yet
+		db.FirstOrCreate(&grant, grant)
+		params["role"] = FindRole(role).Name
+		Audit(req, "role.grant", FindUser(user).Username, params, "success")
+	}
+
+	// Redirect back to "/users" when we're done here
+	http.Redirect(w, req, "/users", http.StatusSeeOther)
+}
+
+// Handle POSTs to "/users/roles/revoke" which takes a role away from
+// a user that it has been granted to.
+func HandleUserRevokeRole(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	// Get the grant we're revoking
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		Warnf("Error converting id: %s", err)
+		Audit(req, "role.revoke", req.FormValue("id"), map[string]string{"error": "id is not a number"}, "failed")
+	} else {
+		var grant RoleGrant
+		if db.Where("id = ?", id).First(&grant).RecordNotFound() {
+			Audit(req, "role.revoke", req.FormValue("id"), map[string]string{"error": "grant does not exist"}, "failed")
+		} else {
+			db.Where("id = ?", id).Delete(&RoleGrant{})
+
+			// Record who and what was revoked
+			target := ""
+			params := map[string]string{"server": strconv.FormatUint(grant.ServerId, 10)}
+			if u := grant.User(); u != nil {
+				target = u.Username
+			}
+			if r := grant.Role(); r != nil {
+				params["role"] = r.Name
+			}
+			Audit(req, "role.revoke", target, params, "success")
+		}
+	}
+
+	// Redirect back to "/users" when we're done here
+	http.Redirect(w, req, "/users", http.StatusSeeOther)
+}
+
+// Handle "/servers/{server}" web which shows the console for a server.
+func HandleServer(w http.ResponseWriter, req *http.Request) {
 	if *debugFlag {
 		templates = RefreshTemplates(req)
 	}
 
-	// Check if logged in
-	if !IsLoggedIn(w, req) {
-		http.Redirect(w, req, "/login", http.StatusSeeOther)
+	server := FindServer(RequestServerId(req))
+	if server == nil {
+		http.Redirect(w, req, "/", http.StatusSeeOther)
 	} else {
-		// Check if user is admin
-		if !WhoAmI(req).Admin {
-			http.Redirect(w, req, "/", http.StatusSeeOther)
+		templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "server", server)
+	}
+}
+
+// Handles POST AJAX requests to "/servers/{server}/command" which
+// sends a command to a server and returns the response.
+func HandleServerCommand(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+	} else {
+		server := FindServer(RequestServerId(req))
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
 		} else {
-			// Parse our form so we can get values from req.Form
-			err = req.ParseForm()
+			// Run the command as the current user
+			command := req.FormValue("command")
+			target := server.Host + ":" + strconv.Itoa(server.Port)
+			response, err := server.Run(WhoAmI(req), command)
 			if err != nil {
-				golem.Warnf("Error parsing form: %s", err)
+				Audit(req, "server.command", target, map[string]string{"command": command, "error": err.Error()}, "denied")
+				http.Error(w, err.Error(), http.StatusForbidden)
+			} else {
+				Audit(req, "server.command", target, map[string]string{"command": command}, "success")
+				w.Write([]byte(response))
 			}
+		}
+	}
+}
 
-			// Parse accept from string to bool
-			accept, err := strconv.ParseBool(req.Form["accept"][0])
-			if err != nil {
-				golem.Warnf("Error parsing accept from string to bool: %s", err)
-			}
+// Handle "/policies" web which lists every command policy.
+func HandlePolicies(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
 
-			if !accept {
-				http.Redirect(w, req, "/users", http.StatusSeeOther)
-			} else {
-				// Get the user we're switching admin values for
-				username := req.Form["username"][0]
-				var id uint64 = 0
-				for _, u := range users {
-					if u.Username == username {
-						id = u.Id
-					}
-				}
+	// Get every policy
+	var policies []*CommandPolicy
+	db.Order("role_id, server_id, command").Find(&policies)
 
-				// Loop through users to find user in memory
-				for i, v := range users {
-					if id == v.Id {
-						// Delete user from memory
-						users = append(users[:i], users[i+1:]...)
-						// Delete user from database
-						db.Unscoped().Table("users").Where("id = ?", id).Delete(&User{})
-					}
-				}
+	templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "policies", map[string]interface{}{
+		"Policies": policies,
+		"Roles":    roles.All(),
+		"Servers":  servers.All(),
+	})
+}
 
-				// Redirect when we're done here
-				http.Redirect(w, req, "/users", http.StatusSeeOther)
-			}
+// Handle POSTs to "/policies/new" which creates a new command policy.
+func HandleNewPolicy(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	role, _ := strconv.ParseUint(req.FormValue("role"), 10, 64)
+	server, _ := strconv.ParseUint(req.FormValue("server"), 10, 64)
+	allow, _ := strconv.ParseBool(req.FormValue("allow"))
+	command, _ := SplitCommand(req.FormValue("command"))
+	arguments := strings.TrimSpace(req.FormValue("arguments"))
+
+	// Make sure the role and server exist, and that the arguments
+	// are a valid regular expression.
+	params := map[string]string{
+		"role":      req.FormValue("role"),
+		"server":    req.FormValue("server"),
+		"allow":     strconv.FormatBool(allow),
+		"arguments": arguments,
+	}
+
+	if FindRole(role) == nil || (server != 0 && FindServer(server) == nil) || command == "" {
+		Warnf("Error creating command policy for role %d on server %d", role, server)
+		Audit(req, "policy.create", command, params, "failed")
+	} else if _, err := regexp.Compile(arguments); err != nil {
+		Warnf("Error compiling command policy arguments: %s", err)
+		Audit(req, "policy.create", command, params, "failed")
+	} else {
+		db.Create(&CommandPolicy{
+			RoleId:    role,
+			ServerId:  server,
+			Allow:     allow,
+			Command:   command,
+			Arguments: arguments,
+		})
+		Audit(req, "policy.create", command, params, "success")
+	}
+
+	// Redirect back to "/policies" when we're done here
+	http.Redirect(w, req, "/policies", http.StatusSeeOther)
+}
+
+// Handle POSTs to "/policies/delete" which deletes a command policy.
+func HandlePolicyDelete(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		Warnf("Error converting id: %s", err)
+	} else {
+		var policy CommandPolicy
+		db.Where("id = ?", id).First(&policy)
+		db.Where("id = ?", id).Delete(&CommandPolicy{})
+		Audit(req, "policy.delete", policy.Command, map[string]string{
+			"id":    strconv.FormatUint(id, 10),
+			"allow": strconv.FormatBool(policy.Allow),
+		}, "success")
+	}
+
+	// Redirect back to "/policies" when we're done here
+	http.Redirect(w, req, "/policies", http.StatusSeeOther)
+}
+
+// Handle "/audit" web which lists the audit log with optional
+// filters, one page at a time.
+func HandleAudit(w http.ResponseWriter, req *http.Request) {
+	if *debugFlag {
+		templates = RefreshTemplates(req)
+	}
+
+	// Figure out which page we're on
+	page, err := strconv.Atoi(req.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// Count every entry that matches the filters
+	var total int
+	AuditQuery(req).Count(&total)
+
+	// Get the entries for this page
+	var entries []AuditEntry
+	AuditQuery(req).Order("id desc").Limit(auditPageSize).Offset((page - 1) * auditPageSize).Find(&entries)
+
+	// Build links to the pages around this one, and to the exports,
+	// that keep the filters
+	link := func(path string, key string, value string) string {
+		query := req.URL.Query()
+		query.Del("page")
+		query.Set(key, value)
+		return path + "?" + query.Encode()
+	}
+
+	data := map[string]interface{}{
+		"Entries": entries,
+		"Filters": req.URL.Query(),
+		"Page":    page,
+		"Total":   total,
+		"Csv":     link("/audit/export", "format", "csv"),
+		"Json":    link("/audit/export", "format", "json"),
+	}
+
+	if page > 1 {
+		data["Prev"] = link("/audit", "page", strconv.Itoa(page-1))
+	}
+
+	if page*auditPageSize < total {
+		data["Next"] = link("/audit", "page", strconv.Itoa(page+1))
+	}
+
+	templates.Funcs(AddTemplateFunctions(req)).ExecuteTemplate(w, "audit", data)
+}
+
+// Handle "/audit/export" web which downloads every audit entry that
+// matches the filters as either CSV or JSON.
+func HandleAuditExport(w http.ResponseWriter, req *http.Request) {
+	var entries []AuditEntry
+	AuditQuery(req).Order("id").Find(&entries)
+
+	filename := "sorbet-audit-" + time.Now().Format("20060102-150405")
+
+	if req.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+".json\"")
+
+		err := json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			Warnf("Error exporting audit log: %s", err)
 		}
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+".csv\"")
+
+		out := csv.NewWriter(w)
+		out.Write([]string{"id", "time", "actor_id", "actor", "action", "target", "parameters", "ip", "user_agent", "result"})
+		for _, e := range entries {
+			out.Write([]string{
+				strconv.FormatUint(e.Id, 10),
+				e.CreatedAt.UTC().Format(time.RFC3339),
+				strconv.FormatUint(e.ActorId, 10),
+				CSVCell(e.Actor),
+				CSVCell(e.Action),
+				CSVCell(e.Target),
+				CSVCell(e.Parameters),
+				CSVCell(e.Ip),
+				CSVCell(e.UserAgent),
+				CSVCell(e.Result),
+			})
+		}
+
+		out.Flush()
+		if err := out.Error(); err != nil {
+			Warnf("Error exporting audit log: %s", err)
+		}
+	}
+}
+
+// Handle POSTs to "/users/unlock" which unlocks a user that has been
+// locked out because of failed logins.
+func HandleUserUnlock(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		Warnf("Error converting id: %s", err)
+	} else if user := FindUser(id); user != nil {
+		ClearLoginFailures(UserLoginKey(user.Username))
+		Audit(req, "user.unlock", user.Username, nil, "success")
 	}
+
+	// Redirect back to where we came from when we're done here
+	RedirectBack(w, req)
+}
+
+// Handle POSTs to "/users/2fa/reset" which turns off 2fa for a user
+// that has lost their phone and their recovery codes.
+func HandleUserReset2FA(w http.ResponseWriter, req *http.Request) {
+	// Parse our form so we can get values from req.Form
+	err := req.ParseForm()
+	if err != nil {
+		Warnf("Error parsing form: %s", err)
+	}
+
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		Warnf("Error converting id: %s", err)
+	} else if user := FindUser(id); user != nil && WhoAmI(req).CanManage(user) {
+		ResetTwofa(user)
+		InvalidateSessions(w, req, user)
+		Audit(req, "user.2fa.reset", user.Username, nil, "success")
+	}
+
+	// Redirect back to where we came from when we're done here
+	RedirectBack(w, req)
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// As Test User adds the cookies of a logged in user to a request.
+func AsTestUser(req *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	return req
+}
+
+func TestUpdateUserKeepsTheUserWhenSavingFails(t *testing.T) {
+	user := NewTestUser(t, "update-keep", false)
+	cookies := LogInTestUser(t, NewTestUser(t, "update-admin", true))
+
+	// A user that was saved by someone else and isn't in memory yet
+	if err := db.Create(&User{Username: "update-taken", SecurityStamp: NewSecurityStamp()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	id := strconv.FormatUint(user.Id, 10)
+	req := AsTestUser(NewTestForm("/users/"+id, url.Values{"username": {"update-taken"}, "email": {"keep@example.com"}}), cookies)
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+
+	w := httptest.NewRecorder()
+	HandleUpdateUser(w, req)
+
+	if location := w.Header().Get("Location"); location != "/users/"+id+"?error=save" {
+		t.Errorf("saving a taken username sent the admin to %q", location)
+	}
+
+	if found := FindUser(user.Id); found.Username != "update-keep" || found.Email != "" {
+		t.Errorf("the user in memory was changed to %q with %q when saving failed", found.Username, found.Email)
+	}
+}
+
+func TestOnlyAdministratorsCanChangeAdministrators(t *testing.T) {
+	manager := NewTestUser(t, "manager", false)
+	GrantTestRole(t, manager, "admin", 0)
+	admin := NewTestUser(t, "manager-admin", true)
+	other := NewTestUser(t, "manager-other", false)
+	cookies := LogInTestUser(t, manager)
+
+	// Managers can't make themselves administrators
+	HandleUserAdminSwitch(httptest.NewRecorder(), AsTestUser(NewTestForm("/users/admin", url.Values{"id": {strconv.FormatUint(manager.Id, 10)}}), cookies))
+	if FindUser(manager.Id).Admin {
+		t.Error("a manager made themselves an administrator")
+	}
+
+	// Or create new ones
+	w := httptest.NewRecorder()
+	HandleNewUser(w, AsTestUser(NewTestForm("/users/new", url.Values{
+		"username": {"manager-new"},
+		"password": {"Correct-Horse-Battery-9"},
+		"admin":    {"true"},
+	}), cookies))
+
+	if location := w.Header().Get("Location"); location != "/users?error=admin" || FindUserByUsername("manager-new") != nil {
+		t.Errorf("creating an administrator as a manager sent them to %q", location)
+	}
+
+	// Or reset the password of an administrator
+	password := func(user *User) string {
+		id := strconv.FormatUint(user.Id, 10)
+		req := AsTestUser(NewTestForm("/users/"+id+"/password", url.Values{"password": {"Correct-Horse-Battery-9"}}), cookies)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+
+		w := httptest.NewRecorder()
+		HandleUserPassword(w, req)
+		return w.Header().Get("Location")
+	}
+
+	if location := password(admin); location != "/users/"+strconv.FormatUint(admin.Id, 10)+"?error=admin" {
+		t.Errorf("changing the password of an administrator as a manager sent them to %q", location)
+	}
+
+	if FindUser(admin.Id).MustChangePassword {
+		t.Error("a manager changed the password of an administrator")
+	}
+
+	// But they can change everyone else
+	if location := password(other); location != "/users/"+strconv.FormatUint(other.Id, 10)+"?done=password" {
+		t.Errorf("changing the password of a user as a manager sent them to %q", location)
+	}
+
+	// And administrators can make administrators
+	HandleUserAdminSwitch(httptest.NewRecorder(), AsTestUser(NewTestForm("/users/admin", url.Values{"id": {strconv.FormatUint(manager.Id, 10)}}), LogInTestUser(t, admin)))
+	if !FindUser(manager.Id).Admin {
+		t.Error("an administrator should be able to make a manager an administrator")
+	}
+}
+
+func TestUserAdminSwitchKeepsTheUserWhenSavingFails(t *testing.T) {
+	user := NewTestUser(t, "admin-switch-keep", false)
+	cookies := LogInTestUser(t, NewTestUser(t, "admin-switch-admin", true))
+
+	// Fail every update until the test is done
+	db.Callback().Update().Before("gorm:update").Register("test:fail", func(scope *gorm.Scope) {
+		scope.Err(errors.New("the database is gone"))
+	})
+	defer db.Callback().Update().Remove("test:fail")
+
+	HandleUserAdminSwitch(httptest.NewRecorder(), AsTestUser(NewTestForm("/users/admin", url.Values{"id": {strconv.FormatUint(user.Id, 10)}}), cookies))
+
+	if FindUser(user.Id).Admin {
+		t.Error("the user in memory was made an administrator when saving failed")
+	}
+
+	var entry AuditEntry
+	db.Where("action = ? AND target = ?", "user.admin", user.Username).Last(&entry)
+	if entry.Result != "failed" {
+		t.Errorf("the switch was audited as %q, want failed", entry.Result)
+	}
+}
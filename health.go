@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long to wait for a server to answer when checking if it can be
+// reached.
+const healthServerTimeout = 2 * time.Second
+
+// How long to wait for the database to answer.
+const healthDatabaseTimeout = 2 * time.Second
+
+// How long the result of checking the servers is kept, so that probes
+// that come in quickly don't each connect to every server.
+const healthServerCacheFor = 5 * time.Second
+
+// When Sorbet was started, which is shown on /healthz.
+var startedAt = time.Now()
+
+// The last result of checking the servers and when it was checked. The
+// lock is held while checking, so probes that come in at the same time
+// wait for the one check instead of starting their own.
+var serverHealth struct {
+	lock      sync.Mutex
+	checkedAt time.Time
+	errs      map[string]error
+}
+
+// Reasons that Sorbet isn't ready, other than errors from the database.
+var (
+	errTemplatesNotLoaded = errors.New("templates are not loaded")
+	errShuttingDown       = errors.New("sorbet is shutting down")
+)
+
+// HealthCheck is the result of one of the checks on /readyz.
+type HealthCheck struct {
+	// Status is "ok" or "fail".
+	Status string `json:"status"`
+
+	// Error is what went wrong, which is only shown if health details
+	// are turned on.
+	Error string `json:"error,omitempty"`
+}
+
+// Health Check Result turns an error into a check that passed if it is
+// nil and failed if it isn't.
+func HealthCheckResult(err error) HealthCheck {
+	if err == nil {
+		return HealthCheck{Status: "ok"}
+	}
+
+	check := HealthCheck{Status: "fail"}
+	if *healthDetailsFlag {
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+// Check Servers tries to connect to the RCON port of every server at
+// the same time, and returns the error of each server that can't be
+// reached by its address.
+func CheckServers() map[string]error {
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	errs := map[string]error{}
+
+	for _, server := range servers.All() {
+		wait.Add(1)
+		go func(server *Server) {
+			defer wait.Done()
+
+			conn, err := net.DialTimeout("tcp", server.String(), healthServerTimeout)
+			if err == nil {
+				conn.Close()
+			}
+
+			lock.Lock()
+			errs[server.String()] = err
+			lock.Unlock()
+		}(server)
+	}
+
+	wait.Wait()
+	return errs
+}
+
+// Cached Server Health returns the result of CheckServers, checking
+// again only if the last result is older than a few seconds.
+func CachedServerHealth() map[string]error {
+	serverHealth.lock.Lock()
+	defer serverHealth.lock.Unlock()
+
+	if serverHealth.errs == nil || time.Since(serverHealth.checkedAt) > healthServerCacheFor {
+		serverHealth.errs = CheckServers()
+		serverHealth.checkedAt = time.Now()
+	}
+
+	return serverHealth.errs
+}
+
+// Write Health writes a health response as JSON, with 200 if the status
+// is "ok" and 503 if it isn't.
+func WriteHealth(w http.ResponseWriter, status string, body map[string]interface{}) {
+	body["status"] = status
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(body)
+}
+
+// Handles GET requests for "/healthz", which says that Sorbet is
+// running. It never touches the database, so a supervisor only restarts
+// Sorbet when the process itself is stuck.
+func HandleHealthz(w http.ResponseWriter, req *http.Request) {
+	body := map[string]interface{}{}
+	if *healthDetailsFlag {
+		body["started_at"] = startedAt
+		body["uptime"] = time.Since(startedAt).Round(time.Second).String()
+	}
+
+	WriteHealth(w, "ok", body)
+}
+
+// Handles GET requests for "/readyz", which says if Sorbet can serve
+// requests: the database has to answer and the templates have to be
+// loaded, and every server has to be reachable if ready servers is
+// turned on, which is checked at most every few seconds. Sorbet also
+// stops being ready as soon as it starts to shut down, so load
+// balancers stop sending it requests.
+func HandleReadyz(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]interface{}{}
+	status := "ok"
+
+	add := func(name string, err error) {
+		if err != nil {
+			status = "fail"
+		}
+
+		checks[name] = HealthCheckResult(err)
+	}
+
+	// A database that hangs makes Sorbet not ready instead of making
+	// the probe time out
+	ctx, cancel := context.WithTimeout(req.Context(), healthDatabaseTimeout)
+	add("database", db.DB().PingContext(ctx))
+	cancel()
+
+	if templates == nil || templates.Lookup("index") == nil {
+		add("templates", errTemplatesNotLoaded)
+	} else {
+		add("templates", nil)
+	}
+
+	if shutdown.Err() != nil {
+		add("shutdown", errShuttingDown)
+	}
+
+	// Servers are only listed by address if details are shown, since
+	// they would tell anyone where the Minecraft servers are
+	if *readyServersFlag {
+		reachable := 0
+		details := map[string]HealthCheck{}
+		for address, err := range CachedServerHealth() {
+			if err == nil {
+				reachable++
+			}
+
+			details[address] = HealthCheckResult(err)
+		}
+
+		check := map[string]interface{}{
+			"status":    "ok",
+			"reachable": reachable,
+			"total":     len(details),
+		}
+
+		if reachable < len(details) {
+			status = "fail"
+			check["status"] = "fail"
+		}
+
+		if *healthDetailsFlag {
+			check["servers"] = details
+		}
+
+		checks["servers"] = check
+	}
+
+	WriteHealth(w, status, map[string]interface{}{"checks": checks})
+}
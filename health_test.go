@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyzChecksServersAtMostEveryFewSeconds(t *testing.T) {
+	defer func(ready bool) { *readyServersFlag = ready }(*readyServersFlag)
+	*readyServersFlag = true
+
+	// A server that only counts how often it is connected to
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&connections, 1)
+			conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	number, _ := strconv.Atoi(port)
+	server := &Server{Id: 999999, Host: host, Port: number}
+	servers.Add(server)
+	defer servers.Remove(server.Id)
+
+	serverHealth.lock.Lock()
+	serverHealth.errs = nil
+	serverHealth.lock.Unlock()
+
+	readyz := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		HandleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		var body map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&body)
+		return body["checks"].(map[string]interface{})["servers"].(map[string]interface{})
+	}
+
+	for i := 0; i < 5; i++ {
+		if check := readyz(); check["reachable"] != float64(1) {
+			t.Fatalf("the servers check is %v, want the server to be reachable", check)
+		}
+	}
+
+	// Give the server a moment to count the connection
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("the server was connected to %d times, want 1", n)
+	}
+
+	// Once the result is old the servers are checked again
+	serverHealth.lock.Lock()
+	serverHealth.checkedAt = time.Now().Add(-2 * healthServerCacheFor)
+	serverHealth.lock.Unlock()
+
+	readyz()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Errorf("the server was connected to %d times after the result was old, want 2", n)
+	}
+}
+
+func TestHealthChecksAreNotGivenACSRFCookie(t *testing.T) {
+	handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+			t.Errorf("%s set the cookie %q", path, cookie)
+		}
+	}
+
+	// Every other page still gets one
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("/login should set a CSRF cookie")
+	}
+
+	// And health checks can't be used to skip the token
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/readyz", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("a POST to /readyz without a token answered %d, want 403", w.Code)
+	}
+}
+
+func TestReadyzStopsWaitingForTheDatabase(t *testing.T) {
+	// A request that has given up can't wait for the database, which
+	// is the same as the database not answering in time
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	HandleReadyz(w, httptest.NewRequest("GET", "/readyz", nil).WithContext(ctx))
+
+	var body struct {
+		Checks map[string]HealthCheck `json:"checks"`
+	}
+
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusServiceUnavailable || body.Checks["database"].Status != "fail" {
+		t.Errorf("readyz answered %d with the database check %+v, want it to fail", w.Code, body.Checks["database"])
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net/http"
+	"net/url"
+)
+
+// LDAPAuthenticator checks passwords by binding to an LDAP directory as
+// the user. Users are created in Sorbet the first time they log in, and
+// their global roles follow the groups that they are in.
+type LDAPAuthenticator struct {
+	// Url is the address of the directory, like "ldap://host:389"
+	// or "ldaps://host:636".
+	Url string
+
+	// StartTLS is a bool that specifies if the connection should be
+	// upgraded to TLS before anything is sent.
+	StartTLS bool
+
+	// BindDn and BindPassword are used to search for users. If
+	// BindDn is blank then the search is done anonymously.
+	BindDn       string
+	BindPassword string
+
+	// BaseDn is where users are searched for.
+	BaseDn string
+
+	// UserFilter is the filter that finds a user, with %s where the
+	// escaped username goes.
+	UserFilter string
+
+	// UsernameAttribute is the attribute that the Sorbet username is
+	// taken from, so that users get the same name no matter how they
+	// typed it.
+	UsernameAttribute string
+
+	// GroupAttribute is the attribute of a user that lists the groups
+	// that they are in.
+	GroupAttribute string
+
+	// Groups maps lowercase group names to the roles that members of
+	// the group are granted.
+	Groups map[string][]string
+}
+
+// New LDAP Authenticator creates an LDAPAuthenticator from the ldap
+// flags.
+func NewLDAPAuthenticator() *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		Url:               *ldapUrlFlag,
+		StartTLS:          *ldapStartTLSFlag,
+		BindDn:            *ldapBindDnFlag,
+		BindPassword:      *ldapBindPasswordFlag,
+		BaseDn:            *ldapBaseDnFlag,
+		UserFilter:        *ldapUserFilterFlag,
+		UsernameAttribute: *ldapUsernameAttributeFlag,
+		GroupAttribute:    *ldapGroupAttributeFlag,
+		Groups:            ParseRoleMapping(*ldapGroupsFlag),
+	}
+}
+
+// Name returns "ldap".
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate searches the directory for the user and then binds as
+// them with the password. If the bind works then the user is created in
+// Sorbet if they need to be and their roles are updated.
+func (a *LDAPAuthenticator) Authenticate(req *http.Request, username string, password string) (*User, error) {
+	// Most directories treat a bind without a password as anonymous
+	// and let it through, so never try one.
+	if username == "" || password == "" {
+		return nil, nil
+	}
+
+	conn, err := a.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Find the user
+	search := ldap.NewSearchRequest(
+		a.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		10,
+		false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.UsernameAttribute, a.GroupAttribute},
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	} else if len(result.Entries) != 1 {
+		return nil, nil
+	}
+
+	entry := result.Entries[0]
+
+	// Check the password
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	name := entry.GetAttributeValue(a.UsernameAttribute)
+	if name == "" {
+		name = username
+	}
+
+	user, err := ProvisionUser(req, a.Name(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	SyncRoles(req, user, a.Groups, entry.GetAttributeValues(a.GroupAttribute))
+	return user, nil
+}
+
+// Dial connects to the directory, upgrades the connection to TLS if it
+// should be and binds as the search user.
+func (a *LDAPAuthenticator) Dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.StartTLS {
+		u, err := url.Parse(a.Url)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if a.BindDn != "" {
+		err = conn.Bind(a.BindDn, a.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// TestLDAPEntry is a user in the test directory.
+type TestLDAPEntry struct {
+	Dn       string
+	Uid      string
+	Password string
+	Groups   []string
+}
+
+// Start Test LDAP starts a directory that only knows how to bind and to
+// search for users by uid, which is all that Sorbet asks of it. The
+// search user is "cn=sorbet,dc=test" with the password "search".
+func StartTestLDAP(t *testing.T, entries ...*TestLDAPEntry) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go ServeTestLDAP(conn, entries)
+		}
+	}()
+
+	return "ldap://" + listener.Addr().String()
+}
+
+// Serve Test LDAP answers the requests on one LDAP connection.
+func ServeTestLDAP(conn net.Conn, entries []*TestLDAPEntry) {
+	defer conn.Close()
+
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+
+		id := request.Children[0].Value.(int64)
+		op := request.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if dn == "cn=sorbet,dc=test" && password == "search" {
+				code = ldap.LDAPResultSuccess
+			}
+
+			for _, entry := range entries {
+				if dn == entry.Dn && password == entry.Password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+
+			WriteTestLDAP(conn, id, LDAPTestResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, entry := range entries {
+				if filter == fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(entry.Uid)) {
+					WriteTestLDAP(conn, id, entry.Packet())
+				}
+			}
+
+			WriteTestLDAP(conn, id, LDAPTestResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+// Write Test LDAP wraps an answer in a message with the id of the
+// request and sends it.
+func WriteTestLDAP(conn net.Conn, id int64, op *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+// LDAP Test Result returns an answer with a result code and nothing
+// else.
+func LDAPTestResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+// Packet returns the entry as a search result with its uid and groups.
+func (e *TestLDAPEntry) Packet() *ber.Packet {
+	attribute := func(name string, values ...string) *ber.Packet {
+		packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+
+		packet.AppendChild(set)
+		return packet
+	}
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	attributes.AppendChild(attribute("uid", e.Uid))
+	attributes.AppendChild(attribute("memberOf", e.Groups...))
+
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.Dn, ""))
+	entry.AppendChild(attributes)
+	return entry
+}
+
+// New Test LDAP Authenticator returns an authenticator for a test
+// directory that grants "operator" to the ops group and "viewer" to the
+// staff group.
+func NewTestLDAPAuthenticator(url string) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		Url:               url,
+		BindDn:            "cn=sorbet,dc=test",
+		BindPassword:      "search",
+		BaseDn:            "dc=test",
+		UserFilter:        "(uid=%s)",
+		UsernameAttribute: "uid",
+		GroupAttribute:    "memberOf",
+		Groups:            ParseRoleMapping("cn=ops,dc=test=operator;CN=Staff,dc=test=viewer"),
+	}
+}
+
+// Role Names returns the names of the global roles that a user has.
+func RoleNames(u *User) []string {
+	names := []string{}
+	for _, role := range u.Roles(0) {
+		names = append(names, role.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestLDAPAuthenticateChecksThePassword(t *testing.T) {
+	entry := &TestLDAPEntry{Dn: "uid=ldap-steve,dc=test", Uid: "ldap-steve", Password: "directory-password"}
+	authenticator := NewTestLDAPAuthenticator(StartTestLDAP(t, entry))
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	user, err := authenticator.Authenticate(req, "ldap-steve", "wrong-password")
+	if user != nil || err != nil {
+		t.Errorf("a wrong password returned %v, %v, want nil, nil", user, err)
+	}
+
+	user, err = authenticator.Authenticate(req, "nobody", "directory-password")
+	if user != nil || err != nil {
+		t.Errorf("a user that isn't in the directory returned %v, %v, want nil, nil", user, err)
+	}
+
+	user, err = authenticator.Authenticate(req, "ldap-steve", "")
+	if user != nil || err != nil {
+		t.Errorf("a blank password returned %v, %v, want nil, nil", user, err)
+	}
+
+	user, err = authenticator.Authenticate(req, "ldap-steve", "directory-password")
+	if err != nil || user == nil {
+		t.Fatalf("the right password returned %v, %v", user, err)
+	}
+
+	if user.Username != "ldap-steve" || user.Source != "ldap" || user.Password != "" {
+		t.Errorf("the user was created as %q from %q with a password %q", user.Username, user.Source, user.Password)
+	}
+
+	if added := FindUserByUsername("ldap-steve"); added == nil || added.Id != user.Id {
+		t.Error("the user should be added to the users")
+	}
+
+	// The search user has to be able to bind too
+	authenticator.BindPassword = "wrong"
+	if _, err := authenticator.Authenticate(req, "ldap-steve", "directory-password"); err == nil {
+		t.Error("a search user that can't bind should be an error")
+	}
+}
+
+func TestLDAPAuthenticateMapsGroupsToRoles(t *testing.T) {
+	entry := &TestLDAPEntry{
+		Dn:       "uid=ldap-alex,dc=test",
+		Uid:      "ldap-alex",
+		Password: "directory-password",
+		Groups:   []string{"cn=OPS,dc=test", "cn=staff,dc=test", "cn=other,dc=test"},
+	}
+
+	authenticator := NewTestLDAPAuthenticator(StartTestLDAP(t, entry))
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	user, err := authenticator.Authenticate(req, "ldap-alex", "directory-password")
+	if err != nil || user == nil {
+		t.Fatalf("logging in returned %v, %v", user, err)
+	}
+
+	// Roles that aren't in the mapping are left alone
+	GrantTestRole(t, user, "moderator", 0)
+
+	if got := fmt.Sprint(RoleNames(user)); got != "[moderator operator viewer]" {
+		t.Errorf("the user has the roles %s, want [moderator operator viewer]", got)
+	}
+
+	// Leaving a group takes its role away the next time they log in
+	entry = &TestLDAPEntry{Dn: entry.Dn, Uid: entry.Uid, Password: entry.Password, Groups: []string{"cn=staff,dc=test"}}
+	authenticator = NewTestLDAPAuthenticator(StartTestLDAP(t, entry))
+	if _, err := authenticator.Authenticate(req, "ldap-alex", "directory-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(RoleNames(user)); got != "[moderator viewer]" {
+		t.Errorf("the user has the roles %s, want [moderator viewer]", got)
+	}
+}
+
+func TestLDAPAuthenticateDoesNotTakeOverLocalUsers(t *testing.T) {
+	local := NewTestUser(t, "ldap-local", true)
+	entry := &TestLDAPEntry{Dn: "uid=ldap-local,dc=test", Uid: "ldap-local", Password: "directory-password", Groups: []string{"cn=ops,dc=test"}}
+	authenticator := NewTestLDAPAuthenticator(StartTestLDAP(t, entry))
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	user, err := authenticator.Authenticate(req, "ldap-local", "directory-password")
+	if user != nil || err == nil {
+		t.Errorf("logging in as a local user returned %v, %v, want an error", user, err)
+	}
+
+	if !local.IsLocal() || len(local.Roles(0)) != 0 {
+		t.Error("the local user should not be changed")
+	}
+
+	if _, err := ProvisionUser(req, "oidc", "ldap-local"); err == nil {
+		t.Error("other sources should not take over a local user either")
+	}
+
+	if user, err := ProvisionUser(req, "local", "ldap-local"); err != nil || user == nil || user.Id != local.Id {
+		t.Errorf("provisioning a local user as local returned %v, %v", user, err)
+	}
+}
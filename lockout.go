@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest that a failed login will ever be delayed for.
+const maxLoginDelay = 8 * time.Second
+
+// LoginFailure keeps track of failed logins for either an address or
+// an account so that they can be slowed down and locked out.
+type LoginFailure struct {
+	// Id is a uint64 that is the failure's identification number.
+	Id uint64
+
+	// Subject is the key that the failures are counted for, which
+	// is either "ip:" followed by an address or "user:" followed by
+	// a lowercase username.
+	Subject string `sql:"size:255;unique"`
+
+	// Failures is the number of failed logins in a row.
+	Failures int
+
+	// LastFailureAt is a timestamp of the last failed login.
+	LastFailureAt time.Time
+
+	// LockedUntil is a timestamp of when the lockout ends. If it is
+	// in the past then the key is not locked.
+	LockedUntil time.Time
+
+	// CreatedAt is a timestamp of when the specific
+	// failure was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// failure was last updated at.
+	UpdatedAt time.Time
+}
+
+// Login Keys returns the keys that failed logins are counted for in a
+// request, which is the address that the request came from and the
+// username that is trying to log in.
+func LoginKeys(req *http.Request, username string) []string {
+	return []string{"ip:" + RemoteIp(req), UserLoginKey(username)}
+}
+
+// User Login Key returns the key that failed logins are counted for
+// for a username.
+func UserLoginKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// Login Threshold returns how many failed logins in a row are allowed
+// for a key before it is locked. Addresses are allowed more failures
+// than accounts because many people can share an address.
+func LoginThreshold(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return *lockoutIpThresholdFlag
+	}
+
+	return *lockoutThresholdFlag
+}
+
+// Login Failures returns the failures for every key, skipping failures
+// that are so old that they don't count anymore.
+func LoginFailures(keys []string) []LoginFailure {
+	var failures []LoginFailure
+	db.Where("subject IN (?)", keys).Find(&failures)
+
+	list := []LoginFailure{}
+	for _, f := range failures {
+		if time.Since(f.LastFailureAt) < *lockoutDurationFlag || time.Now().Before(f.LockedUntil) {
+			list = append(list, f)
+		}
+	}
+
+	return list
+}
+
+// Login Locked checks if any of the keys are locked.
+func LoginLocked(keys []string) bool {
+	for _, f := range LoginFailures(keys) {
+		if time.Now().Before(f.LockedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Login Delay returns how long a failed login should be delayed for,
+// given how many failures in a row there have been including this one.
+// The delay doubles with each failure after the first, up to
+// maxLoginDelay.
+func LoginDelay(failures int) time.Duration {
+	if failures <= 1 {
+		return 0
+	}
+
+	delay := 250 * time.Millisecond
+	for i := 2; i < failures && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+
+	return delay
+}
+
+// Record Login Failure counts a failed login for every key, locking any
+// key that has reached its threshold, and returns how long the failed
+// login should be delayed for. The user is the account that was being
+// logged in to, if it exists, and is used for the audit log.
+//
+// Failures are counted by the database itself, so logins that fail at
+// the same time are all counted, and the delay and threshold are
+// checked against the count that was saved. The delay only starts once
+// the failure has been counted.
+func RecordLoginFailure(req *http.Request, user *User, keys []string) time.Duration {
+	most := 0
+	for _, key := range keys {
+		failure, err := CountLoginFailure(key)
+		if err != nil {
+			Warnf("Error counting failed login for %s: %s", key, err)
+			continue
+		}
+
+		if failure.Failures > most {
+			most = failure.Failures
+		}
+
+		if failure.Failures >= LoginThreshold(key) {
+			// Only lock the key if it isn't locked already, so that
+			// each lockout is only recorded once
+			now := time.Now()
+			until := now.Add(*lockoutDurationFlag)
+			locked := db.Model(&LoginFailure{}).Where("subject = ? AND locked_until < ?", key, now).UpdateColumn("locked_until", until)
+			if locked.Error == nil && locked.RowsAffected == 1 {
+				Warnf("Locked %s after %d failed logins", key, failure.Failures)
+				AuditAs(req, user, "login.lockout", key, map[string]string{
+					"failures": strconv.Itoa(failure.Failures),
+					"until":    until.UTC().Format(time.RFC3339),
+				}, "locked")
+			}
+		}
+	}
+
+	return LoginDelay(most)
+}
+
+// Count Login Failure adds one to the failures of a key in a single
+// update, creating the key if it doesn't exist yet, and returns the
+// failures as they were saved. Counting starts again if the last
+// failure was long enough ago and the key isn't locked.
+func CountLoginFailure(key string) (LoginFailure, error) {
+	var failure LoginFailure
+	for tries := 0; tries < 2; tries++ {
+		now := time.Now()
+		update := db.Exec("UPDATE login_failures SET failures = CASE WHEN last_failure_at < ? AND locked_until < ? THEN 1 ELSE failures + 1 END, last_failure_at = ?, updated_at = ? WHERE subject = ?",
+			now.Add(-*lockoutDurationFlag), now, now, now, key)
+		if update.Error != nil {
+			return failure, update.Error
+		}
+
+		if update.RowsAffected == 0 {
+			// Nobody has failed to log in as this key yet. If another
+			// login creates it first then the unique subject makes
+			// this fail, and it is updated instead.
+			failure = LoginFailure{Subject: key, Failures: 1, LastFailureAt: now}
+			if db.Create(&failure).Error != nil {
+				continue
+			}
+		}
+
+		err := db.Where("subject = ?", key).First(&failure).Error
+		return failure, err
+	}
+
+	return failure, errors.New("the failure could not be created or updated")
+}
+
+// Clear Login Failures forgets every failed login for a key, which is
+// done when a user logs in successfully or is unlocked.
+func ClearLoginFailures(key string) {
+	db.Where("subject = ?", key).Delete(&LoginFailure{})
+}
+
+// Locked checks if the user's account is currently locked because of
+// failed logins.
+func (u *User) Locked() bool {
+	return LoginLocked([]string{UserLoginKey(u.Username)})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordLoginFailureCountsFailuresAtTheSameTime(t *testing.T) {
+	key := UserLoginKey("lockout-parallel")
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			RecordLoginFailure(req, nil, []string{key})
+		}()
+	}
+
+	wait.Wait()
+
+	var failure LoginFailure
+	if db.Where("subject = ?", key).First(&failure).RecordNotFound() {
+		t.Fatal("the failures were not saved")
+	}
+
+	if failure.Failures != 20 {
+		t.Errorf("counted %d failures, want 20", failure.Failures)
+	}
+
+	if !LoginLocked([]string{key}) {
+		t.Error("the key should be locked after more failures than the threshold")
+	}
+
+	var lockouts int
+	db.Model(&AuditEntry{}).Where("action = ? AND target = ?", "login.lockout", key).Count(&lockouts)
+	if lockouts != 1 {
+		t.Errorf("the lockout was recorded %d times, want 1", lockouts)
+	}
+}
+
+func TestRecordLoginFailureLocksAtTheThreshold(t *testing.T) {
+	key := UserLoginKey("lockout-threshold")
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	for i := 1; i < *lockoutThresholdFlag; i++ {
+		if delay := RecordLoginFailure(req, nil, []string{key}); delay != LoginDelay(i) {
+			t.Errorf("failure %d was delayed for %s, want %s", i, delay, LoginDelay(i))
+		}
+	}
+
+	if LoginLocked([]string{key}) {
+		t.Fatal("the key should not be locked before the threshold")
+	}
+
+	RecordLoginFailure(req, nil, []string{key})
+	if !LoginLocked([]string{key}) {
+		t.Error("the key should be locked at the threshold")
+	}
+}
+
+func TestRecordLoginFailureStartsCountingAgain(t *testing.T) {
+	key := UserLoginKey("lockout-again")
+	req := httptest.NewRequest("POST", "/login", nil)
+
+	RecordLoginFailure(req, nil, []string{key})
+	RecordLoginFailure(req, nil, []string{key})
+	db.Model(&LoginFailure{}).Where("subject = ?", key).UpdateColumn("last_failure_at", time.Now().Add(-2**lockoutDurationFlag))
+
+	failure, err := CountLoginFailure(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failure.Failures != 1 {
+		t.Errorf("counted %d failures after the last one expired, want 1", failure.Failures)
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:  0,
+		1:  0,
+		2:  250 * time.Millisecond,
+		3:  500 * time.Millisecond,
+		4:  time.Second,
+		20: maxLoginDelay,
+	}
+
+	for failures, want := range tests {
+		if got := LoginDelay(failures); got != want {
+			t.Errorf("LoginDelay(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestRemoteIpOnlyTrustsForwardedForFromTrustedProxies(t *testing.T) {
+	defer func(proxies string) { *trustedProxiesFlag = proxies }(*trustedProxiesFlag)
+	*trustedProxiesFlag = "10.0.0.1,192.168.0.0/16"
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.2, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"192.168.4.4:1234", "not an address, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, not an address", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if got := RemoteIp(req); got != test.want {
+			t.Errorf("RemoteIp(%s, %q) = %s, want %s", test.remote, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1"); err != nil {
+		t.Error(err)
+	}
+
+	for _, list := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) should fail", list)
+		}
+	}
+}
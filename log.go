@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// Logger that everything Sorbet has to say is written to.
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// Infof logs something that happened.
+func Infof(format string, v ...interface{}) {
+	logger.Printf("[info] "+format, v...)
+}
+
+// Verb logs something that is only interesting when debugging.
+func Verb(message string) {
+	logger.Print("[verb] " + message)
+}
+
+// Warn logs something that went wrong.
+func Warn(message string) {
+	logger.Print("[warn] " + message)
+}
+
+// Warnf logs something that went wrong.
+func Warnf(format string, v ...interface{}) {
+	logger.Printf("[warn] "+format, v...)
+}
@@ -3,29 +3,68 @@ package main
 import (
 	"flag"
 	"github.com/gorilla/mux"
-	"github.com/lukevers/golem"
 	"html/template"
-	"net/http"
-	"strconv"
+	"os"
+	"time"
 )
 
 var (
-	err     error
-	users   []*User
-	servers []*Server
+	users   = &UserRepository{}
+	servers = &ServerRepository{}
+	roles   = &RoleRepository{}
 )
 
-var templates = template.Must(template.New("").Funcs(AddTemplateFunctions(nil)).ParseGlob("app/views/*"))
+var templates *template.Template
+
+// Static files and the hashes of their contents
+var assets = &StaticFiles{}
 
 func main() {
-	// Parse flags
+	// Parse flags, then fill in everything that wasn't given as a flag
+	// from the environment and the config file
 	flag.Parse()
+	initalizeConfig()
+
+	// Run a command, like "sorbet migrate status", if one was given
+	if flag.NArg() > 0 {
+		os.Exit(RunCommand(flag.Args()))
+	}
+
+	// Load templates and static files
+	templates = RefreshTemplates(nil)
+	initalizeAssets()
 
-	// Initalize database
+	// Load common passwords
+	initalizePasswordPolicy()
+
+	// Load the master keys that server passwords are encrypted with
+	initalizeSecrets()
+
+	// Initalize database, bring the schema up to date and create the
+	// default roles and server
 	initalizeDB()
+	initalizeSchema()
+	initalizeDefaults()
+
+	// Load session keys
+	initalizeSessions()
 
-	// Remove old sessions
+	// Set up security keys
+	initalizeWebAuthn()
+
+	// Set up single sign-on
+	initalizeOIDC()
+
+	// Set up how links are delivered
+	initalizeNotifier()
+
+	// Remove expired sessions and tokens now and every hour from now on
 	CleanSessions()
+	CleanTokens()
+	StartWorker(time.Hour, func() {
+		CleanSessions()
+		CleanTokens()
+	})
 
 	// Create web server
 	r := mux.NewRouter()
@@ -33,6 +72,20 @@ func main() {
 	// Handles GET requests for "/" which is our root page.
 	r.HandleFunc("/", HandleRoot)
 
+	// Handles GET requests to "/setup" which displays a form that is
+	// used to create the first administrator.
+	r.HandleFunc("/setup", HandleSetup).Methods("GET")
+
+	// Handles POST requests to "/setup" which creates the first
+	// administrator.
+	r.HandleFunc("/setup", HandleSetupForm).Methods("POST")
+
+	// Handles GET requests for "/healthz" and "/readyz", which load
+	// balancers and supervisors use to check on Sorbet without logging
+	// in.
+	r.HandleFunc("/healthz", HandleHealthz).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", HandleReadyz).Methods("GET", "HEAD")
+
 	// Handles GET requests to "/login" which displays a form that a user
 	// can use to try and login.
 	r.HandleFunc("/login", HandleLogin).Methods("GET")
@@ -49,6 +102,46 @@ func main() {
 	// token is correct or not.
 	r.HandleFunc("/login/2fa", HandleLoginForm2FA).Methods("POST")
 
+	// Handles POST requests to "/login/webauthn/begin" which starts
+	// logging in with a security key instead of a 2fa token.
+	r.HandleFunc("/login/webauthn/begin", HandleBeginSecurityKeyLogin).Methods("POST")
+
+	// Handles POST requests to "/login/webauthn/finish" which tests if
+	// a security key signed the login correctly.
+	r.HandleFunc("/login/webauthn/finish", HandleFinishSecurityKeyLogin).Methods("POST")
+
+	// Handles GET requests to "/login/oidc" which sends the user to the
+	// identity provider to log in.
+	r.HandleFunc("/login/oidc", HandleOIDCLogin).Methods("GET")
+
+	// Handles GET requests to "/login/oidc/callback" which is where the
+	// identity provider sends the user back to.
+	r.HandleFunc("/login/oidc/callback", HandleOIDCCallback).Methods("GET")
+
+	// Handles GET requests to "/login/forgot" which displays a form that
+	// users can ask for a password reset link with.
+	r.HandleFunc("/login/forgot", HandleForgot).Methods("GET")
+
+	// Handles POST requests to "/login/forgot" which sends a password
+	// reset link to the user.
+	r.HandleFunc("/login/forgot", HandleForgotForm).Methods("POST")
+
+	// Handles GET requests to "/invite/{token}" which displays a form
+	// that somebody who was invited chooses their password with.
+	r.HandleFunc("/invite/{token}", HandleInvite).Methods("GET")
+
+	// Handles POST requests to "/invite/{token}" which creates the user
+	// that was invited.
+	r.HandleFunc("/invite/{token}", HandleInviteForm).Methods("POST")
+
+	// Handles GET requests to "/reset/{token}" which displays a form
+	// that a user chooses a new password with.
+	r.HandleFunc("/reset/{token}", HandleReset).Methods("GET")
+
+	// Handles POST requests to "/reset/{token}" which changes the users
+	// password.
+	r.HandleFunc("/reset/{token}", HandleResetForm).Methods("POST")
+
 	// Handle logout requests which removes the session and logs the user out
 	r.HandleFunc("/logout", HandleLogout)
 
@@ -60,6 +153,22 @@ func main() {
 	// can update their settings. POSTing here will update settings.
 	r.HandleFunc("/settings", HandleUpdateSettings).Methods("POST")
 
+	// Handles GET requests for "/settings/password" which is a page that
+	// users have to choose a new password on when they have to.
+	r.HandleFunc("/settings/password", HandleChangePassword).Methods("GET")
+
+	// Handles POST requests for "/settings/password" which changes the
+	// users password.
+	r.HandleFunc("/settings/password", HandleChangePasswordForm).Methods("POST")
+
+	// Handles GET requests for "/settings/sessions" which is a page
+	// where users can see every session they are logged in with.
+	r.HandleFunc("/settings/sessions", HandleSessions).Methods("GET")
+
+	// Handles POST requests for "/settings/sessions/revoke" which logs
+	// out one or all of the users other sessions.
+	r.HandleFunc("/settings/sessions/revoke", HandleRevokeSession).Methods("POST")
+
 	// Handles GET requests for "/settings/2fa/generate" which is a page
 	// that generates a QR code for Two Factor Auth.
 	r.HandleFunc("/settings/2fa/generate", HandleGenerate2FA).Methods("GET")
@@ -73,37 +182,157 @@ func main() {
 	// 2FA for the users account.
 	r.HandleFunc("/settings/2fa/disable", HandleDisable2FA).Methods("POST")
 
-	// Handles GET requests for "/users" which is an admin-only page
-	r.HandleFunc("/users", HandleUsers).Methods("GET")
+	// Handles POST requests for "/settings/webauthn/register/begin"
+	// which starts adding a security key to the users account.
+	r.HandleFunc("/settings/webauthn/register/begin", HandleBeginSecurityKey).Methods("POST")
+
+	// Handles POST requests for "/settings/webauthn/register/finish"
+	// which saves a security key once the browser has created it.
+	r.HandleFunc("/settings/webauthn/register/finish", HandleFinishSecurityKey).Methods("POST")
+
+	// Handles POST requests for "/settings/webauthn/delete" which
+	// removes a security key from the users account.
+	r.HandleFunc("/settings/webauthn/delete", HandleDeleteSecurityKey).Methods("POST")
+
+	// Handles POST requests for "/settings/2fa/recovery" which
+	// gives the user a new set of 2FA recovery codes.
+	r.HandleFunc("/settings/2fa/recovery", HandleRecoveryCodes).Methods("POST")
+
+	// Handles GET requests for "/users" which is a page for users
+	// that can manage other users.
+	r.HandleFunc("/users", RequirePermission(PermManageUsers, HandleUsers)).Methods("GET")
 
 	// Handles POST requests for "/users/new" which is a form where
 	// new users can be added.
-	r.HandleFunc("/users/new", HandleNewUser).Methods("POST")
+	r.HandleFunc("/users/new", RequirePermission(PermManageUsers, HandleNewUser)).Methods("POST")
+
+	// Handles GET requests for "/users/{id}" which is a page where a
+	// single user can be edited.
+	r.HandleFunc("/users/{id:[0-9]+}", RequirePermission(PermManageUsers, HandleUser)).Methods("GET")
+
+	// Handles POST requests for "/users/{id}" which renames, disables
+	// or enables a user.
+	r.HandleFunc("/users/{id:[0-9]+}", RequirePermission(PermManageUsers, HandleUpdateUser)).Methods("POST")
+
+	// Handles POST requests for "/users/{id}/password" which gives a
+	// user a temporary password.
+	r.HandleFunc("/users/{id:[0-9]+}/password", RequirePermission(PermManageUsers, HandleUserPassword)).Methods("POST")
+
+	// Handles POST requests for "/users/invite" which creates a link
+	// that lets somebody choose the password for a new user.
+	r.HandleFunc("/users/invite", RequirePermission(PermManageUsers, HandleInviteUser)).Methods("POST")
+
+	// Handles POST requests for "/users/reset" which creates a link
+	// that lets a user choose a new password.
+	r.HandleFunc("/users/reset", RequirePermission(PermManageUsers, HandleResetUser)).Methods("POST")
 
 	// Handles POST requests for "/users/delete" which is how users
 	// can be deleted.
-	r.HandleFunc("/users/delete", HandleUserDelete).Methods("POST")
+	r.HandleFunc("/users/delete", RequirePermission(PermManageUsers, HandleUserDelete)).Methods("POST")
 
 	// Handles POST requests for "/users/admin" which is a form where
 	// administrators can promote/demote users.
-	r.HandleFunc("/users/admin", HandleUserAdminSwitch).Methods("POST")
+	r.HandleFunc("/users/admin", RequirePermission(PermManageUsers, HandleUserAdminSwitch)).Methods("POST")
+
+	// Handles POST requests for "/users/unlock" which is how users
+	// that have been locked out by failed logins can be unlocked.
+	r.HandleFunc("/users/unlock", RequirePermission(PermManageUsers, HandleUserUnlock)).Methods("POST")
+
+	// Handles POST requests for "/users/2fa/reset" which is how 2FA
+	// can be turned off for a user that can't log in anymore.
+	r.HandleFunc("/users/2fa/reset", RequirePermission(PermManageUsers, HandleUserReset2FA)).Methods("POST")
+
+	// Handles POST requests for "/users/roles/grant" which is a form
+	// where a role can be granted to a user globally or on a server.
+	r.HandleFunc("/users/roles/grant", RequirePermission(PermManageUsers, HandleUserGrantRole)).Methods("POST")
+
+	// Handles POST requests for "/users/roles/revoke" which is how a
+	// role that has been granted to a user can be taken away.
+	r.HandleFunc("/users/roles/revoke", RequirePermission(PermManageUsers, HandleUserRevokeRole)).Methods("POST")
+
+	// Handles GET requests for "/servers/{server}" which is the
+	// console for a server.
+	r.HandleFunc("/servers/{server:[0-9]+}", RequirePermission(PermViewConsole, HandleServer)).Methods("GET")
+
+	// Handles POST requests for "/servers/{server}/command" which
+	// sends a command to a server if the command policies for the
+	// user allow it.
+	r.HandleFunc("/servers/{server:[0-9]+}/command", RequirePermission(PermRunCommands, HandleServerCommand)).Methods("POST")
 
-	// Handle all other static files and folders (eg. CSS/JS).
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public")))
+	// Handles GET requests for "/policies" which is a page where
+	// command policies for roles can be managed.
+	r.HandleFunc("/policies", RequirePermission(PermManageUsers, HandlePolicies)).Methods("GET")
+
+	// Handles POST requests for "/policies/new" which is a form where
+	// new command policies can be added.
+	r.HandleFunc("/policies/new", RequirePermission(PermManageUsers, HandleNewPolicy)).Methods("POST")
+
+	// Handles POST requests for "/policies/delete" which is how
+	// command policies can be deleted.
+	r.HandleFunc("/policies/delete", RequirePermission(PermManageUsers, HandlePolicyDelete)).Methods("POST")
+
+	// Handles GET requests for "/audit" which is a page that lists
+	// every administrative action that has been performed.
+	r.HandleFunc("/audit", RequirePermission(PermManageUsers, HandleAudit)).Methods("GET")
+
+	// Handles GET requests for "/audit/export" which downloads the
+	// audit log as CSV or JSON.
+	r.HandleFunc("/audit/export", RequirePermission(PermManageUsers, HandleAuditExport)).Methods("GET")
+
+	// Handle all other static files (eg. CSS/JS).
+	r.PathPrefix("/").Handler(assets)
 
 	// Get all users
-	db.Find(&users, &User{})
+	users.Load()
 
-	// Get first server
-	db.Find(&servers, &Server{})
+	// Give every user that doesn't have a security stamp yet one,
+	// since sessions can't be used without one. Anyone that is still
+	// using the old default of admin/admin has to change it.
+	for _, user := range users.All() {
+		if user.SecurityStamp == "" {
+			user = users.Update(user.Id, func(v *User) {
+				v.SecurityStamp = NewSecurityStamp()
+			})
+			db.Save(user)
+		}
 
-	// Initialize servers
-	for i := range servers {
-		servers[i].initalizeRcon()
+		if user.Username == "admin" && !user.MustChangePassword && PasswordMatchesHash("admin", user.Password) {
+			Warnf("The user \"admin\" still has the default password and has to change it")
+			user = users.Update(user.Id, func(v *User) {
+				v.MustChangePassword = true
+			})
+			db.Save(user)
+		}
 	}
 
+	// Create the first administrator if there are no users yet
+	initalizeSetup()
+
+	// Get all roles
+	roles.Load()
+
+	// Set up the authenticators that users log in with, which needs
+	// the roles to map groups to.
+	initalizeAuthenticators()
+
+	// Get all servers and connect to them
+	servers.Load()
+
+	// Load users and servers again when asked to with SIGHUP
+	ReloadOnHangup()
+
+	// Shut down gracefully when asked to with SIGINT or SIGTERM from
+	// now on, until the webserver has stopped
+	stopSignals := StopOnSignal()
+
 	// Start web server
-	golem.Infof("Starting webserver on port %s", strconv.Itoa(*portFlag))
-	http.Handle("/", r)
-	http.ListenAndServe(*interfaceFlag+":"+strconv.Itoa(*portFlag), nil)
+	err := ListenAndServe(StrictTransportSecurity(CSRFProtect(RequirePasswordChange(r))))
+	stopSignals()
+	if err != nil {
+		Warnf("Error running webserver: %s", err)
+		Exit(1)
+	}
+
+	// Stopped because we were asked to
+	Exit(0)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain sets Sorbet up the same way main does, with a new SQLite
+// database and key files in a temporary folder, so that tests can use
+// the database and the global users, servers and roles.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sorbet-test")
+	if err != nil {
+		panic(err)
+	}
+
+	*driverFlag = "sqlite3"
+	*databaseFlag = filepath.Join(dir, "sorbet.db")
+	*keyFileFlag = filepath.Join(dir, "sorbet.key")
+	*masterKeyFileFlag = filepath.Join(dir, "sorbet.master.key")
+
+	templates = RefreshTemplates(nil)
+	initalizeAssets()
+	initalizePasswordPolicy()
+	initalizeSecrets()
+	initalizeDB()
+	initalizeSchema()
+	initalizeDefaults()
+	initalizeSessions()
+
+	roles.Load()
+	users.Load()
+
+	code := m.Run()
+
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// New Test User creates a user that can log in with the password
+// "Correct-Horse-Battery-9".
+func NewTestUser(t *testing.T, username string, admin bool) *User {
+	t.Helper()
+
+	user := &User{
+		Username:      username,
+		Password:      HashPassword("Correct-Horse-Battery-9"),
+		Admin:         admin,
+		SecurityStamp: NewSecurityStamp(),
+	}
+
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("creating user %s: %s", username, err)
+	}
+
+	users.Add(user)
+	return user
+}
+
+// Grant Test Role grants a role to a user on a server, or globally if
+// the server id is 0.
+func GrantTestRole(t *testing.T, user *User, name string, server uint64) {
+	t.Helper()
+
+	role := FindRoleByName(name)
+	if role == nil {
+		t.Fatalf("there is no role %s", name)
+	}
+
+	if err := db.Create(&RoleGrant{UserId: user.Id, RoleId: role.Id, ServerId: server}).Error; err != nil {
+		t.Fatalf("granting %s to %s: %s", name, user.Username, err)
+	}
+}
+
+// New Test Form returns a POST request with a form, which handlers can
+// be called with directly.
+func NewTestForm(path string, form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
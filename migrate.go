@@ -0,0 +1,517 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaMigration is a migration that has been applied to the database.
+type SchemaMigration struct {
+	// Id is a uint64 that is the row's identification number.
+	Id uint64
+
+	// Version is the version of the migration.
+	Version int `sql:"unique"`
+
+	// Name is what the migration does.
+	Name string `sql:"size:255"`
+
+	// AppliedAt is a timestamp of when the migration was applied.
+	AppliedAt time.Time
+}
+
+// Migration changes the database from the version before it to its own
+// version, and back again. Migrations only use gorm and the column types
+// in migrationTypes so that they work on SQLite, MySQL and PostgreSQL.
+type Migration struct {
+	// Version is the number of the migration, which is one more than
+	// the migration before it.
+	Version int
+
+	// Name is what the migration does.
+	Name string
+
+	// Up applies the migration.
+	Up func(tx *gorm.DB) error
+
+	// Down undoes the migration.
+	Down func(tx *gorm.DB) error
+}
+
+// Every migration in order. New migrations are only ever added to the
+// end, and a migration is never changed once it has been released.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range migrationTables {
+				if err := CreateMigrationTable(tx, table.Name, table.Columns); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range migrationTables {
+				if err := tx.DropTableIfExists(table.Name).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index user ids and audit times",
+		Up: func(tx *gorm.DB) error {
+			for _, index := range migrationIndexes {
+				if err := tx.Model(index.Model).AddIndex(index.Name, index.Column).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, index := range migrationIndexes {
+				if err := tx.Model(index.Model).RemoveIndex(index.Name).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "encrypt server passwords",
+		Up: func(tx *gorm.DB) error {
+			_, err := RewrapServerSecrets(tx)
+			return err
+		},
+		Down: DecryptServerSecrets,
+	},
+	{
+		Version: 4,
+		Name:    "add OIDC issuers and subjects",
+		Up: func(tx *gorm.DB) error {
+			err := AddMigrationColumns(tx, "users", []string{"issuer string", "subject string"})
+			if err != nil {
+				return err
+			}
+
+			return tx.Table("users").AddIndex("idx_users_issuer_subject", "issuer", "subject").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Table("users").RemoveIndex("idx_users_issuer_subject").Error
+			if err == nil {
+				err = tx.Table("users").DropColumn("issuer").Error
+			}
+
+			if err == nil {
+				err = tx.Table("users").DropColumn("subject").Error
+			}
+
+			return err
+		},
+	},
+}
+
+// Tables that the first migration creates. Each column is its name,
+// its type from migrationTypes and "unique" if no two rows can have the
+// same value. These are written out instead of taken from the structs
+// so that the migration never changes when a struct does; columns that
+// are added later need a migration of their own.
+var migrationTables = []struct {
+	Name    string
+	Columns []string
+}{
+	{"users", []string{
+		"id id", "username string unique", "email string", "password string",
+		"source string", "must_change_password bool", "admin bool", "twofa bool",
+		"twofa_secret string", "twofa_last_step bigint", "disabled bool",
+		"last_login_at time", "last_login_ip string", "security_stamp string",
+		"created_at time", "updated_at time",
+	}},
+	{"servers", []string{
+		"id id", "host string", "port int", "password text", "created_at time",
+		"updated_at time",
+	}},
+	{"roles", []string{
+		"id id", "name string unique", "permissions string", "created_at time",
+		"updated_at time",
+	}},
+	{"role_grants", []string{
+		"id id", "user_id ref", "role_id ref", "server_id ref", "created_at time",
+		"updated_at time",
+	}},
+	{"command_policies", []string{
+		"id id", "role_id ref", "server_id ref", "allow bool", "command string",
+		"arguments string", "created_at time", "updated_at time",
+	}},
+	{"audit_entries", []string{
+		"id id", "actor_id ref", "actor string", "action string", "target string",
+		"parameters text", "ip string", "user_agent string", "result string",
+		"created_at time",
+	}},
+	{"login_failures", []string{
+		"id id", "subject string unique", "failures int", "last_failure_at time",
+		"locked_until time", "created_at time", "updated_at time",
+	}},
+	{"user_sessions", []string{
+		"id id", "token string unique", "user_id ref", "ip string",
+		"user_agent string", "data text", "last_activity_at time",
+		"expires_at time", "created_at time", "updated_at time",
+	}},
+	{"recovery_codes", []string{
+		"id id", "user_id ref", "hash string", "used bool", "created_at time",
+		"updated_at time",
+	}},
+	{"security_keys", []string{
+		"id id", "user_id ref", "name string", "credential_id string unique",
+		"public_key text", "attestation_type string", "aaguid string",
+		"sign_count uint", "clone_warning bool", "last_used_at time",
+		"created_at time", "updated_at time",
+	}},
+	{"pending_twofas", []string{
+		"id id", "user_id ref unique", "secret string", "expires_at time",
+		"created_at time", "updated_at time",
+	}},
+	{"user_tokens", []string{
+		"id id", "purpose string", "hash string unique", "user_id ref",
+		"username string", "email string", "admin bool", "created_by_id ref",
+		"used bool", "expires_at time", "created_at time", "updated_at time",
+	}},
+}
+
+// Columns of the table that keeps track of migrations, which isn't a
+// migration itself.
+var schemaMigrationColumns = []string{
+	"id id", "version int unique", "name string", "applied_at time",
+}
+
+// Column types that migrations use, for each database. Ids are the same
+// types that gorm gives to uint64 primary keys, and refs are ids of
+// rows in other tables.
+var migrationTypes = map[string]map[string]string{
+	"sqlite3": {
+		"id":     "integer primary key autoincrement",
+		"ref":    "bigint",
+		"string": "varchar(255)",
+		"text":   "text",
+		"bool":   "bool",
+		"int":    "integer",
+		"uint":   "integer",
+		"bigint": "bigint",
+		"time":   "datetime",
+	},
+	"mysql": {
+		"id":     "bigint unsigned AUTO_INCREMENT PRIMARY KEY",
+		"ref":    "bigint unsigned",
+		"string": "varchar(255)",
+		"text":   "text",
+		"bool":   "boolean",
+		"int":    "int",
+		"uint":   "int unsigned",
+		"bigint": "bigint",
+		"time":   "DATETIME NULL",
+	},
+	"postgres": {
+		"id":     "bigserial PRIMARY KEY",
+		"ref":    "bigint",
+		"string": "varchar(255)",
+		"text":   "text",
+		"bool":   "boolean",
+		"int":    "integer",
+		"uint":   "bigint",
+		"bigint": "bigint",
+		"time":   "timestamp with time zone",
+	},
+}
+
+// Migration Column turns a column from a migration, like "username
+// string unique", into its name and its definition for the database.
+func MigrationColumn(tx *gorm.DB, column string) (string, string, error) {
+	parts := strings.Fields(column)
+	kind, ok := migrationTypes[tx.Dialect().GetName()][parts[1]]
+	if !ok {
+		return "", "", fmt.Errorf("no %s column type for %s", tx.Dialect().GetName(), parts[1])
+	}
+
+	definition := tx.Dialect().Quote(parts[0]) + " " + kind
+	if len(parts) > 2 && parts[2] == "unique" {
+		definition += " UNIQUE"
+	}
+
+	return parts[0], definition, nil
+}
+
+// Create Migration Table creates a table with the columns. If the table
+// is already there, like the users and servers tables of databases from
+// before migrations, then only the columns that it doesn't have yet are
+// added.
+func CreateMigrationTable(tx *gorm.DB, table string, columns []string) error {
+	if tx.Dialect().HasTable(table) {
+		return AddMigrationColumns(tx, table, columns)
+	}
+
+	definitions := make([]string, len(columns))
+	for i, column := range columns {
+		_, definition, err := MigrationColumn(tx, column)
+		if err != nil {
+			return err
+		}
+
+		definitions[i] = definition
+	}
+
+	return tx.Exec("CREATE TABLE " + tx.Dialect().Quote(table) + " (" + strings.Join(definitions, ", ") + ")").Error
+}
+
+// Add Migration Columns adds every column that the table doesn't have
+// yet. Databases can't add a unique column to a table that has rows,
+// so unique columns are given a unique index instead.
+func AddMigrationColumns(tx *gorm.DB, table string, columns []string) error {
+	for _, column := range columns {
+		name, definition, err := MigrationColumn(tx, column)
+		if err != nil {
+			return err
+		}
+
+		if tx.Dialect().HasColumn(table, name) {
+			continue
+		}
+
+		unique := strings.HasSuffix(definition, " UNIQUE")
+		definition = strings.TrimSuffix(definition, " UNIQUE")
+
+		err = tx.Exec("ALTER TABLE " + tx.Dialect().Quote(table) + " ADD COLUMN " + definition).Error
+		if err == nil && unique {
+			err = tx.Table(table).AddUniqueIndex("idx_"+table+"_"+name, name).Error
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Indexes that are added by the second migration. Every user's grants,
+// sessions, recovery codes and security keys are looked up on most
+// requests, and the audit log is always sorted by time.
+var migrationIndexes = []struct {
+	Model  interface{}
+	Name   string
+	Column string
+}{
+	{&RoleGrant{}, "idx_role_grants_user_id", "user_id"},
+	{&UserSession{}, "idx_user_sessions_user_id", "user_id"},
+	{&RecoveryCode{}, "idx_recovery_codes_user_id", "user_id"},
+	{&SecurityKey{}, "idx_security_keys_user_id", "user_id"},
+	{&AuditEntry{}, "idx_audit_entries_created_at", "created_at"},
+}
+
+// Latest Schema Version returns the version of the last migration.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Schema Version returns the version of the last migration that has
+// been applied to the database, or 0 if none have been. It only reads
+// from the database, so the table that keeps track of migrations might
+// not be there yet.
+func SchemaVersion() int {
+	var last SchemaMigration
+	if db.HasTable(&SchemaMigration{}) {
+		db.Order("version desc").First(&last)
+	}
+
+	return last.Version
+}
+
+// Applied Migrations returns when each version that has been applied to
+// the database was applied.
+func AppliedMigrations() map[int]time.Time {
+	var list []SchemaMigration
+	if db.HasTable(&SchemaMigration{}) {
+		db.Order("version").Find(&list)
+	}
+
+	applied := map[int]time.Time{}
+	for _, m := range list {
+		applied[m.Version] = m.AppliedAt
+	}
+
+	return applied
+}
+
+// Migrate Up applies every migration after the current version up to
+// and including the target version.
+func MigrateUp(target int) error {
+	current := SchemaVersion()
+	if current > LatestSchemaVersion() {
+		return ErrNewerSchema(current)
+	}
+
+	// The table that keeps track of migrations isn't a migration itself
+	if !db.HasTable(&SchemaMigration{}) {
+		err := CreateMigrationTable(db, "schema_migrations", schemaMigrationColumns)
+		if err != nil {
+			return fmt.Errorf("can't create the schema_migrations table: %s", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version > current && m.Version <= target {
+			Infof("Applying migration %d: %s", m.Version, m.Name)
+			err := RunMigration(m.Up, func(tx *gorm.DB) error {
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d failed: %s", m.Version, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Migrate Down undoes the given number of migrations, starting with the
+// last one that was applied.
+func MigrateDown(steps int) error {
+	current := SchemaVersion()
+	if current > LatestSchemaVersion() {
+		return ErrNewerSchema(current)
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.Version <= current {
+			Infof("Undoing migration %d: %s", m.Version, m.Name)
+			err := RunMigration(m.Down, func(tx *gorm.DB) error {
+				return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("undoing migration %d failed: %s", m.Version, err)
+			}
+
+			steps--
+		}
+	}
+
+	return nil
+}
+
+// Run Migration runs one direction of a migration and records it in a
+// transaction. MySQL can't roll back changes to tables, so a migration
+// that fails there may have to be cleaned up by hand.
+func RunMigration(change func(*gorm.DB) error, record func(*gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	err := change(tx)
+	if err == nil {
+		err = record(tx)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// Err Newer Schema is returned when the database has been migrated by a
+// newer version of Sorbet than this one.
+func ErrNewerSchema(version int) error {
+	return fmt.Errorf("the database schema is version %d but this version of Sorbet only knows up to version %d, so Sorbet has to be upgraded", version, LatestSchemaVersion())
+}
+
+// Initalize Schema makes sure the database schema is the one that this
+// version of Sorbet expects. Pending migrations are applied unless auto
+// migrate is turned off, and a database that is newer than Sorbet is
+// never touched.
+func initalizeSchema() {
+	current := SchemaVersion()
+	latest := LatestSchemaVersion()
+
+	var err error
+	if current > latest {
+		err = ErrNewerSchema(current)
+	} else if current < latest && !*autoMigrateFlag {
+		err = fmt.Errorf("the database schema is version %d but has to be version %d, run \"sorbet migrate up\"", current, latest)
+	} else if current < latest {
+		err = MigrateUp(latest)
+	}
+
+	if err != nil {
+		Warnf("Error migrating database: %s", err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+}
+
+// Migrate Command runs "sorbet migrate status", "sorbet migrate up
+// [version]" or "sorbet migrate down [steps]".
+func MigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: sorbet migrate status|up [version]|down [steps]")
+	}
+
+	// Both up and down take an optional number
+	number := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a number", args[1])
+		}
+
+		number = n
+	}
+
+	switch args[0] {
+	case "status":
+		applied := AppliedMigrations()
+		for _, m := range migrations {
+			status := "pending"
+			if at, ok := applied[m.Version]; ok {
+				status = "applied " + at.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%4d  %-33s  %s\n", m.Version, status, m.Name)
+		}
+
+		if current := SchemaVersion(); current > LatestSchemaVersion() {
+			return ErrNewerSchema(current)
+		}
+
+		return nil
+	case "up":
+		if len(args) == 1 {
+			number = LatestSchemaVersion()
+		}
+
+		return MigrateUp(number)
+	case "down":
+		if len(args) == 1 {
+			number = 1
+		}
+
+		return MigrateDown(number)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Use Test Database points the global database at a new one until the
+// test is over. SQLite databases are made in a temporary folder, and
+// MySQL and PostgreSQL databases are only used if their DSN is in the
+// environment, in which case they have to be empty.
+func UseTestDatabase(t *testing.T, driver string, env string) {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "migrate.db")
+	if env != "" {
+		dsn = os.Getenv(env)
+		if dsn == "" {
+			t.Skipf("set %s to test against %s", env, driver)
+		}
+	}
+
+	test, err := gorm.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := db
+	db = test
+	t.Cleanup(func() {
+		db = old
+		test.Close()
+	})
+
+	// Databases from the environment are left empty for the next test
+	if env != "" {
+		t.Cleanup(func() {
+			if err := MigrateDown(len(migrations)); err != nil {
+				t.Error(err)
+			}
+
+			db.DropTableIfExists(&SchemaMigration{})
+		})
+	}
+}
+
+// Check Migrated Schema checks that every table that Sorbet uses is
+// there with a column for every field, and that a row can be saved in
+// each of them.
+func CheckMigratedSchema(t *testing.T) {
+	t.Helper()
+
+	if version := SchemaVersion(); version != LatestSchemaVersion() {
+		t.Fatalf("the schema is version %d, want %d", version, LatestSchemaVersion())
+	}
+
+	models := []interface{}{
+		&User{Username: "migrated", Issuer: "https://id.example.com", Subject: "1"},
+		&Server{Host: "localhost", Port: 25575},
+		&Role{Name: "migrated"},
+		&RoleGrant{UserId: 1, RoleId: 1},
+		&CommandPolicy{RoleId: 1, Allow: true, Command: "list"},
+		&AuditEntry{Actor: "migrated", Action: "migrate"},
+		&LoginFailure{Subject: "migrated"},
+		&UserSession{Token: "migrated", UserId: 1},
+		&RecoveryCode{UserId: 1, Hash: "migrated"},
+		&SecurityKey{UserId: 1, CredentialId: "migrated", SignCount: 4000000000},
+		&PendingTwofa{UserId: 1},
+		&UserToken{Hash: "migrated"},
+	}
+
+	for _, model := range models {
+		scope := db.NewScope(model)
+		for _, field := range scope.Fields() {
+			if field.IsNormal && !scope.Dialect().HasColumn(scope.TableName(), field.DBName) {
+				t.Errorf("%s has no %s column", scope.TableName(), field.DBName)
+			}
+		}
+
+		if err := db.Create(model).Error; err != nil {
+			t.Errorf("saving a row in %s: %s", scope.TableName(), err)
+		}
+	}
+
+	var key SecurityKey
+	if db.First(&key).Error != nil || key.SignCount != 4000000000 {
+		t.Errorf("the sign count came back as %d, want 4000000000", key.SignCount)
+	}
+}
+
+// Check Migrations Go Up Down And Up Again applies every migration,
+// undoes them all and then applies them again.
+func CheckMigrationsGoUpDownAndUpAgain(t *testing.T) {
+	t.Helper()
+
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	CheckMigratedSchema(t)
+
+	if err := MigrateDown(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+
+	if version := SchemaVersion(); version != 0 {
+		t.Errorf("the schema is version %d after undoing every migration, want 0", version)
+	}
+
+	for _, table := range migrationTables {
+		if db.HasTable(table.Name) {
+			t.Errorf("the %s table is still there after undoing every migration", table.Name)
+		}
+	}
+
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	CheckMigratedSchema(t)
+}
+
+func TestMigrationsGoUpDownAndUpAgainOnSQLite(t *testing.T) {
+	UseTestDatabase(t, "sqlite3", "")
+	CheckMigrationsGoUpDownAndUpAgain(t)
+}
+
+func TestMigrationsGoUpDownAndUpAgainOnMySQL(t *testing.T) {
+	UseTestDatabase(t, "mysql", "SORBET_TEST_MYSQL")
+	CheckMigrationsGoUpDownAndUpAgain(t)
+}
+
+func TestMigrationsGoUpDownAndUpAgainOnPostgreSQL(t *testing.T) {
+	UseTestDatabase(t, "postgres", "SORBET_TEST_POSTGRES")
+	CheckMigrationsGoUpDownAndUpAgain(t)
+}
+
+func TestMigrateStatusDoesNotChangeTheDatabase(t *testing.T) {
+	UseTestDatabase(t, "sqlite3", "")
+
+	if version := SchemaVersion(); version != 0 {
+		t.Errorf("an empty database is version %d, want 0", version)
+	}
+
+	if applied := AppliedMigrations(); len(applied) != 0 {
+		t.Errorf("an empty database has the migrations %v applied", applied)
+	}
+
+	if err := MigrateCommand([]string{"status"}); err != nil {
+		t.Error(err)
+	}
+
+	if db.HasTable(&SchemaMigration{}) {
+		t.Error("checking the status created the schema_migrations table")
+	}
+}
+
+func TestMigrationsKeepTablesFromBeforeMigrations(t *testing.T) {
+	UseTestDatabase(t, "sqlite3", "")
+
+	// The users table as Sorbet made it before there were migrations
+	err := db.Exec(`CREATE TABLE users (id integer primary key autoincrement,
+		username varchar(255) UNIQUE, password varchar(255), admin bool,
+		twofa bool, twofa_secret varchar(255), created_at datetime,
+		updated_at datetime)`).Error
+	if err == nil {
+		err = db.Exec("INSERT INTO users (username, password, admin) VALUES ('old', 'hash', 1)").Error
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	var user User
+	if err := db.Where("username = ?", "old").First(&user).Error; err != nil {
+		t.Fatalf("the user from before migrations is gone: %s", err)
+	} else if user.Password != "hash" || !user.Admin {
+		t.Errorf("the user from before migrations changed: %+v", user)
+	}
+
+	if err := db.Create(&User{Username: "old"}).Error; err == nil {
+		t.Error("a second user with the same username could be saved")
+	}
+
+	CheckMigratedSchema(t)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notifier delivers links, like invitations and password resets, to the
+// people that they are for.
+type Notifier interface {
+	// Notify sends a message with a link to an address. If the link
+	// could not be delivered, for example because the notifier can't
+	// send anything or there is no address, then false is returned and
+	// the link has to be handed over by whoever created it.
+	Notify(to string, subject string, message string, link string) (bool, error)
+}
+
+// Notifier that links are delivered with
+var notifier Notifier
+
+// Initalize Notifier sets up the notifier that was asked for with the
+// notifier flag.
+func initalizeNotifier() {
+	switch *notifierFlag {
+	case "display":
+		notifier = &DisplayNotifier{}
+	case "smtp":
+		notifier = &SMTPNotifier{
+			Addr:     *smtpAddrFlag,
+			From:     *smtpFromFlag,
+			Username: *smtpUsernameFlag,
+			Password: *smtpPasswordFlag,
+		}
+	default:
+		Warnf("Unknown notifier: %s", *notifierFlag)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+}
+
+// Can Send Links checks if the notifier can deliver links by itself,
+// which is needed for users to reset their own passwords.
+func CanSendLinks() bool {
+	_, display := notifier.(*DisplayNotifier)
+	return !display
+}
+
+// DisplayNotifier never delivers anything, so every link is shown to
+// whoever created it to copy and hand over.
+type DisplayNotifier struct{}
+
+// Notify always returns false.
+func (n *DisplayNotifier) Notify(to string, subject string, message string, link string) (bool, error) {
+	return false, nil
+}
+
+// SMTPNotifier delivers links by email.
+type SMTPNotifier struct {
+	// Addr is the host and port of the mail server.
+	Addr string
+
+	// From is the address that emails are sent from.
+	From string
+
+	// Username and Password are used to log in to the mail server
+	// if a username is given.
+	Username string
+	Password string
+}
+
+// Notify emails the message and link to the address. Nothing is sent if
+// there is no address.
+func (n *SMTPNotifier) Notify(to string, subject string, message string, link string) (bool, error) {
+	if to == "" {
+		return false, nil
+	}
+
+	// Make sure nothing can sneak extra headers into the email
+	address, err := mail.ParseAddress(to)
+	if err != nil {
+		return false, err
+	} else if strings.ContainsAny(subject, "\r\n") {
+		return false, errors.New("subject can't contain new lines")
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, strings.Split(n.Addr, ":")[0])
+	}
+
+	body := strings.Join([]string{
+		"From: " + n.From,
+		"To: " + address.String(),
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		message,
+		"",
+		link,
+		"",
+	}, "\r\n")
+
+	err = smtp.SendMail(n.Addr, auth, n.From, []string{address.Address}, []byte(body))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start Test SMTP starts a mail server that accepts every email and
+// sends each one that it gets down the channel.
+func StartTestSMTP(t *testing.T) (string, chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go ServeTestSMTP(conn, mails)
+		}
+	}()
+
+	return listener.Addr().String(), mails
+}
+
+// Serve Test SMTP answers the commands on one SMTP connection.
+func ServeTestSMTP(conn net.Conn, mails chan string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	write := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	write("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			write("250 localhost")
+		case command == "DATA":
+			write("354 End data with <CR><LF>.<CR><LF>")
+
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				} else if line == ".\r\n" {
+					break
+				}
+
+				data.WriteString(line)
+			}
+
+			mails <- data.String()
+			write("250 OK")
+		case command == "QUIT":
+			write("221 Bye")
+			return
+		default:
+			write("250 OK")
+		}
+	}
+}
+
+// Reset Test Password sends the reset form for the token with a new
+// password.
+func ResetTestPassword(token string, password string) *httptest.ResponseRecorder {
+	req := NewTestForm("/reset/"+token, url.Values{"password": {password}, "confirm": {password}})
+	req = mux.SetURLVars(req, map[string]string{"token": token})
+
+	w := httptest.NewRecorder()
+	HandleResetForm(w, req)
+	return w
+}
+
+func TestForgotPasswordEmailsALinkThatWorksOnce(t *testing.T) {
+	addr, mails := StartTestSMTP(t)
+	defer func(old Notifier) { notifier = old }(notifier)
+	notifier = &SMTPNotifier{Addr: addr, From: "sorbet@example.com"}
+
+	user := NewTestUser(t, "smtp-forgot", false)
+	db.Model(user).UpdateColumn("email", "forgot@example.com")
+	users.Update(user.Id, func(v *User) {
+		v.Email = "forgot@example.com"
+	})
+
+	HandleForgotForm(httptest.NewRecorder(), NewTestForm("/login/forgot", url.Values{"username": {"smtp-forgot"}}))
+
+	var mail string
+	select {
+	case mail = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+	}
+
+	if !strings.Contains(mail, "To: <forgot@example.com>") || !strings.Contains(mail, "Subject: Reset your Sorbet password") {
+		t.Errorf("the email was not for the user:\n%s", mail)
+	}
+
+	match := regexp.MustCompile(`/reset/([A-Za-z0-9_-]+)`).FindStringSubmatch(mail)
+	if match == nil {
+		t.Fatalf("the email has no reset link:\n%s", mail)
+	}
+
+	// The link changes the password
+	if w := ResetTestPassword(match[1], "Brand-New-Password-1"); w.Code != 303 {
+		t.Fatalf("resetting the password answered %d", w.Code)
+	}
+
+	if !PasswordMatchesHash("Brand-New-Password-1", FindUser(user.Id).Password) {
+		t.Error("the password was not changed")
+	}
+
+	// And doesn't work a second time
+	if w := ResetTestPassword(match[1], "Another-New-Password-2"); !strings.Contains(w.Body.String(), "already been used") {
+		t.Error("a used link should say that it has been used")
+	}
+
+	if !PasswordMatchesHash("Brand-New-Password-1", FindUser(user.Id).Password) {
+		t.Error("a used link should not change the password")
+	}
+}
+
+func TestForgotPasswordOnlyEmailsUsersWithAnAddress(t *testing.T) {
+	addr, mails := StartTestSMTP(t)
+	defer func(old Notifier) { notifier = old }(notifier)
+	notifier = &SMTPNotifier{Addr: addr, From: "sorbet@example.com"}
+
+	NewTestUser(t, "smtp-noaddress", false)
+	HandleForgotForm(httptest.NewRecorder(), NewTestForm("/login/forgot", url.Values{"username": {"smtp-noaddress"}}))
+	HandleForgotForm(httptest.NewRecorder(), NewTestForm("/login/forgot", url.Values{"username": {"smtp-nobody"}}))
+
+	select {
+	case mail := <-mails:
+		t.Errorf("an email was sent:\n%s", mail)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestExpiredResetLinksAreRefused(t *testing.T) {
+	user := NewTestUser(t, "smtp-expired", false)
+	token := NewUserToken(&UserToken{Purpose: TokenReset, UserId: user.Id}, -time.Minute)
+
+	if FindUserToken(TokenReset, token) != nil {
+		t.Error("an expired token should not be found")
+	}
+
+	if w := ResetTestPassword(token, "Brand-New-Password-1"); !strings.Contains(w.Body.String(), "has expired") {
+		t.Error("an expired link should say that it has expired")
+	}
+
+	if !PasswordMatchesHash("Correct-Horse-Battery-9", FindUser(user.Id).Password) {
+		t.Error("an expired link should not change the password")
+	}
+}
+
+func TestSMTPNotifierRefusesHeadersInTheSubject(t *testing.T) {
+	notifier := &SMTPNotifier{Addr: "127.0.0.1:1", From: "sorbet@example.com"}
+
+	if sent, err := notifier.Notify("someone@example.com", "Hi\r\nBcc: everyone@example.com", "message", "link"); sent || err == nil {
+		t.Error("a subject with a new line should not be sent")
+	}
+
+	if sent, err := notifier.Notify("", "Hi", "message", "link"); sent || err != nil {
+		t.Error("nothing should be sent without an address")
+	}
+}
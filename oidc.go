@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// How long somebody has to log in with the identity provider before
+// they have to start again, in seconds.
+const oidcMaxAge = 10 * 60
+
+// OIDC is the identity provider that users can log in with, or nil if
+// single sign-on is not set up.
+var OIDC *OIDCProvider
+
+// OIDCProvider is an OpenID Connect identity provider that users log in
+// with by being sent to it and back again with an authorization code.
+type OIDCProvider struct {
+	// Name is what the login button calls the provider.
+	Name string
+
+	// Config is the OAuth2 client for the provider.
+	Config oauth2.Config
+
+	// Verifier checks the signature, issuer, audience and expiry of
+	// ID tokens.
+	Verifier *oidc.IDTokenVerifier
+
+	// UsernameClaim is the claim that the Sorbet username is taken
+	// from.
+	UsernameClaim string
+
+	// RolesClaim is the claim that lists the groups or roles that the
+	// user has with the provider.
+	RolesClaim string
+
+	// Roles maps lowercase values of the roles claim to the Sorbet
+	// roles that they are granted.
+	Roles map[string][]string
+}
+
+// Initalize OIDC finds the identity provider's endpoints and keys with
+// discovery. Nothing is set up if no issuer was given.
+func initalizeOIDC() {
+	if *oidcIssuerFlag == "" {
+		return
+	}
+
+	provider, err := oidc.NewProvider(context.Background(), *oidcIssuerFlag)
+	if err != nil {
+		Warnf("Error discovering OIDC issuer %s: %s", *oidcIssuerFlag, err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+
+	redirect := *oidcRedirectUrlFlag
+	if redirect == "" {
+		redirect = BaseUrl() + "/login/oidc/callback"
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range strings.Split(*oidcScopesFlag, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" && scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	OIDC = &OIDCProvider{
+		Name: *oidcNameFlag,
+		Config: oauth2.Config{
+			ClientID:     *oidcClientIdFlag,
+			ClientSecret: *oidcClientSecretFlag,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirect,
+			Scopes:       scopes,
+		},
+		Verifier:      provider.Verifier(&oidc.Config{ClientID: *oidcClientIdFlag}),
+		UsernameClaim: *oidcUsernameClaimFlag,
+		RolesClaim:    *oidcRolesClaimFlag,
+		Roles:         ParseRoleMapping(*oidcRolesFlag),
+	}
+}
+
+// Random Token returns a random string that is safe to put in a URL.
+func RandomToken() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// PKCE Challenge returns the S256 code challenge for a PKCE verifier.
+func PKCEChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Start creates the URL that the user is sent to at the identity
+// provider. The state, nonce and PKCE verifier are kept in a short
+// lived cookie so they can be checked when the user comes back.
+func (p *OIDCProvider) Start(w http.ResponseWriter, req *http.Request) (string, error) {
+	state := RandomToken()
+	nonce := RandomToken()
+	verifier := RandomToken()
+
+	// The flow is kept in a cookie rather than the user session, which
+	// would make the browser look partly logged in.
+	session, _ := csrfStore.New(req, "oidc")
+	session.Options.MaxAge = oidcMaxAge
+	session.Options.HttpOnly = true
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+
+	err := session.Save(req, w)
+	if err != nil {
+		return "", err
+	}
+
+	return p.Config.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", PKCEChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+// Finish checks the state that the identity provider sent the user back
+// with, swaps the authorization code for tokens and verifies the ID
+// token. The claims of the ID token are returned.
+func (p *OIDCProvider) Finish(w http.ResponseWriter, req *http.Request) (map[string]interface{}, error) {
+	session, _ := csrfStore.Get(req, "oidc")
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	verifier, _ := session.Values["verifier"].(string)
+
+	// Each flow can only be finished once
+	session.Options.MaxAge = -1
+	session.Save(req, w)
+
+	if e := req.FormValue("error"); e != "" {
+		return nil, fmt.Errorf("identity provider returned %s: %s", e, req.FormValue("error_description"))
+	}
+
+	sent := req.FormValue("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(state)) != 1 {
+		return nil, errors.New("state does not match")
+	}
+
+	token, err := p.Config.Exchange(req.Context(), req.FormValue("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token was returned")
+	}
+
+	idToken, err := p.Verifier.Verify(req.Context(), raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce does not match")
+	}
+
+	claims := map[string]interface{}{}
+	err = idToken.Claims(&claims)
+	return claims, err
+}
+
+// Username returns the Sorbet username from the claims of an ID token.
+func (p *OIDCProvider) Username(claims map[string]interface{}) string {
+	username, _ := claims[p.UsernameClaim].(string)
+	return strings.TrimSpace(username)
+}
+
+// Provision returns the user that the claims of an ID token belong to,
+// and creates them if they don't exist yet. Users are only ever matched
+// by the issuer and subject, which the identity provider never changes
+// or gives to anyone else. The username claim is only used to name new
+// users, since users can often choose it themselves, and a number is
+// added to it if somebody already has the name.
+func (p *OIDCProvider) Provision(req *http.Request, claims map[string]interface{}) (*User, error) {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if issuer == "" || subject == "" {
+		return nil, errors.New("the iss or sub claim is missing")
+	}
+
+	user := users.FindBySubject(issuer, subject)
+	if user != nil {
+		return user, nil
+	}
+
+	username := p.Username(claims)
+	if username == "" {
+		return nil, fmt.Errorf("the %s claim is missing", p.UsernameClaim)
+	}
+
+	name := username
+	for i := 2; FindUserByUsername(name) != nil; i++ {
+		name = fmt.Sprintf("%s-%d", username, i)
+	}
+
+	// Create user without a password, since it's checked elsewhere
+	newuser := User{
+		Username:      name,
+		Source:        "oidc",
+		Issuer:        issuer,
+		Subject:       subject,
+		SecurityStamp: NewSecurityStamp(),
+	}
+
+	err := db.Create(&newuser).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the users array
+	users.Add(&newuser)
+	AuditAs(req, &newuser, "user.provision", name, map[string]string{"source": "oidc", "issuer": issuer, "subject": subject}, "success")
+
+	return &newuser, nil
+}
+
+// Groups returns the values of the roles claim, which can either be a
+// list of strings or a single string.
+func (p *OIDCProvider) Groups(claims map[string]interface{}) []string {
+	list := []string{}
+
+	switch value := claims[p.RolesClaim].(type) {
+	case string:
+		list = append(list, value)
+	case []interface{}:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/go-jose/go-jose/v3"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIssuer is an OpenID Connect identity provider that hands out ID
+// tokens with whatever claims the test gives it for a code.
+type TestIssuer struct {
+	Server *httptest.Server
+	Key    *rsa.PrivateKey
+
+	lock  sync.Mutex
+	codes map[string]map[string]interface{}
+}
+
+// Start Test Issuer starts an identity provider with discovery, a key
+// set and a token endpoint, and points Sorbet at it with the client id
+// "sorbet".
+func StartTestIssuer(t *testing.T) *TestIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &TestIssuer{Key: key, codes: map[string]map[string]interface{}{}}
+	mux := http.NewServeMux()
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.Server.URL,
+			"authorization_endpoint":                issuer.Server.URL + "/authorize",
+			"token_endpoint":                        issuer.Server.URL + "/token",
+			"jwks_uri":                              issuer.Server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		issuer.lock.Lock()
+		claims, ok := issuer.codes[req.FormValue("code")]
+		delete(issuer.codes, req.FormValue("code"))
+		issuer.lock.Unlock()
+
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.Sign(t, claims),
+		})
+	})
+
+	*oidcIssuerFlag = issuer.Server.URL
+	*oidcClientIdFlag = "sorbet"
+	*oidcRolesFlag = "ops=operator"
+	initalizeOIDC()
+	t.Cleanup(func() {
+		OIDC = nil
+		*oidcIssuerFlag = ""
+		*oidcClientIdFlag = ""
+		*oidcRolesFlag = ""
+	})
+
+	return issuer
+}
+
+// Sign returns an ID token with the claims, filling in the claims that
+// every ID token has.
+func (i *TestIssuer) Sign(t *testing.T, claims map[string]interface{}) string {
+	payload := map[string]interface{}{
+		"iss": i.Server.URL,
+		"aud": "sorbet",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	for name, value := range claims {
+		payload[name] = value
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: i.Key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+
+	encoded, _ := json.Marshal(payload)
+	signed, err := signer.Sign(encoded)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+
+	token, _ := signed.CompactSerialize()
+	return token
+}
+
+// Log In runs the whole login flow in Sorbet. The issuer answers with
+// the claims, and the nonce that Sorbet asked for is added to them
+// unless they already have one. The response to the callback is
+// returned.
+func (i *TestIssuer) LogIn(t *testing.T, claims map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	start := httptest.NewRecorder()
+	HandleOIDCLogin(start, httptest.NewRequest("GET", "/login/oidc", nil))
+
+	location, err := url.Parse(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := location.Query()
+	if _, ok := claims["nonce"]; !ok {
+		claims["nonce"] = query.Get("nonce")
+	}
+
+	code := RandomToken()
+	i.lock.Lock()
+	i.codes[code] = claims
+	i.lock.Unlock()
+
+	req := httptest.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {query.Get("state")}, "code": {code}}.Encode(), nil)
+	for _, cookie := range start.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	callback := httptest.NewRecorder()
+	HandleOIDCCallback(callback, req)
+	return callback
+}
+
+func TestOIDCLoginMatchesUsersBySubject(t *testing.T) {
+	issuer := StartTestIssuer(t)
+
+	response := issuer.LogIn(t, map[string]interface{}{"sub": "subject-1", "preferred_username": "oidc-sam", "groups": []string{"ops"}})
+	if location := response.Header().Get("Location"); location != "/" {
+		t.Fatalf("logging in sent the user to %q, want /", location)
+	}
+
+	user := FindUserByUsername("oidc-sam")
+	if user == nil {
+		t.Fatal("the user was not created")
+	}
+
+	if user.Source != "oidc" || user.Issuer != issuer.Server.URL || user.Subject != "subject-1" {
+		t.Errorf("the user was created from %q with the issuer %q and subject %q", user.Source, user.Issuer, user.Subject)
+	}
+
+	if !user.Can(PermRunCommands, 0) {
+		t.Error("the user should have the role of their group")
+	}
+
+	// Changing the username with the identity provider keeps the same
+	// user and name
+	issuer.LogIn(t, map[string]interface{}{"sub": "subject-1", "preferred_username": "oidc-samuel"})
+	if FindUserByUsername("oidc-samuel") != nil {
+		t.Error("a new user was created for a subject that already has one")
+	}
+
+	if users.FindBySubject(issuer.Server.URL, "subject-1") == nil {
+		t.Error("the user should still be found by their subject")
+	}
+}
+
+func TestOIDCLoginDoesNotTakeOverUsersWithTheSameName(t *testing.T) {
+	issuer := StartTestIssuer(t)
+	admin := NewTestUser(t, "oidc-admin", true)
+
+	issuer.LogIn(t, map[string]interface{}{"sub": "subject-2", "preferred_username": "oidc-admin"})
+	user := users.FindBySubject(issuer.Server.URL, "subject-2")
+	if user == nil || user.Id == admin.Id {
+		t.Fatal("a new user should be created for the subject")
+	}
+
+	if user.Username != "oidc-admin-2" || user.Admin {
+		t.Errorf("the new user is %q with admin %t, want oidc-admin-2 without admin", user.Username, user.Admin)
+	}
+
+	// Another subject that claims the name of an OIDC user gets its
+	// own user too
+	issuer.LogIn(t, map[string]interface{}{"sub": "subject-3", "preferred_username": "oidc-admin-2"})
+	other := users.FindBySubject(issuer.Server.URL, "subject-3")
+	if other == nil || other.Id == user.Id || other.Username != "oidc-admin-2-2" {
+		t.Errorf("the second subject got %v, want a new user called oidc-admin-2-2", other)
+	}
+}
+
+func TestOIDCLoginChecksTheNonce(t *testing.T) {
+	issuer := StartTestIssuer(t)
+
+	response := issuer.LogIn(t, map[string]interface{}{"sub": "subject-4", "preferred_username": "oidc-nonce", "nonce": "wrong"})
+	if location := response.Header().Get("Location"); location != "/login" {
+		t.Errorf("a wrong nonce sent the user to %q, want /login", location)
+	}
+
+	if users.FindBySubject(issuer.Server.URL, "subject-4") != nil {
+		t.Error("a user should not be created with a wrong nonce")
+	}
+}
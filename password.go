@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base32"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// bcrypt only looks at the first 72 bytes of a password, so anything
+// after that would be thrown away without the user knowing.
+const maxPasswordLength = 72
+
+// Common passwords that nobody is allowed to use, in lowercase.
+var commonPasswords = map[string]bool{}
+
+// PasswordPolicyError is returned when a password is not allowed by the
+// password policy.
+type PasswordPolicyError struct {
+	// Reason is a human readable explanation of why it's not allowed.
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "Password " + e.Reason
+}
+
+// Initalize Password Policy loads the list of common passwords, which is
+// the built in list unless another one was given. Sorbet doesn't start
+// if the list can't be read, rather than letting anyone choose a common
+// password without anybody noticing.
+func initalizePasswordPolicy() {
+	if *passwordListFlag == "" {
+		commonPasswords, _ = ReadPasswordList(strings.NewReader(embeddedPasswords))
+		return
+	}
+
+	list, err := LoadPasswordList(*passwordListFlag)
+	if err != nil {
+		Warnf("Error loading common passwords from %s: %s", *passwordListFlag, err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+
+	commonPasswords = list
+}
+
+// Load Password List reads a file with one password on each line.
+func LoadPasswordList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadPasswordList(file)
+}
+
+// Read Password List reads one password from each line. Blank lines and
+// lines that start with "#" are skipped.
+func ReadPasswordList(r io.Reader) (map[string]bool, error) {
+	list := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			list[strings.ToLower(line)] = true
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// Check Password checks if a password is allowed by the password policy
+// for a user with the username. A *PasswordPolicyError is returned if
+// it isn't.
+func CheckPassword(password string, username string) error {
+	lower := strings.ToLower(password)
+
+	if len(password) < *passwordMinLengthFlag {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("must be at least %d characters", *passwordMinLengthFlag)}
+	} else if len(password) > maxPasswordLength {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("must be at most %d characters", maxPasswordLength)}
+	} else if commonPasswords[lower] {
+		return &PasswordPolicyError{Reason: "is too common"}
+	} else if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return &PasswordPolicyError{Reason: "must not contain the username"}
+	}
+
+	return nil
+}
+
+// Password Policy returns a human readable description of what
+// passwords have to look like.
+func PasswordPolicy() string {
+	return fmt.Sprintf("Passwords must be %d to %d characters long, can't contain your username, and can't be a common password.", *passwordMinLengthFlag, maxPasswordLength)
+}
+
+// Random Password returns a random password that is easy to type,
+// which is given to the first administrator when they don't choose
+// their own.
+func RandomPassword() string {
+	return strings.ToLower(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(15)))
+}
+
+// Require Password Change wraps a handler so that users that have to
+// change their password can't do anything else until they have. Static
+// files and logging out are still allowed.
+func RequirePasswordChange(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		allowed := path == "/settings/password" || path == "/logout" || path == "/robots.txt" || strings.HasPrefix(path, "/assets/")
+
+		if user := WhoAmI(req); !allowed && user != nil && user.MustChangePassword && IsLoggedIn(w, req) {
+			http.Redirect(w, req, "/settings/password", http.StatusSeeOther)
+		} else {
+			handler.ServeHTTP(w, req)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuiltInPasswordListIsLoaded(t *testing.T) {
+	if *passwordListFlag != "" {
+		t.Skip("another list was given")
+	}
+
+	if !commonPasswords["password123"] || !commonPasswords["minecraft123"] {
+		t.Error("the built in list of common passwords should be loaded without a path")
+	}
+}
+
+func TestCheckPasswordRejectsCommonPasswords(t *testing.T) {
+	for _, password := range []string{"Password123456", "minecraft2024", "QWERTYUIOP123", "1234567890", "iloveyou123!", "Herobrine2020"} {
+		if err := CheckPassword(password, ""); err == nil {
+			t.Errorf("%q should be too common", password)
+		}
+	}
+
+	if err := CheckPassword("Correct-Horse-Battery-9", "steve"); err != nil {
+		t.Errorf("an uncommon password should be allowed: %s", err)
+	}
+}
+
+func TestCommonPasswordsAreLongEnoughToMatter(t *testing.T) {
+	// Passwords that are shorter than the minimum length are refused
+	// anyway, so the list has to be mostly long passwords to do
+	// anything
+	long := 0
+	for password := range commonPasswords {
+		if len(password) >= *passwordMinLengthFlag {
+			long++
+		}
+	}
+
+	if long < 10000 {
+		t.Errorf("only %d common passwords are at least %d characters", long, *passwordMinLengthFlag)
+	}
+}
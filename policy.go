@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type CommandPolicy struct {
+	// Id is a uint64 that is the policy's identification number.
+	Id uint64
+
+	// RoleId is the id of the role that the policy applies to.
+	RoleId uint64
+
+	// ServerId is the id of the server that the policy applies to.
+	// If ServerId is 0 then the policy applies to every server.
+	ServerId uint64
+
+	// Allow is a bool that specifies if commands that match the
+	// policy are allowed or denied.
+	Allow bool
+
+	// Command is the name of the command that the policy matches,
+	// without a leading slash. A command of "*" matches every
+	// command.
+	Command string `sql:"size:255"`
+
+	// Arguments is an optional regular expression that has to match
+	// the arguments of the command for the policy to apply.
+	Arguments string `sql:"size:255"`
+
+	// CreatedAt is a timestamp of when the specific
+	// policy was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// policy was last updated at.
+	UpdatedAt time.Time
+}
+
+// Default command policies are created when the database is initialized
+// and there are no policies at all yet. The key is the name of the role
+// that the policies are created for.
+var defaultCommandPolicies = map[string][]CommandPolicy{
+	"moderator": {
+		{Allow: true, Command: "kick"},
+		{Allow: true, Command: "say"},
+		{Allow: false, Command: "stop"},
+		{Allow: false, Command: "op"},
+		{Allow: false, Command: "execute"},
+	},
+	"operator": {
+		{Allow: true, Command: "*"},
+		{Allow: false, Command: "stop"},
+	},
+	"admin": {
+		{Allow: true, Command: "*"},
+	},
+}
+
+// CommandDeniedError is returned when a user tries to run a command on
+// a server that they are not allowed to run.
+type CommandDeniedError struct {
+	// Command is the name of the command that was denied.
+	Command string
+
+	// Reason is a human readable explanation of why it was denied.
+	Reason string
+}
+
+func (e *CommandDeniedError) Error() string {
+	return fmt.Sprintf("You are not allowed to run \"%s\": %s", e.Command, e.Reason)
+}
+
+// Role returns the role that the policy applies to.
+func (p *CommandPolicy) Role() *Role {
+	return FindRole(p.RoleId)
+}
+
+// Server returns the server that the policy applies to, or nil if the
+// policy applies to every server.
+func (p *CommandPolicy) Server() *Server {
+	return FindServer(p.ServerId)
+}
+
+// Matches checks if the policy applies to a command name and the
+// arguments that were given to the command.
+func (p *CommandPolicy) Matches(name string, args string) bool {
+	if p.Command != "*" && !strings.EqualFold(p.Command, name) {
+		return false
+	}
+
+	if p.Arguments != "" {
+		re, err := regexp.Compile(p.Arguments)
+		if err != nil {
+			Warnf("Error compiling arguments of command policy %d: %s", p.Id, err)
+			return false
+		}
+
+		return re.MatchString(args)
+	}
+
+	return true
+}
+
+// Split Command takes a command as it would be typed into the console
+// and splits it into the lowercase name of the command and the rest of
+// the arguments. The name ends at any whitespace, not only a space, and
+// a namespace like "minecraft:" is taken off so that "minecraft:stop"
+// is matched as "stop".
+func SplitCommand(command string) (string, string) {
+	command = strings.TrimPrefix(strings.TrimSpace(command), "/")
+
+	name, args := command, ""
+	if i := strings.IndexFunc(command, unicode.IsSpace); i >= 0 {
+		name, args = command[:i], strings.TrimSpace(command[i:])
+	}
+
+	name = strings.ToLower(name)
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return name, args
+}
+
+// Check Command checks if a user is allowed to run a command on a
+// server. Every policy for the roles that the user has on the server
+// is checked, and a command is only allowed when at least one policy
+// allows it and none of them deny it. Administrators can run every
+// command. Every denial is logged.
+func CheckCommand(u *User, s *Server, command string) error {
+	name, args := SplitCommand(command)
+
+	var denied error
+	if name == "" {
+		denied = &CommandDeniedError{Command: command, Reason: "no command was given"}
+	} else if !u.Admin {
+		if !u.Can(PermRunCommands, s.Id) {
+			denied = &CommandDeniedError{Command: name, Reason: "you can not run commands on this server"}
+		} else {
+			// Get the ids of every role the user has on this server
+			ids := []uint64{}
+			for _, role := range u.Roles(s.Id) {
+				ids = append(ids, role.Id)
+			}
+
+			var policies []CommandPolicy
+			db.Where("role_id IN (?) AND (server_id = 0 OR server_id = ?)", ids, s.Id).Find(&policies)
+
+			allowed := false
+			for _, p := range policies {
+				if p.Matches(name, args) {
+					if !p.Allow {
+						denied = &CommandDeniedError{Command: name, Reason: "it has been denied for your role"}
+						break
+					}
+
+					allowed = true
+				}
+			}
+
+			if denied == nil && !allowed {
+				denied = &CommandDeniedError{Command: name, Reason: "it has not been allowed for your role"}
+			}
+		}
+	}
+
+	if denied != nil {
+		Warnf("Denied command %q for %s on server %s:%d: %s", command, u.Username, s.Host, s.Port, denied)
+	}
+
+	return denied
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		name    string
+		args    string
+	}{
+		{"stop", "stop", ""},
+		{"/say hello world", "say", "hello world"},
+		{"  KICK  steve  ", "kick", "steve"},
+		{"stop\tnow", "stop", "now"},
+		{"stop\nnow", "stop", "now"},
+		{"minecraft:stop", "stop", ""},
+		{"/Minecraft:Kick steve", "kick", "steve"},
+		{"say a:b", "say", "a:b"},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		name, args := SplitCommand(test.command)
+		if name != test.name || args != test.args {
+			t.Errorf("SplitCommand(%q) = %q, %q, want %q, %q", test.command, name, args, test.name, test.args)
+		}
+	}
+}
+
+func TestCheckCommandDeniesEveryWayOfWritingACommand(t *testing.T) {
+	user := NewTestUser(t, "policy-operator", false)
+	GrantTestRole(t, user, "operator", 0)
+	server := &Server{Id: 1, Host: "localhost", Port: 25575}
+
+	if err := CheckCommand(user, server, "say hello"); err != nil {
+		t.Errorf("say should be allowed for operators: %s", err)
+	}
+
+	for _, command := range []string{"stop", "/stop", "STOP", "minecraft:stop", "stop\t", "\tstop\tnow", "/minecraft:STOP now"} {
+		if err := CheckCommand(user, server, command); err == nil {
+			t.Errorf("%q should be denied for operators", command)
+		}
+	}
+}
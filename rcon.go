@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packet types of the Source RCON protocol, which Minecraft speaks.
+const (
+	rconResponse = 0
+	rconCommand  = 2
+	rconLogin    = 3
+)
+
+// How long to wait for a server to connect or answer before giving up.
+const rconTimeout = 10 * time.Second
+
+// Largest packet that a server is allowed to send back, which is more
+// than Minecraft ever sends in one packet.
+const rconMaxPacket = 1 << 16
+
+// Reasons that an RCON command can fail, other than network errors.
+var (
+	errRconPassword = errors.New("the RCON password was wrong")
+	errRconPacket   = errors.New("the server sent a packet that isn't RCON")
+	errRconClosed   = errors.New("the RCON connection has been closed")
+)
+
+// Rcon is a connection to the RCON port of a Minecraft server. It
+// remembers where it connected to and the password, so a connection
+// that is dropped is made again on the next command, and it keeps the
+// connection itself so that it can be closed. Only one command can be
+// sent at a time.
+type Rcon struct {
+	addr     string
+	password string
+	conn     net.Conn
+	id       int32
+	closed   bool
+}
+
+// Dial Rcon connects to a server and logs in with the password.
+func DialRcon(host string, port int, password string) (*Rcon, error) {
+	r := &Rcon{addr: net.JoinHostPort(host, strconv.Itoa(port)), password: password}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Command runs a command on the server and returns what it said back.
+// If the connection was dropped since the last command then a new one
+// is made first. A command that couldn't be written to an old
+// connection is sent again on a new one, but a command that was written
+// isn't, since it may already have run.
+func (r *Rcon) Command(command string) (string, error) {
+	if r.closed {
+		return "", errRconClosed
+	}
+
+	old := r.conn != nil
+	id, err := r.send(command)
+	if err != nil && old {
+		r.drop()
+		id, err = r.send(command)
+	}
+
+	if err != nil {
+		r.drop()
+		return "", err
+	}
+
+	answer, err := r.answer(id)
+	if err != nil {
+		r.drop()
+	}
+
+	return answer, err
+}
+
+// Close closes the connection to the server for good, so that it isn't
+// made again by the next command.
+func (r *Rcon) Close() error {
+	r.closed = true
+	if r.conn == nil {
+		return nil
+	}
+
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// Connect makes a new connection to the server and logs in.
+func (r *Rcon) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, rconTimeout)
+	if err != nil {
+		return err
+	}
+
+	r.conn = conn
+	id, err := r.write(rconLogin, r.password)
+	if err == nil {
+		var answer int32
+		answer, _, err = r.read()
+
+		// Servers answer a login with the id of the request, or -1 if
+		// the password was wrong
+		if err == nil && answer == -1 {
+			err = errRconPassword
+		} else if err == nil && answer != id {
+			err = errRconPacket
+		}
+	}
+
+	if err != nil {
+		r.drop()
+	}
+
+	return err
+}
+
+// Drop closes the connection so that the next command makes a new one.
+func (r *Rcon) drop() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// Send writes a command, connecting first if there is no connection,
+// and returns the id of the command. An empty packet is written after
+// the command, which the server only answers once it has answered the
+// command, so that answers that take more than one packet can be read
+// to the end.
+func (r *Rcon) send(command string) (int32, error) {
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := r.write(rconCommand, command)
+	if err == nil {
+		_, err = r.write(rconResponse, "")
+	}
+
+	return id, err
+}
+
+// Answer reads the packets that answer the command with the id, until
+// the answer to the empty packet after it.
+func (r *Rcon) answer(id int32) (string, error) {
+	var answer strings.Builder
+	for {
+		packet, body, err := r.read()
+		if err != nil {
+			return "", err
+		}
+
+		switch packet {
+		case id:
+			answer.WriteString(body)
+		case id + 1:
+			return answer.String(), nil
+		default:
+			return "", errRconPacket
+		}
+	}
+}
+
+// Write writes one packet and returns its id. A packet is its length,
+// an id, a type and a body that ends with two null bytes, and the
+// length doesn't count itself.
+func (r *Rcon) write(kind int32, body string) (int32, error) {
+	r.id++
+	r.conn.SetDeadline(time.Now().Add(rconTimeout))
+
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&packet, binary.LittleEndian, r.id)
+	binary.Write(&packet, binary.LittleEndian, kind)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	_, err := r.conn.Write(packet.Bytes())
+	return r.id, err
+}
+
+// Read reads one packet and returns its id and body.
+func (r *Rcon) read() (int32, string, error) {
+	var length int32
+	if err := binary.Read(r.conn, binary.LittleEndian, &length); err != nil {
+		return 0, "", err
+	}
+
+	if length < 10 || length > rconMaxPacket {
+		return 0, "", errRconPacket
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r.conn, packet); err != nil {
+		return 0, "", err
+	}
+
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	return id, string(packet[8 : length-2]), nil
+}
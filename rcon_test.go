@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start Test Rcon starts an RCON server that accepts the password and
+// answers every command with "ran " and the command, in packets of at
+// most 4096 bytes like Minecraft. The command "drop" closes the
+// connection without an answer. Packets are written in pieces, so
+// commands that are sent at the same time on one connection would get
+// each other's answers.
+func StartTestRcon(t *testing.T, password string) (string, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go ServeTestRcon(conn, password)
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// Serve Test Rcon answers the packets on one RCON connection.
+func ServeTestRcon(conn net.Conn, password string) {
+	defer conn.Close()
+
+	for {
+		var length, id, kind int32
+		if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+			return
+		}
+
+		binary.Read(conn, binary.LittleEndian, &id)
+		binary.Read(conn, binary.LittleEndian, &kind)
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		text := string(bytes.TrimRight(body, "\x00"))
+		switch kind {
+		case rconLogin:
+			if text != password {
+				id = -1
+			}
+
+			WriteTestRcon(conn, id, rconCommand, "")
+		case rconCommand:
+			if text == "drop" {
+				return
+			}
+
+			answer := "ran " + text
+			for len(answer) > 4096 {
+				WriteTestRcon(conn, id, rconResponse, answer[:4096])
+				answer = answer[4096:]
+			}
+
+			WriteTestRcon(conn, id, rconResponse, answer)
+		default:
+			WriteTestRcon(conn, id, rconResponse, "Unknown request 0")
+		}
+	}
+}
+
+// Write Test Rcon writes one packet in two pieces.
+func WriteTestRcon(conn net.Conn, id int32, kind int32, body string) {
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, kind)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	half := packet.Len() / 2
+	conn.Write(packet.Bytes()[:half])
+	time.Sleep(time.Millisecond)
+	conn.Write(packet.Bytes()[half:])
+}
+
+func TestRconWritesPackets(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := &Rcon{conn: client}
+	go r.write(rconCommand, "list")
+
+	packet := make([]byte, 18)
+	if _, err := io.ReadFull(server, packet); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{14, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 'l', 'i', 's', 't', 0, 0}
+	if !bytes.Equal(packet, want) {
+		t.Errorf("wrote % x, want % x", packet, want)
+	}
+}
+
+func TestRconRejectsPacketsThatArentRcon(t *testing.T) {
+	for _, length := range []int32{4, rconMaxPacket + 1} {
+		client, server := net.Pipe()
+		go binary.Write(server, binary.LittleEndian, length)
+
+		r := &Rcon{conn: client}
+		if _, _, err := r.read(); err != errRconPacket {
+			t.Errorf("reading a packet of length %d returned %v, want %v", length, err, errRconPacket)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDialRconChecksThePassword(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+
+	if _, err := DialRcon(host, port, "wrong"); err != errRconPassword {
+		t.Errorf("logging in with the wrong password returned %v, want %v", err, errRconPassword)
+	}
+
+	rcon, err := DialRcon(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rcon.Close()
+
+	answer, err := rcon.Command("list")
+	if err != nil || answer != "ran list" {
+		t.Errorf("Command(list) = %q, %v", answer, err)
+	}
+}
+
+func TestRconJoinsAnswersThatTakeMoreThanOnePacket(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+	rcon, err := DialRcon(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rcon.Close()
+
+	command := "say " + strings.Repeat("a", 10000)
+	answer, err := rcon.Command(command)
+	if err != nil || answer != "ran "+command {
+		t.Errorf("a long answer came back with %d characters and %v, want %d", len(answer), err, len("ran "+command))
+	}
+
+	// The next answer isn't mixed up with the last one
+	if answer, err := rcon.Command("list"); err != nil || answer != "ran list" {
+		t.Errorf("Command(list) = %q, %v", answer, err)
+	}
+}
+
+func TestRconConnectsAgainAfterTheConnectionIsDropped(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+	rcon, err := DialRcon(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rcon.Close()
+
+	if _, err := rcon.Command("drop"); err == nil {
+		t.Error("a command that was never answered should fail")
+	}
+
+	if answer, err := rcon.Command("list"); err != nil || answer != "ran list" {
+		t.Errorf("Command(list) after the connection was dropped = %q, %v", answer, err)
+	}
+
+	// A connection that went away while nothing was sent is made again
+	// too, without losing the command
+	rcon.conn.Close()
+	if answer, err := rcon.Command("list"); err != nil || answer != "ran list" {
+		t.Errorf("Command(list) on a closed connection = %q, %v", answer, err)
+	}
+}
+
+func TestRconCloseStopsConnectingAgain(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+	rcon, err := DialRcon(host, port, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcon.Close()
+	if _, err := rcon.Command("list"); err != errRconClosed {
+		t.Errorf("a command after closing returned %v, want %v", err, errRconClosed)
+	}
+}
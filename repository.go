@@ -0,0 +1,288 @@
+package main
+
+import (
+	"sync"
+)
+
+// UserRepository keeps every user in memory so that they don't have to
+// be loaded from the database on each request. Handlers add and remove
+// users while other requests look them up, so the list is guarded by a
+// lock and only ever handed out as a copy.
+//
+// Users that are handed out are never changed either, since other
+// requests may be reading them. Changes are made with Update, which
+// swaps in a changed copy of the user.
+type UserRepository struct {
+	lock sync.RWMutex
+	list []*User
+}
+
+// Load replaces the users in the repository with every user in the
+// database.
+func (r *UserRepository) Load() {
+	var list []*User
+	db.Find(&list, &User{})
+
+	r.lock.Lock()
+	r.list = list
+	r.lock.Unlock()
+}
+
+// All returns a copy of the list of users, which can be looped through
+// while users are added or removed.
+func (r *UserRepository) All() []*User {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	list := make([]*User, len(r.list))
+	copy(list, r.list)
+	return list
+}
+
+// Count returns how many users there are.
+func (r *UserRepository) Count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.list)
+}
+
+// Find returns the user that matches the id, or nil if there is no such
+// user.
+func (r *UserRepository) Find(id uint64) *User {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, user := range r.list {
+		if user.Id == id {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// Find By Username returns the user that matches the username, or nil if
+// there is no such user.
+func (r *UserRepository) FindByUsername(username string) *User {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, user := range r.list {
+		if user.Username == username {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// Find By Subject returns the user that an OIDC issuer knows by the
+// subject, or nil if there is no such user.
+func (r *UserRepository) FindBySubject(issuer string, subject string) *User {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, user := range r.list {
+		if user.Source == "oidc" && user.Issuer == issuer && user.Subject == subject {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// Update changes a copy of the user with the id and puts the copy in
+// place of the user, so that anyone that is still reading the old user
+// never sees it change. The changed user is returned, or nil if there is
+// no such user.
+func (r *UserRepository) Update(id uint64, change func(*User)) *User {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, user := range r.list {
+		if user.Id == id {
+			changed := *user
+			change(&changed)
+
+			// Copy into a new slice so that copies handed out by All
+			// are never changed underneath whoever is using them.
+			list := make([]*User, len(r.list))
+			copy(list, r.list)
+			list[i] = &changed
+			r.list = list
+			return &changed
+		}
+	}
+
+	return nil
+}
+
+// Add puts a user that has been saved to the database in the repository.
+func (r *UserRepository) Add(user *User) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.list = append(r.list, user)
+}
+
+// Remove takes the user with the id out of the repository. The user
+// that was removed is returned, or nil if there was no such user.
+func (r *UserRepository) Remove(id uint64) *User {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, user := range r.list {
+		if user.Id == id {
+			// Copy into a new slice so that copies handed out by All
+			// are never changed underneath whoever is using them.
+			list := make([]*User, 0, len(r.list)-1)
+			list = append(list, r.list[:i]...)
+			r.list = append(list, r.list[i+1:]...)
+			return user
+		}
+	}
+
+	return nil
+}
+
+// RoleRepository keeps every role in memory, since they are looked up
+// whenever a permission is checked. Like users, the list is guarded by a
+// lock and only ever handed out as a copy.
+type RoleRepository struct {
+	lock sync.RWMutex
+	list []*Role
+}
+
+// Load replaces the roles in the repository with every role in the
+// database.
+func (r *RoleRepository) Load() {
+	var list []*Role
+	db.Find(&list, &Role{})
+
+	r.lock.Lock()
+	r.list = list
+	r.lock.Unlock()
+}
+
+// All returns a copy of the list of roles.
+func (r *RoleRepository) All() []*Role {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	list := make([]*Role, len(r.list))
+	copy(list, r.list)
+	return list
+}
+
+// Find returns the role that matches the id, or nil if there is no such
+// role.
+func (r *RoleRepository) Find(id uint64) *Role {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, role := range r.list {
+		if role.Id == id {
+			return role
+		}
+	}
+
+	return nil
+}
+
+// Find By Name returns the role that matches the name, or nil if there
+// is no such role.
+func (r *RoleRepository) FindByName(name string) *Role {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, role := range r.list {
+		if role.Name == name {
+			return role
+		}
+	}
+
+	return nil
+}
+
+// ServerRepository keeps every server in memory along with its RCON
+// connection. Like users, the list is guarded by a lock and only ever
+// handed out as a copy.
+type ServerRepository struct {
+	lock sync.RWMutex
+	list []*Server
+}
+
+// Load replaces the servers in the repository with every server in the
+// database, and connects to each of them. The connections of the
+// servers that were replaced are closed.
+func (r *ServerRepository) Load() {
+	var list []*Server
+	db.Find(&list, &Server{})
+
+	for _, server := range list {
+		server.initalizeRcon()
+	}
+
+	r.lock.Lock()
+	old := r.list
+	r.list = list
+	r.lock.Unlock()
+
+	for _, server := range old {
+		server.Close()
+	}
+}
+
+// All returns a copy of the list of servers, which can be looped through
+// while servers are added or removed.
+func (r *ServerRepository) All() []*Server {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	list := make([]*Server, len(r.list))
+	copy(list, r.list)
+	return list
+}
+
+// Find returns the server that matches the id, or nil if there is no
+// such server.
+func (r *ServerRepository) Find(id uint64) *Server {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, server := range r.list {
+		if server.Id == id {
+			return server
+		}
+	}
+
+	return nil
+}
+
+// Add puts a server that has been saved to the database in the
+// repository.
+func (r *ServerRepository) Add(server *Server) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.list = append(r.list, server)
+}
+
+// Remove takes the server with the id out of the repository. The server
+// that was removed is returned, or nil if there was no such server.
+func (r *ServerRepository) Remove(id uint64) *Server {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, server := range r.list {
+		if server.Id == id {
+			list := make([]*Server, 0, len(r.list)-1)
+			list = append(list, r.list[:i]...)
+			r.list = append(list, r.list[i+1:]...)
+			return server
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// Log In Test User saves a session for the user and returns its cookies,
+// which can be added to requests to make them from the user.
+func LogInTestUser(t *testing.T, user *User) []*http.Cookie {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(req, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.Values["user_id"] = user.Id
+	session.Values["stamp"] = user.SecurityStamp
+
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, session); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Result().Cookies()
+}
+
+func TestUsersCanBeChangedWhileTheyAreRead(t *testing.T) {
+	user := NewTestUser(t, "repository-race", true)
+	cookies := LogInTestUser(t, user)
+
+	request := func(req *http.Request) *http.Request {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+
+		return req
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(2)
+
+		// Change the user every way that a handler can
+		go func(i int) {
+			defer wait.Done()
+
+			email := fmt.Sprintf("race-%d@example.com", i)
+			HandleUpdateSettings(httptest.NewRecorder(), request(NewTestForm("/settings", url.Values{"email": {email}})))
+			RecordLogin(httptest.NewRequest("POST", "/login", nil), user)
+			HandleUserAdminSwitch(httptest.NewRecorder(), request(NewTestForm("/users/admin", url.Values{"id": {fmt.Sprint(user.Id)}})))
+			InvalidateSessions(httptest.NewRecorder(), request(httptest.NewRequest("GET", "/", nil)), user)
+			roles.Load()
+		}(i)
+
+		// And read it at the same time
+		go func() {
+			defer wait.Done()
+
+			req := request(httptest.NewRequest("GET", "/", nil))
+			if me := WhoAmI(req); me != nil {
+				me.Can(PermViewConsole, 0)
+			}
+
+			if found := FindUserByUsername("repository-race"); found != nil {
+				_ = found.Email + found.LastLoginIp
+				found.Can(PermManageUsers, 0)
+			}
+
+			IsLoggedIn(httptest.NewRecorder(), req)
+		}()
+	}
+
+	wait.Wait()
+
+	// The user that was handed out at the start was never changed
+	if user.Email != "" || !user.LastLoginAt.IsZero() || !user.Admin {
+		t.Error("a user that was handed out should not be changed")
+	}
+
+	if found := FindUser(user.Id); found == nil || found.LastLoginAt.IsZero() || found.SecurityStamp == user.SecurityStamp {
+		t.Error("the user in memory should have the changes")
+	}
+}
+
+func TestUserRepositoryUpdate(t *testing.T) {
+	user := NewTestUser(t, "repository-update", false)
+	all := users.All()
+
+	changed := users.Update(user.Id, func(v *User) {
+		v.Email = "update@example.com"
+	})
+
+	if changed == nil || changed == user || changed.Email != "update@example.com" {
+		t.Fatalf("Update returned %v, want a changed copy", changed)
+	}
+
+	if FindUser(user.Id) != changed || user.Email != "" {
+		t.Error("the copy should take the place of the user without changing it")
+	}
+
+	for _, v := range all {
+		if v == changed {
+			t.Error("a list that was handed out should not be changed")
+		}
+	}
+
+	if users.Update(999999, func(v *User) {}) != nil {
+		t.Error("updating a missing user should return nil")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Permission is a single thing that a user is allowed to do. Permissions
+// are never given to users directly, they are grouped together in a Role
+// and the Role is granted to the user.
+type Permission string
+
+const (
+	// PermViewConsole allows a user to view a server's console.
+	PermViewConsole Permission = "console.view"
+
+	// PermRunCommands allows a user to send commands to a server.
+	PermRunCommands Permission = "console.command"
+
+	// PermManagePlayers allows a user to kick, ban and whitelist players.
+	PermManagePlayers Permission = "players.manage"
+
+	// PermManageBackups allows a user to create and restore backups.
+	PermManageBackups Permission = "backups.manage"
+
+	// PermManageUsers allows a user to create, delete and change the
+	// roles of other users. Only administrators can make administrators
+	// or change them, so it can't be used to take over an administrator.
+	PermManageUsers Permission = "users.manage"
+)
+
+// Permissions is a list of every permission that Sorbet knows about.
+var Permissions = []Permission{
+	PermViewConsole,
+	PermRunCommands,
+	PermManagePlayers,
+	PermManageBackups,
+	PermManageUsers,
+}
+
+type Role struct {
+	// Id is a uint64 that is the role's identification number.
+	Id uint64
+
+	// Name is a string with max-size set to 255 and is the
+	// name that the role is displayed as.
+	Name string `sql:"size:255;unique"`
+
+	// Permissions is a comma separated list of every permission
+	// that is given to a user that has this role.
+	Permissions string `sql:"size:255"`
+
+	// CreatedAt is a timestamp of when the specific
+	// role was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// role was last updated at.
+	UpdatedAt time.Time
+}
+
+type RoleGrant struct {
+	// Id is a uint64 that is the grant's identification number.
+	Id uint64
+
+	// UserId is the id of the user that has been granted the role.
+	UserId uint64
+
+	// RoleId is the id of the role that has been granted.
+	RoleId uint64
+
+	// ServerId is the id of the server that the role has been
+	// granted on. If ServerId is 0 then the role has been granted
+	// globally and applies to every server.
+	ServerId uint64
+
+	// CreatedAt is a timestamp of when the specific
+	// grant was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// grant was last updated at.
+	UpdatedAt time.Time
+}
+
+// Default roles are created when the database is initialized if
+// they do not exist yet.
+var defaultRoles = []Role{
+	{
+		Name:        "viewer",
+		Permissions: JoinPermissions(PermViewConsole),
+	},
+	{
+		Name:        "moderator",
+		Permissions: JoinPermissions(PermViewConsole, PermRunCommands, PermManagePlayers),
+	},
+	{
+		Name:        "operator",
+		Permissions: JoinPermissions(PermViewConsole, PermRunCommands, PermManagePlayers, PermManageBackups),
+	},
+	{
+		Name:        "admin",
+		Permissions: JoinPermissions(Permissions...),
+	},
+}
+
+// Join Permissions takes a list of permissions and turns them into a
+// comma separated string that can be stored on a Role.
+func JoinPermissions(perms ...Permission) string {
+	list := make([]string, len(perms))
+	for i, p := range perms {
+		list[i] = string(p)
+	}
+
+	return strings.Join(list, ",")
+}
+
+// Has checks if the role contains a specific permission.
+func (r *Role) Has(perm Permission) bool {
+	for _, p := range strings.Split(r.Permissions, ",") {
+		if Permission(strings.TrimSpace(p)) == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find Role returns the *Role from the slice of roles that we have
+// that matches the id, or nil if there is no such role.
+func FindRole(id uint64) *Role {
+	return roles.Find(id)
+}
+
+// Find Role By Name returns the *Role from the slice of roles that we
+// have that matches the name, or nil if there is no such role.
+func FindRoleByName(name string) *Role {
+	return roles.FindByName(name)
+}
+
+// Find User returns the *User from the slice of users that we have
+// that matches the id, or nil if there is no such user.
+func FindUser(id uint64) *User {
+	return users.Find(id)
+}
+
+// Find Server returns the *Server from the slice of servers that we
+// have that matches the id, or nil if there is no such server.
+func FindServer(id uint64) *Server {
+	return servers.Find(id)
+}
+
+// User returns the user that the role has been granted to.
+func (g *RoleGrant) User() *User {
+	return FindUser(g.UserId)
+}
+
+// Role returns the role that has been granted.
+func (g *RoleGrant) Role() *Role {
+	return FindRole(g.RoleId)
+}
+
+// Server returns the server that the role has been granted on, or
+// nil if the role has been granted globally.
+func (g *RoleGrant) Server() *Server {
+	return FindServer(g.ServerId)
+}
+
+// Roles returns every role that has been granted to the user, either
+// globally or on the server with the given id. If the server id is 0
+// then only the roles that have been granted globally are returned.
+func (u *User) Roles(server uint64) []*Role {
+	var grants []RoleGrant
+	db.Where("user_id = ? AND (server_id = 0 OR server_id = ?)", u.Id, server).Find(&grants)
+
+	list := []*Role{}
+	for _, g := range grants {
+		if role := FindRole(g.RoleId); role != nil {
+			list = append(list, role)
+		}
+	}
+
+	return list
+}
+
+// Can checks if the user has been granted a permission either globally
+// or on the server with the given id. Administrators can do everything.
+func (u *User) Can(perm Permission, server uint64) bool {
+	if u.Admin {
+		return true
+	}
+
+	for _, role := range u.Roles(server) {
+		if role.Has(perm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Can Manage checks if the user is allowed to change another user.
+// Administrators can change everyone, but users who can only manage
+// users can't change administrators, or they could take over their
+// accounts. A user that has been logged out can't change anyone.
+func (u *User) CanManage(other *User) bool {
+	return u != nil && (u.Admin || !other.Admin)
+}
+
+// Request Server Id returns the id of the server that the request is
+// for, which is taken from the "server" route variable. If the route
+// does not have a server then 0 is returned.
+func RequestServerId(req *http.Request) uint64 {
+	id, err := strconv.ParseUint(mux.Vars(req)["server"], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// Require Permission wraps a handler so that it is only ran if the
+// current user is logged in and has been granted the permission, either
+// globally or on the server that the request is for. Users that are not
+// logged in are sent to "/login" and users without the permission are
+// sent back to "/".
+func RequirePermission(perm Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !IsLoggedIn(w, req) {
+			http.Redirect(w, req, "/login", http.StatusSeeOther)
+		} else if !WhoAmI(req).Can(perm, RequestServerId(req)) {
+			http.Redirect(w, req, "/", http.StatusSeeOther)
+		} else {
+			handler(w, req)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Secrets that are encrypted start with this, followed by the id of the
+// master key, the wrapped data key and the sealed secret, separated by
+// colons. Anything else is a secret from before they were encrypted.
+const secretPrefix = "enc:v1:"
+
+// Additional data that every sealed secret is bound to, so ciphertext
+// from anywhere else can't be passed off as a server password.
+var secretData = []byte("sorbet server secret")
+
+var (
+	// Master keys that data keys are wrapped with. The first key is
+	// used for new secrets and the rest are only used to unwrap data
+	// keys that were wrapped before a rotation.
+	masterKeys [][]byte
+
+	// Lock for the master keys, which are loaded again on SIGHUP.
+	masterKeysLock sync.RWMutex
+)
+
+// Initalize Secrets loads the master keys. They come from the master key
+// flags if one was given, otherwise from the master key file, which is
+// created with a new key the first time Sorbet starts.
+func initalizeSecrets() {
+	keys, err := LoadMasterKeys()
+	if err == nil && len(keys) == 0 {
+		if *debugFlag {
+			Verb("Generating a new master key")
+		}
+
+		keys = [][]byte{securecookie.GenerateRandomKey(32)}
+		err = SaveMasterKeys(*masterKeyFileFlag, keys)
+	}
+
+	if err != nil {
+		Warnf("Error loading master keys: %s", err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+
+	SetMasterKeys(keys)
+}
+
+// Reload Secrets loads the master keys again, which is needed after they
+// have been rotated. The keys that are loaded are kept if it fails.
+func ReloadSecrets() {
+	keys, err := LoadMasterKeys()
+	if err != nil || len(keys) == 0 {
+		Warnf("Error reloading master keys, still using the old ones: %v", err)
+	} else {
+		SetMasterKeys(keys)
+	}
+}
+
+// Load Master Keys reads the master keys from the flags, or from the
+// master key file if no key was given as a flag. No keys are returned
+// if the file doesn't exist yet.
+func LoadMasterKeys() ([][]byte, error) {
+	if *masterKeyFlag == "" {
+		return LoadMasterKeyFile(*masterKeyFileFlag)
+	}
+
+	keys := [][]byte{}
+	for _, encoded := range append([]string{*masterKeyFlag}, strings.Split(*oldMasterKeysFlag, ",")...) {
+		if encoded = strings.TrimSpace(encoded); encoded != "" {
+			key, err := DecodeMasterKey(encoded)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Load Master Key File reads one base64 encoded key from each line of a
+// key file. If the file doesn't exist then no keys are returned.
+func LoadMasterKeyFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := [][]byte{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := DecodeMasterKey(line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
+
+// Save Master Keys writes the keys to a key file that only the current
+// user can read.
+func SaveMasterKeys(path string, keys [][]byte) error {
+	lines := []string{"# Sorbet master keys. The first key is used for new secrets."}
+	for _, key := range keys {
+		lines = append(lines, base64.StdEncoding.EncodeToString(key))
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// Decode Master Key decodes a base64 encoded 32 byte master key.
+func DecodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("master keys have to be base64 encoded")
+	} else if len(key) != 32 {
+		return nil, fmt.Errorf("master keys have to be 32 bytes, not %d", len(key))
+	}
+
+	return key, nil
+}
+
+// New Master Key returns a new random master key, base64 encoded.
+func NewMasterKey() string {
+	return base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// Set Master Keys replaces the master keys that are used.
+func SetMasterKeys(keys [][]byte) {
+	masterKeysLock.Lock()
+	masterKeys = keys
+	masterKeysLock.Unlock()
+}
+
+// Master Key Id returns a short id for a key, which is saved with each
+// secret so we know which key to unwrap its data key with.
+func MasterKeyId(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// Seal encrypts data with AES-256-GCM. The random nonce is put in front
+// of the ciphertext.
+func Seal(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := securecookie.GenerateRandomKey(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, data, secretData), nil
+}
+
+// Open decrypts data that was encrypted with Seal.
+func Open(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secret is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], secretData)
+}
+
+// Encrypt Secret encrypts a secret with a new random data key, and wraps
+// the data key with the current master key. The result is what is saved
+// in the database.
+func EncryptSecret(secret string) (string, error) {
+	dataKey := securecookie.GenerateRandomKey(32)
+	sealed, err := Seal(dataKey, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+
+	return WrapSecret(dataKey, sealed)
+}
+
+// Decrypt Secret decrypts a secret that was encrypted with Encrypt
+// Secret. Secrets from before they were encrypted are returned as they
+// are.
+func DecryptSecret(stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return stored, nil
+	}
+
+	dataKey, sealed, err := UnwrapSecret(stored)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := Open(dataKey, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// Rewrap Secret wraps the data key of a secret with the current master
+// key, without decrypting the secret itself. Secrets from before they
+// were encrypted are encrypted.
+func RewrapSecret(stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return EncryptSecret(stored)
+	}
+
+	dataKey, sealed, err := UnwrapSecret(stored)
+	if err != nil {
+		return "", err
+	}
+
+	return WrapSecret(dataKey, sealed)
+}
+
+// Wrap Secret wraps a data key with the current master key and puts it
+// together with the secret that was sealed with it.
+func WrapSecret(dataKey []byte, sealed []byte) (string, error) {
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+
+	if len(masterKeys) == 0 {
+		return "", errors.New("there is no master key")
+	}
+
+	wrapped, err := Seal(masterKeys[0], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return secretPrefix + MasterKeyId(masterKeys[0]) + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap Secret splits an encrypted secret up and unwraps its data key
+// with the master key that it was wrapped with. The data key and the
+// sealed secret are returned.
+func UnwrapSecret(stored string) ([]byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, secretPrefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("secret is not in a format that is known")
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	masterKeysLock.RLock()
+	defer masterKeysLock.RUnlock()
+
+	for _, key := range masterKeys {
+		if MasterKeyId(key) == parts[0] {
+			dataKey, err := Open(key, wrapped)
+			return dataKey, sealed, err
+		}
+	}
+
+	return nil, nil, fmt.Errorf("secret was encrypted with master key %s, which is not loaded", parts[0])
+}
+
+// Secret Master Key Id returns the id of the master key that a secret
+// from the database was wrapped with, or a blank id if it isn't
+// encrypted.
+func SecretMasterKeyId(stored string) string {
+	if !IsEncrypted(stored) {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimPrefix(stored, secretPrefix), ":", 2)[0]
+}
+
+// Is Encrypted checks if a secret from the database is encrypted.
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, secretPrefix)
+}
+
+// Rewrap Server Secrets encrypts or rewraps the password of every
+// server with the current master key. The number of passwords that were
+// changed is returned.
+func RewrapServerSecrets(tx *gorm.DB) (int, error) {
+	var list []*Server
+	if err := tx.Find(&list).Error; err != nil {
+		return 0, err
+	}
+
+	for _, server := range list {
+		password, err := RewrapSecret(server.Password)
+		if err != nil {
+			return 0, fmt.Errorf("server %s: %s", server, err)
+		}
+
+		if err := tx.Table("servers").Where("id = ?", server.Id).UpdateColumn("password", password).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	return len(list), nil
+}
+
+// Decrypt Server Secrets turns every server password back into
+// plaintext, which undoes encrypting them.
+func DecryptServerSecrets(tx *gorm.DB) error {
+	var list []*Server
+	if err := tx.Find(&list).Error; err != nil {
+		return err
+	}
+
+	for _, server := range list {
+		password, err := DecryptSecret(server.Password)
+		if err != nil {
+			return fmt.Errorf("server %s: %s", server, err)
+		}
+
+		if err := tx.Table("servers").Where("id = ?", server.Id).UpdateColumn("password", password).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/securecookie"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Use Test Master Keys keeps the master keys in a new key file until the
+// test is over, and returns the keys, which are made if none are given.
+func UseTestMasterKeys(t *testing.T, keys ...[]byte) [][]byte {
+	t.Helper()
+
+	if len(keys) == 0 {
+		keys = [][]byte{securecookie.GenerateRandomKey(32)}
+	}
+
+	masterKeysLock.RLock()
+	old := masterKeys
+	masterKeysLock.RUnlock()
+
+	oldFile, oldFlag := *masterKeyFileFlag, *masterKeyFlag
+	t.Cleanup(func() {
+		SetMasterKeys(old)
+		*masterKeyFileFlag, *masterKeyFlag = oldFile, oldFlag
+	})
+
+	*masterKeyFileFlag = filepath.Join(t.TempDir(), "sorbet.master.key")
+	*masterKeyFlag = ""
+	if err := SaveMasterKeys(*masterKeyFileFlag, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	SetMasterKeys(keys)
+	return keys
+}
+
+// Load Test Master Keys returns the keys that are in the key file.
+func LoadTestMasterKeys(t *testing.T) [][]byte {
+	t.Helper()
+
+	keys, err := LoadMasterKeyFile(*masterKeyFileFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+// Use Test Servers migrates a new database and adds a server with each
+// of the passwords to it.
+func UseTestServers(t *testing.T, passwords ...string) {
+	t.Helper()
+
+	UseTestDatabase(t, "sqlite3", "")
+	if err := MigrateUp(LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, password := range passwords {
+		if err := db.Create(&Server{Host: "localhost", Port: 25575 + i, Password: password}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Saved Server Passwords returns the passwords of every server as they
+// are saved in the database.
+func SavedServerPasswords(t *testing.T) []string {
+	t.Helper()
+
+	var list []*Server
+	db.Order("id").Find(&list)
+
+	passwords := []string{}
+	for _, server := range list {
+		passwords = append(passwords, server.Password)
+	}
+
+	return passwords
+}
+
+func TestEncryptSecretRoundTrips(t *testing.T) {
+	UseTestMasterKeys(t)
+
+	first, err := EncryptSecret("rcon-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := EncryptSecret("rcon-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsEncrypted(first) || strings.Contains(first, "rcon-password") {
+		t.Errorf("%q doesn't look encrypted", first)
+	}
+
+	if first == second {
+		t.Error("encrypting the same secret twice gave the same result")
+	}
+
+	for _, stored := range []string{first, second} {
+		if secret, err := DecryptSecret(stored); err != nil || secret != "rcon-password" {
+			t.Errorf("%q decrypts to %q, %v", stored, secret, err)
+		}
+	}
+
+	// Passwords from before they were encrypted are used as they are
+	if secret, err := DecryptSecret("plain"); err != nil || secret != "plain" {
+		t.Errorf("a plaintext password decrypts to %q, %v", secret, err)
+	}
+}
+
+func TestDecryptSecretNeedsTheRightKey(t *testing.T) {
+	UseTestMasterKeys(t)
+
+	stored, err := EncryptSecret("rcon-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tampered secret is refused
+	tampered := stored[:len(stored)-2] + "AA"
+	if tampered == stored {
+		tampered = stored[:len(stored)-2] + "BB"
+	}
+
+	if _, err := DecryptSecret(tampered); err == nil {
+		t.Error("a secret that was changed could be decrypted")
+	}
+
+	if _, err := DecryptSecret(secretPrefix + "nonsense"); err == nil {
+		t.Error("a secret in a format that isn't known could be decrypted")
+	}
+
+	sealed, err := Seal(securecookie.GenerateRandomKey(32), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(securecookie.GenerateRandomKey(32), sealed); err == nil {
+		t.Error("data that was sealed with another key could be opened")
+	}
+
+	// Without the master key that it was wrapped with there is nothing
+	// to decrypt it with
+	SetMasterKeys([][]byte{securecookie.GenerateRandomKey(32)})
+	if _, err := DecryptSecret(stored); err == nil {
+		t.Error("a secret could be decrypted without its master key")
+	}
+}
+
+func TestRewrapSecretKeepsTheSecret(t *testing.T) {
+	keys := UseTestMasterKeys(t)
+
+	stored, err := EncryptSecret("rcon-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the data key is wrapped again, the sealed secret stays
+	newKey := securecookie.GenerateRandomKey(32)
+	SetMasterKeys([][]byte{newKey, keys[0]})
+
+	rewrapped, err := RewrapSecret(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := SecretMasterKeyId(rewrapped); id != MasterKeyId(newKey) {
+		t.Errorf("the secret is wrapped with %s, want the new key %s", id, MasterKeyId(newKey))
+	}
+
+	sealed := func(stored string) string { return stored[strings.LastIndex(stored, ":"):] }
+	if sealed(rewrapped) != sealed(stored) {
+		t.Error("rewrapping encrypted the secret again")
+	}
+
+	SetMasterKeys([][]byte{newKey})
+	if secret, err := DecryptSecret(rewrapped); err != nil || secret != "rcon-password" {
+		t.Errorf("the rewrapped secret decrypts to %q, %v", secret, err)
+	}
+
+	// Plaintext is encrypted
+	if encrypted, err := RewrapSecret("plain"); err != nil || !IsEncrypted(encrypted) {
+		t.Errorf("rewrapping a plaintext password gave %q, %v", encrypted, err)
+	}
+}
+
+func TestRewrapServerSecrets(t *testing.T) {
+	keys := UseTestMasterKeys(t)
+
+	encrypted, err := EncryptSecret("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UseTestServers(t, "first", encrypted)
+
+	newKey := securecookie.GenerateRandomKey(32)
+	SetMasterKeys([][]byte{newKey, keys[0]})
+
+	if count, err := RewrapServerSecrets(db); err != nil || count != 2 {
+		t.Fatalf("rewrapped %d passwords, %v, want 2", count, err)
+	}
+
+	SetMasterKeys([][]byte{newKey})
+	for i, stored := range SavedServerPasswords(t) {
+		want := []string{"first", "second"}[i]
+		if SecretMasterKeyId(stored) != MasterKeyId(newKey) {
+			t.Errorf("the password of server %d isn't wrapped with the new key", i+1)
+		} else if secret, err := DecryptSecret(stored); err != nil || secret != want {
+			t.Errorf("the password of server %d decrypts to %q, %v, want %q", i+1, secret, err, want)
+		}
+	}
+
+	if err := DecryptServerSecrets(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if passwords := SavedServerPasswords(t); passwords[0] != "first" || passwords[1] != "second" {
+		t.Errorf("decrypting the passwords gave %v", passwords)
+	}
+}
+
+func TestSecretsRotateKeepsOldKeysUntilTheyArePruned(t *testing.T) {
+	keys := UseTestMasterKeys(t)
+
+	encrypted, err := EncryptSecret("rcon-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UseTestServers(t, encrypted)
+
+	if err := SecretsCommand([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := LoadTestMasterKeys(t)
+	if len(rotated) != 2 || !bytes.Equal(rotated[1], keys[0]) {
+		t.Fatalf("the key file has %d keys after rotating, want the new key and the old one", len(rotated))
+	}
+
+	if id := SecretMasterKeyId(SavedServerPasswords(t)[0]); id != MasterKeyId(rotated[0]) {
+		t.Errorf("the password is wrapped with %s, want the new key %s", id, MasterKeyId(rotated[0]))
+	}
+
+	// A Sorbet that is still running with the old key saves a password
+	SetMasterKeys(keys)
+	stale, err := EncryptSecret("stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Create(&Server{Host: "stale", Port: 25575, Password: stale})
+
+	if err := SecretsCommand([]string{"prune"}); err == nil {
+		t.Fatal("pruning while a password is wrapped with an old key should be an error")
+	}
+
+	if len(LoadTestMasterKeys(t)) != 2 {
+		t.Error("pruning that failed removed keys")
+	}
+
+	// Once it is reloaded, rotating again picks the password up
+	SetMasterKeys(LoadTestMasterKeys(t))
+	if err := SecretsCommand([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SecretsCommand([]string{"prune"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned := LoadTestMasterKeys(t)
+	if len(pruned) != 1 {
+		t.Fatalf("the key file has %d keys after pruning, want 1", len(pruned))
+	}
+
+	SetMasterKeys(pruned)
+	for i, stored := range SavedServerPasswords(t) {
+		want := []string{"rcon-password", "stale"}[i]
+		if secret, err := DecryptSecret(stored); err != nil || secret != want {
+			t.Errorf("after pruning the password of server %d decrypts to %q, %v, want %q", i+1, secret, err, want)
+		}
+	}
+}
+
+func TestSecretsRotateRollsBackWhenAPasswordCantBeRewrapped(t *testing.T) {
+	keys := UseTestMasterKeys(t)
+
+	good, err := EncryptSecret("good")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A password that was wrapped with a key that isn't loaded
+	SetMasterKeys([][]byte{securecookie.GenerateRandomKey(32)})
+	lost, err := EncryptSecret("lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetMasterKeys(keys)
+	UseTestServers(t, good, lost)
+	before := SavedServerPasswords(t)
+
+	if err := SecretsCommand([]string{"rotate"}); err == nil {
+		t.Fatal("rotating with a password that can't be unwrapped should be an error")
+	}
+
+	after := SavedServerPasswords(t)
+	if after[0] != before[0] || after[1] != before[1] {
+		t.Error("the passwords changed even though rotating failed")
+	}
+
+	if saved := LoadTestMasterKeys(t); len(saved) != 1 || !bytes.Equal(saved[0], keys[0]) {
+		t.Error("the key file changed even though rotating failed")
+	}
+
+	if secret, err := DecryptSecret(after[0]); err != nil || secret != "good" {
+		t.Errorf("the password decrypts to %q, %v after rotating failed", secret, err)
+	}
+}
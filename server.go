@@ -1,7 +1,8 @@
 package main
 
 import (
-	"github.com/lukevers/mcgorcon"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,8 +18,9 @@ type Server struct {
 	Port int
 
 	// Password is a string which is the password to query the
-	// minecraft server.
-	Password string
+	// minecraft server. It is encrypted with a master key, so use
+	// DecryptSecret to get the password itself.
+	Password string `json:"-"`
 
 	// CreatedAt is a timestamp of when the specific
 	// user was created at.
@@ -28,22 +30,57 @@ type Server struct {
 	// user was last updated at.
 	UpdatedAt time.Time
 
-	// Rcon is an unexported field that connects with a server.
-	rcon mcgorcon.Client `sql:"-"`
+	// Rcon is an unexported field that connects with a server. It is
+	// nil if the server couldn't be connected to.
+	rcon *Rcon `sql:"-"`
+
+	// Lock for the RCON connection, so that only one command is sent
+	// at a time and each user gets the answer to their own command.
+	rconLock sync.Mutex `sql:"-"`
 }
 
 // Initialize Rcon for an initalized server.
 func (s *Server) initalizeRcon() {
-	s.rcon, err = mcgorcon.Dial(s.Host, s.Port, s.Password)
+	password, err := DecryptSecret(s.Password)
 	if err != nil {
-		s.rcon = mcgorcon.Client{}
+		Warnf("Error decrypting the password of %s: %s", s, err)
 	}
+
+	rcon, err := DialRcon(s.Host, s.Port, password)
+	if err != nil {
+		Warnf("Error connecting to %s: %s", s, err)
+	}
+
+	s.rcon = rcon
 }
 
+// String returns the host and port of the server, which is how servers
+// are shown in logs. The password is never part of it.
+func (s *Server) String() string {
+	return s.Host + ":" + strconv.Itoa(s.Port)
+}
+
+// Close closes the RCON connection to the server, if there is one.
+func (s *Server) Close() {
+	s.rconLock.Lock()
+	defer s.rconLock.Unlock()
+
+	if s.rcon != nil {
+		err := s.rcon.Close()
+		if err != nil {
+			Warnf("Error closing RCON connection to %s: %s", s, err)
+		}
+	}
+}
+
+// Cmd sends a command to the server and returns what it said back, or
+// nothing if the server isn't connected or the command failed.
 func (s *Server) Cmd(command string) string {
-	tmp := mcgorcon.Client{}
-	if s.rcon != tmp {
-		response, err := s.rcon.SendCommand(command)
+	s.rconLock.Lock()
+	defer s.rconLock.Unlock()
+
+	if s.rcon != nil {
+		response, err := s.rcon.Command(command)
 		if err != nil {
 			return ""
 		}
@@ -53,3 +90,15 @@ func (s *Server) Cmd(command string) string {
 
 	return ""
 }
+
+// Run sends a command to the server on behalf of a user. The command
+// is checked against the command policies for the user first, and if
+// the user is not allowed to run it the command is never sent.
+func (s *Server) Run(u *User, command string) (string, error) {
+	err := CheckCommand(u, s, command)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Cmd(command), nil
+}
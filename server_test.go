@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestServerCmdSendsOneCommandAtATime(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+	password, err := EncryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{Host: host, Port: port, Password: password}
+	server.initalizeRcon()
+	defer server.Close()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+
+			command := fmt.Sprintf("say %d", i)
+			if answer := server.Cmd(command); answer != "ran "+command {
+				t.Errorf("Cmd(%q) = %q", command, answer)
+			}
+		}(i)
+	}
+
+	wait.Wait()
+}
+
+func TestServerCloseClosesTheConnection(t *testing.T) {
+	host, port := StartTestRcon(t, "secret")
+	server := &Server{Host: host, Port: port, Password: "secret"}
+	server.initalizeRcon()
+
+	if server.rcon == nil {
+		t.Fatal("the server should be connected")
+	}
+
+	server.Close()
+	if _, err := server.rcon.Command("list"); err == nil {
+		t.Error("commands should fail once the server has been closed")
+	}
+}
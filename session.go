@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// The most session keys that are kept in the key file. The first
+	// key is used to sign and encrypt new sessions and the rest are
+	// only used to read sessions that were saved before a rotation.
+	maxSessionKeys = 3
+
+	// How often the last activity of a session is written to the
+	// database. Writing it on every request would be a waste.
+	sessionTouchInterval = time.Minute
+)
+
+// Session store for users
+var store *DBStore
+
+// UserSession is a session that has been saved to the database. The
+// cookie that is given to the browser only contains the token, and
+// everything else stays on the server so that it can be listed and
+// revoked.
+type UserSession struct {
+	// Id is a uint64 that is the session's identification number.
+	Id uint64
+
+	// Token is the random string that the browser's cookie points
+	// to the session with.
+	Token string `sql:"size:255;unique"`
+
+	// UserId is the id of the user that the session belongs to, or
+	// 0 if nobody has logged in with the session yet.
+	UserId uint64
+
+	// Ip is the address that the session was last used from.
+	Ip string `sql:"size:255"`
+
+	// UserAgent is the user agent that the session was last used
+	// with.
+	UserAgent string `sql:"size:255"`
+
+	// Data is the signed and encrypted values of the session.
+	Data string `sql:"type:text"`
+
+	// LastActivityAt is a timestamp of when the session was last
+	// used.
+	LastActivityAt time.Time
+
+	// ExpiresAt is a timestamp of when the session expires if it is
+	// not used again before then.
+	ExpiresAt time.Time
+
+	// CreatedAt is a timestamp of when the specific
+	// session was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// session was last updated at.
+	UpdatedAt time.Time
+}
+
+// DBStore is a gorilla session store that keeps sessions in the
+// database.
+type DBStore struct {
+	// Codecs are used to sign and encrypt the cookie and the values
+	// of each session.
+	Codecs []securecookie.Codec
+
+	// Options are the default options for new sessions.
+	Options *sessions.Options
+}
+
+// New DB Store creates a session store that saves sessions in the
+// database. The key pairs are passed to securecookie, so the first
+// pair is used to save sessions and every pair is tried when reading
+// them.
+func NewDBStore(keyPairs ...[]byte) *DBStore {
+	store := &DBStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(sessionAgeFlag.Seconds()),
+			HttpOnly: true,
+		},
+	}
+
+	// Securecookie refuses values that are older than 30 days unless
+	// it is told otherwise, so the codecs have to allow sessions to be
+	// as old as the sessions themselves can be.
+	for _, codec := range store.Codecs {
+		if cookie, ok := codec.(*securecookie.SecureCookie); ok {
+			cookie.MaxAge(store.Options.MaxAge)
+		}
+	}
+
+	return store
+}
+
+// Get returns a session for the given name after adding it to the
+// registry, so every call for the same request returns the same
+// session.
+func (s *DBStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+// New returns the session that the request's cookie points to, or a
+// new session if there is no cookie or the session has expired or been
+// revoked.
+func (s *DBStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	err = securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	row := FindSession(token)
+	if row == nil {
+		return session, nil
+	}
+
+	err = securecookie.DecodeMulti(name, row.Data, &session.Values, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	session.ID = token
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session to the database and gives the browser a
+// cookie that points to it. If the session has a negative MaxAge then
+// it is deleted instead.
+func (s *DBStore) Save(req *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			db.Where("token = ?", session.ID).Delete(&UserSession{})
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	var row UserSession
+	if session.ID != "" {
+		db.Where("token = ?", session.ID).First(&row)
+
+		// If the session was revoked while the request was being
+		// handled then we can't bring it back.
+		if row.Id == 0 {
+			return errors.New("session has been revoked")
+		}
+	} else {
+		row.Token = base64.URLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		session.ID = row.Token
+	}
+
+	row.Data = data
+	// User agents can be longer than the column, which Postgres and
+	// MySQL refuse to save
+	row.Ip = RemoteIp(req)
+	row.UserAgent = Truncate(req.UserAgent(), 255)
+	row.LastActivityAt = time.Now()
+	row.ExpiresAt = time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if id, ok := session.Values["user_id"].(uint64); ok {
+		row.UserId = id
+	}
+
+	if row.Id == 0 {
+		err = db.Create(&row).Error
+	} else {
+		err = db.Save(&row).Error
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cookie, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), cookie, session.Options))
+	return nil
+}
+
+// Find Session returns the session in the database with the token, or
+// nil if it does not exist or has expired.
+func FindSession(token string) *UserSession {
+	var row UserSession
+	db.Where("token = ? AND expires_at > ?", token, time.Now()).First(&row)
+	if row.Id == 0 {
+		return nil
+	}
+
+	return &row
+}
+
+// Touch Session updates the last activity of the session for the
+// request, so that it doesn't expire while it is being used.
+func TouchSession(req *http.Request, session *sessions.Session) {
+	row := FindSession(session.ID)
+	if row != nil && time.Since(row.LastActivityAt) > sessionTouchInterval {
+		db.Model(row).UpdateColumns(map[string]interface{}{
+			"ip":               RemoteIp(req),
+			"user_agent":       Truncate(req.UserAgent(), 255),
+			"last_activity_at": time.Now(),
+			"expires_at":       time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+		})
+	}
+}
+
+// Clean Sessions is a func that is ran when the app is started, and
+// every hour after that, which removes every session that has expired
+// from the database.
+func CleanSessions() {
+	err := db.Where("expires_at <= ?", time.Now()).Delete(&UserSession{}).Error
+	if err != nil {
+		Warnf("Error deleting expired sessions: %s", err)
+	}
+}
+
+// Initalize Sessions loads the session keys and creates the session
+// stores. If the rotate flag is set then a new key is added to the key
+// file before the stores are created.
+func initalizeSessions() {
+	keys, err := LoadSessionKeys(*keyFileFlag)
+	if err != nil {
+		Warnf("Error loading session keys: %s", err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+
+	if len(keys) == 0 || *rotateKeysFlag {
+		if *debugFlag {
+			Verb("Generating a new session key")
+		}
+
+		keys = append([][]byte{
+			securecookie.GenerateRandomKey(64),
+			securecookie.GenerateRandomKey(32),
+		}, keys...)
+
+		if len(keys) > maxSessionKeys*2 {
+			keys = keys[:maxSessionKeys*2]
+		}
+
+		err = SaveSessionKeys(*keyFileFlag, keys)
+		if err != nil {
+			Warnf("Error saving session keys: %s", err)
+			Warn("Exiting with exit status 1")
+			os.Exit(1)
+		}
+	}
+
+	store = NewDBStore(keys...)
+	csrfStore = sessions.NewCookieStore(keys...)
+	csrfStore.Options.HttpOnly = true
+
+	// Cookies are only sent over HTTPS when Sorbet is served over it
+	store.Options.Secure = TLSEnabled() || *secureCookiesFlag
+	csrfStore.Options.Secure = store.Options.Secure
+}
+
+// Load Session Keys reads the key pairs from a key file. Each line of
+// the file is a base64 encoded hash key followed by a base64 encoded
+// block key. If the file does not exist then no keys are returned.
+func LoadSessionKeys(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := [][]byte{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("each key must be a hash key and a block key")
+		}
+
+		for _, field := range fields {
+			key, err := base64.StdEncoding.DecodeString(field)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, scanner.Err()
+}
+
+// Save Session Keys writes the key pairs to a key file that only the
+// current user can read.
+func SaveSessionKeys(path string, keys [][]byte) error {
+	lines := []string{"# Sorbet session keys. The first key is used for new sessions."}
+	for i := 0; i+1 < len(keys); i += 2 {
+		lines = append(lines, base64.StdEncoding.EncodeToString(keys[i])+" "+base64.StdEncoding.EncodeToString(keys[i+1]))
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
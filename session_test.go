@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionSavesLongUserAgents(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", strings.Repeat("a", 1000))
+
+	session, err := store.New(req, "session-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.Values["user_id"] = uint64(1)
+	if err := store.Save(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal(err)
+	}
+
+	row := FindSession(session.ID)
+	if row == nil {
+		t.Fatal("the session was not saved")
+	}
+
+	if len(row.UserAgent) != 255 {
+		t.Errorf("the user agent is %d characters, want 255", len(row.UserAgent))
+	}
+}
+
+func TestSessionCookiesExpireWithTheSessions(t *testing.T) {
+	defer func(age time.Duration) { *sessionAgeFlag = age }(*sessionAgeFlag)
+	*sessionAgeFlag = time.Second
+
+	// Securecookie keeps values for 30 days unless it is told otherwise,
+	// so this only expires after a second if the codecs were given the
+	// session age
+	short := NewDBStore(securecookie.GenerateRandomKey(32))
+	value, err := securecookie.EncodeMulti("user", "token", short.Codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	var token string
+	if err := securecookie.DecodeMulti("user", value, &token, short.Codecs...); err == nil {
+		t.Error("a session that lasts a second could still be read after 2 seconds")
+	}
+}
+
+func TestChangingTheSecurityStampLogsSessionsOut(t *testing.T) {
+	user := NewTestUser(t, "stamp-change", false)
+	first := LogInTestUser(t, user)
+	second := LogInTestUser(t, user)
+
+	loggedIn := func(cookies []*http.Cookie) bool {
+		return IsLoggedIn(httptest.NewRecorder(), AsTestUser(httptest.NewRequest("GET", "/", nil), cookies))
+	}
+
+	if !loggedIn(first) || !loggedIn(second) {
+		t.Fatal("both sessions should be logged in")
+	}
+
+	// A new stamp is enough to log a session out, even though the
+	// session is still in the database
+	stamp := NewSecurityStamp()
+	db.Table("users").Where("id = ?", user.Id).UpdateColumn("security_stamp", stamp)
+	users.Update(user.Id, func(v *User) {
+		v.SecurityStamp = stamp
+	})
+
+	if loggedIn(first) || loggedIn(second) {
+		t.Error("sessions with the old security stamp should be logged out")
+	}
+
+	// Invalidating the sessions of a user from one of their sessions
+	// keeps that one logged in
+	current := LogInTestUser(t, FindUser(user.Id))
+	other := LogInTestUser(t, FindUser(user.Id))
+	InvalidateSessions(httptest.NewRecorder(), AsTestUser(httptest.NewRequest("POST", "/settings", nil), current), FindUser(user.Id))
+
+	if !loggedIn(current) {
+		t.Error("the session that invalidated the others should stay logged in")
+	}
+
+	if loggedIn(other) {
+		t.Error("every other session should be logged out")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+var (
+	// Setup token that has to be given to "/setup" to create the first
+	// administrator. It is blank once any user exists.
+	setupToken string
+
+	// Lock that makes sure only one first administrator is created.
+	setupLock sync.Mutex
+)
+
+// Initalize Setup checks if any users exist yet. If they don't then
+// either a setup token is printed to the log, which is used to create
+// the first administrator at "/setup", or an administrator is created
+// with a one-time password that has to be changed on first login.
+func initalizeSetup() {
+	if users.Count() > 0 {
+		return
+	}
+
+	if *setupPasswordFlag {
+		password := RandomPassword()
+		admin := User{
+			Username:           "admin",
+			Password:           HashPassword(password),
+			Admin:              true,
+			MustChangePassword: true,
+			SecurityStamp:      NewSecurityStamp(),
+		}
+
+		db.Create(&admin)
+		users.Add(&admin)
+
+		Infof("Created the user \"admin\" with the one-time password %s", password)
+		Infof("The password has to be changed when you log in")
+	} else {
+		setupToken = RandomToken()
+
+		Infof("No users exist yet, so the first administrator has to be created")
+		Infof("Visit %s/setup?token=%s to create them", BaseUrl(), setupToken)
+	}
+}
+
+// Setup Needed checks if the first administrator still has to be
+// created.
+func SetupNeeded() bool {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+
+	return setupToken != ""
+}
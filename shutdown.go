@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// Shutdown is cancelled when Sorbet is asked to stop, which tells
+	// the webserver and every background worker to finish up.
+	shutdown, stopShutdown = context.WithCancel(context.Background())
+
+	// Background workers that are still running.
+	workers sync.WaitGroup
+)
+
+// Stop On Signal cancels shutdown when Sorbet gets SIGINT or SIGTERM,
+// and returns a func that stops catching them again. It is only called
+// once the webserver is about to start, so that until then the signals
+// stop Sorbet straight away, like they do while a command runs.
+func StopOnSignal() func() {
+	signals, stop := signal.NotifyContext(shutdown, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals.Done()
+		stopShutdown()
+	}()
+
+	return stop
+}
+
+// Start Worker runs work every interval in the background until Sorbet
+// shuts down.
+func StartWorker(interval time.Duration, work func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-shutdown.Done():
+				return
+			case <-ticker.C:
+				work()
+			}
+		}
+	}()
+}
+
+// Close tears down everything that was started, after the webserver has
+// stopped: background workers are stopped, RCON connections are closed
+// and the database is closed.
+func Close() {
+	stopShutdown()
+	workers.Wait()
+
+	for _, server := range servers.All() {
+		server.Close()
+	}
+
+	err := db.Close()
+	if err != nil {
+		Warnf("Error closing database: %s", err)
+	}
+}
+
+// Exit closes everything and exits with the status.
+func Exit(status int) {
+	Close()
+
+	if status != 0 {
+		Warnf("Exiting with exit status %d", status)
+	} else {
+		Infof("Sorbet has stopped")
+	}
+
+	os.Exit(status)
+}
+
+// Reload On Hangup loads every user, role and server from the database
+// again whenever Sorbet gets SIGHUP, so that changes made with commands
+// like "sorbet user passwd" are used without restarting. Static files in
+// the public folder are hashed again too.
+func ReloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		defer signal.Stop(hangup)
+
+		for {
+			select {
+			case <-shutdown.Done():
+				return
+			case <-hangup:
+				Infof("Reloading users, roles, servers and static files")
+				ReloadSecrets()
+				users.Load()
+				roles.Load()
+				servers.Load()
+
+				if err := assets.Load(); err != nil {
+					Warnf("Error reloading static files: %s", err)
+				}
+			}
+		}
+	}()
+}
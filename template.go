@@ -11,22 +11,54 @@ func IsAdmin(req *http.Request) bool {
 	return WhoAmI(req).Admin
 }
 
+// Template func that checks if the current user has been granted
+// a permission on the server with the given id. If the server id is
+// 0 then the permission has to be granted globally.
+func Can(req *http.Request, perm string, server uint64) bool {
+	user := WhoAmI(req)
+	if user == nil {
+		return false
+	}
+
+	return user.Can(Permission(perm), server)
+}
+
 // UnixTime is a func that takes a timestamp and converts it
 // to a unix timestamp
 func UnixTime(time *time.Time) int64 {
 	return time.Unix()
 }
 
+// Template func that returns a value from the query string of the
+// request, which is how handlers say what went wrong when they
+// redirect back to a page.
+func Query(req *http.Request, key string) string {
+	if req == nil {
+		return ""
+	}
+
+	return req.URL.Query().Get(key)
+}
+
 // Add func to templates
 func AddTemplateFunctions(req *http.Request) template.FuncMap {
 	return template.FuncMap{
-		"IsAdmin":     func() bool { return IsAdmin(req) },
-		"UnixTime":    func(time *time.Time) int64 { return UnixTime(time) },
+		"IsAdmin":  func() bool { return IsAdmin(req) },
+		"Can":      func(perm string) bool { return Can(req, perm, 0) },
+		"CanOn":    func(perm string, server uint64) bool { return Can(req, perm, server) },
+		"UnixTime": func(time *time.Time) int64 { return UnixTime(time) },
+		"Query":    func(key string) string { return Query(req, key) },
+
+		"Asset":          assets.Asset,
+		"PasswordPolicy": PasswordPolicy,
+
+		"CSRFToken": func() string { return CSRFTokenFor(req) },
+		"CSRFField": func() template.HTML { return CSRFField(req) },
 	}
 }
 
 // Refresh Templates recompiles the templates. We use this a lot,
 // so it's better to have it in once place than in 20 places.
 func RefreshTemplates(req *http.Request) *template.Template {
-	return template.Must(template.New("").Funcs(AddTemplateFunctions(req)).ParseGlob("app/views/*"))
+	return template.Must(template.New("").Funcs(AddTemplateFunctions(req)).ParseFS(ViewsFS(), "*"))
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate and key files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// TLS Enabled checks if Sorbet serves HTTPS itself, either with a
+// certificate that it was given or with certificates from ACME.
+func TLSEnabled() bool {
+	return *tlsCertFlag != "" || *acmeDomainsFlag != ""
+}
+
+// CertReloader serves a certificate from files on disk and loads it
+// again whenever the files change, so that renewed certificates are
+// used without restarting Sorbet.
+type CertReloader struct {
+	// CertFile and KeyFile are the paths of the PEM encoded
+	// certificate chain and private key.
+	CertFile string
+	KeyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// New Cert Reloader loads the certificate and key for the first time,
+// which has to work for Sorbet to start.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	return r, r.Reload()
+}
+
+// Reload loads the certificate and key from disk. If they can't be
+// loaded then the certificate that was loaded before is kept.
+func (r *CertReloader) Reload() error {
+	modTime := r.ModTime()
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lock.Unlock()
+
+	return nil
+}
+
+// Mod Time returns when the certificate or key was last changed,
+// whichever was later.
+func (r *CertReloader) ModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+// Check reloads the files if they have changed since they were last
+// loaded.
+func (r *CertReloader) Check() {
+	r.lock.RLock()
+	changed := !r.ModTime().Equal(r.modTime)
+	r.lock.RUnlock()
+
+	if changed {
+		if err := r.Reload(); err != nil {
+			Warnf("Error reloading TLS certificate, still using the old one: %s", err)
+		} else {
+			Infof("Reloaded TLS certificate from %s", r.CertFile)
+		}
+	}
+}
+
+// Get Certificate returns the certificate that is currently loaded. It
+// is used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, nil
+}
+
+// New TLS Config creates the TLS config that Sorbet serves HTTPS with.
+// The second value is the handler that answers ACME HTTP challenges, or
+// nil if certificates don't come from ACME.
+func NewTLSConfig() (*tls.Config, func(http.Handler) http.Handler, error) {
+	if *acmeDomainsFlag != "" {
+		domains := []string{}
+		for _, domain := range strings.Split(*acmeDomainsFlag, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*acmeCacheFlag),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      *acmeEmailFlag,
+			Client:     &acme.Client{DirectoryURL: *acmeDirectoryFlag},
+		}
+
+		config := manager.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, manager.HTTPHandler, nil
+	}
+
+	reloader, err := NewCertReloader(*tlsCertFlag, *tlsKeyFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	StartWorker(certReloadInterval, reloader.Check)
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil, nil
+}
+
+// Redirect To HTTPS sends every request to the same URL over HTTPS.
+// Only hosts that Sorbet is known to be served on are redirected, and
+// the URL is built from the settings instead of what the request asked
+// for, so the redirect can't be used to send visitors somewhere else.
+func RedirectToHTTPS(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	target, ok := HTTPSHosts()[strings.ToLower(host)]
+	if !ok {
+		http.Error(w, "Unknown host", http.StatusMisdirectedRequest)
+	} else {
+		http.Redirect(w, req, "https://"+target+req.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// HTTPS Hosts returns the hosts that Sorbet serves HTTPS on, which are
+// the ACME domains, the host of the base URL and the interface if it
+// isn't every interface. Each host is mapped to the host and port that
+// it is reached on over HTTPS.
+func HTTPSHosts() map[string]string {
+	hosts := map[string]string{}
+	for _, domain := range strings.Split(*acmeDomainsFlag, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			hosts[domain] = domain + PortSuffix(443)
+		}
+	}
+
+	if u, err := url.Parse(*baseUrlFlag); err == nil && u.Hostname() != "" {
+		hosts[strings.ToLower(u.Hostname())] = u.Host
+	}
+
+	if ip := net.ParseIP(*interfaceFlag); ip == nil || !ip.IsUnspecified() {
+		host := strings.ToLower(*interfaceFlag)
+		if strings.Contains(host, ":") {
+			hosts[host] = "[" + host + "]" + PortSuffix(443)
+		} else if host != "" {
+			hosts[host] = host + PortSuffix(443)
+		}
+	}
+
+	return hosts
+}
+
+// Strict Transport Security wraps a handler so that browsers are told
+// to only ever visit Sorbet over HTTPS. Nothing is added if Sorbet
+// doesn't serve HTTPS itself or the max age is 0.
+func StrictTransportSecurity(handler http.Handler) http.Handler {
+	if !TLSEnabled() || *hstsMaxAgeFlag <= 0 {
+		return handler
+	}
+
+	value := "max-age=" + strconv.Itoa(int(hstsMaxAgeFlag.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Listen And Serve serves the handler over HTTP, or over HTTPS if TLS
+// is enabled, until Sorbet is asked to stop. When serving HTTPS, a
+// second webserver on the redirect port sends visitors to HTTPS and
+// answers ACME challenges. An error is returned straight away if a
+// port can't be listened on.
+func ListenAndServe(handler http.Handler) error {
+	// Listen before serving so that a port that is in use is reported
+	// as an error rather than a webserver that never starts
+	addr := net.JoinHostPort(*interfaceFlag, strconv.Itoa(*portFlag))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %s", addr, err)
+	}
+
+	web := &http.Server{Handler: handler}
+	serve := map[*http.Server]func() error{
+		web: func() error { return web.Serve(listener) },
+	}
+
+	if TLSEnabled() {
+		config, challenges, err := NewTLSConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		web.TLSConfig = config
+		serve[web] = func() error { return web.ServeTLS(listener, "", "") }
+
+		if *redirectPortFlag != 0 {
+			redirectAddr := net.JoinHostPort(*interfaceFlag, strconv.Itoa(*redirectPortFlag))
+			redirectListener, err := net.Listen("tcp", redirectAddr)
+			if err != nil {
+				listener.Close()
+				return fmt.Errorf("can't listen on %s: %s", redirectAddr, err)
+			}
+
+			redirect := http.Handler(http.HandlerFunc(RedirectToHTTPS))
+			if challenges != nil {
+				redirect = challenges(redirect)
+			}
+
+			redirectServer := &http.Server{Handler: redirect}
+			serve[redirectServer] = func() error { return redirectServer.Serve(redirectListener) }
+			Infof("Redirecting HTTP on port %s to HTTPS", strconv.Itoa(*redirectPortFlag))
+		}
+
+		Infof("Starting webserver with TLS on port %s", strconv.Itoa(*portFlag))
+	} else {
+		Infof("Starting webserver on port %s", strconv.Itoa(*portFlag))
+	}
+
+	// Serve until one of the webservers fails or we're asked to stop
+	errs := make(chan error, len(serve))
+	for _, run := range serve {
+		go func(run func() error) {
+			if err := run(); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(run)
+	}
+
+	select {
+	case err = <-errs:
+	case <-shutdown.Done():
+		Infof("Shutting down, waiting up to %s for requests to finish", *shutdownTimeoutFlag)
+	}
+
+	// Let requests that are still running finish
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	defer cancel()
+
+	for server := range serve {
+		if e := server.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
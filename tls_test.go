@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write Test Cert writes a new self signed certificate for the name and
+// its key over the files, and marks them as changed at the time.
+func WriteTestCert(t *testing.T, certFile string, keyFile string, name string, changed time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, changed, changed); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Served Cert Name connects to the server and returns the name on the
+// certificate that it answers with. A server name is sent, since the
+// certificate isn't asked for without one.
+func ServedCertName(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{ServerName: "sorbet.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloaderPicksUpNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	WriteTestCert(t, certFile, keyFile, "first.example.com", start)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{GetCertificate: reloader.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+
+	if name := ServedCertName(t, server); name != "first.example.com" {
+		t.Fatalf("serving the certificate for %s, want first.example.com", name)
+	}
+
+	// Nothing changes until the files do
+	reloader.Check()
+	if name := ServedCertName(t, server); name != "first.example.com" {
+		t.Errorf("serving the certificate for %s before the files changed", name)
+	}
+
+	// A renewed certificate is served without restarting
+	WriteTestCert(t, certFile, keyFile, "second.example.com", start.Add(time.Minute))
+	reloader.Check()
+	if name := ServedCertName(t, server); name != "second.example.com" {
+		t.Errorf("serving the certificate for %s after it was renewed, want second.example.com", name)
+	}
+
+	// A broken certificate keeps the one that was loaded before
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+	reloader.Check()
+	if name := ServedCertName(t, server); name != "second.example.com" {
+		t.Errorf("serving the certificate for %s after a broken one was written, want second.example.com", name)
+	}
+}
+
+func TestNewCertReloaderNeedsTheFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("a certificate that doesn't exist should be an error")
+	}
+}
+
+func TestACMEChallengesAreAnsweredOnTheRedirectPort(t *testing.T) {
+	defer func(domains, cache string) { *acmeDomainsFlag, *acmeCacheFlag = domains, cache }(*acmeDomainsFlag, *acmeCacheFlag)
+	*acmeDomainsFlag = "sorbet.test, www.sorbet.test"
+	*acmeCacheFlag = t.TempDir()
+
+	config, challenges, err := NewTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	} else if challenges == nil {
+		t.Fatal("ACME challenges should be answered")
+	}
+
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Error("ACME certificates should need TLS 1.2 or later")
+	}
+
+	redirect := challenges(http.HandlerFunc(RedirectToHTTPS))
+
+	// Challenges that were never started aren't redirected
+	w := httptest.NewRecorder()
+	redirect.ServeHTTP(w, httptest.NewRequest("GET", "http://sorbet.test/.well-known/acme-challenge/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("an unknown challenge answered %d, want 404", w.Code)
+	}
+
+	// Everything else is sent to HTTPS
+	w = httptest.NewRecorder()
+	redirect.ServeHTTP(w, httptest.NewRequest("GET", "http://sorbet.test/login", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") == "" {
+		t.Errorf("a page answered %d with %q, want a redirect to HTTPS", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestRedirectToHTTPSOnlyRedirectsKnownHosts(t *testing.T) {
+	defer func(domains, base, address string, port int) {
+		*acmeDomainsFlag, *baseUrlFlag, *interfaceFlag, *portFlag = domains, base, address, port
+	}(*acmeDomainsFlag, *baseUrlFlag, *interfaceFlag, *portFlag)
+
+	*acmeDomainsFlag = "sorbet.test, www.sorbet.test"
+	*baseUrlFlag = "https://console.sorbet.test:8443/"
+	*interfaceFlag = "0.0.0.0"
+	*portFlag = 6443
+
+	redirects := map[string]string{
+		"http://sorbet.test/login?next=%2F": "https://sorbet.test:6443/login?next=%2F",
+		"http://WWW.sorbet.test:80/":        "https://www.sorbet.test:6443/",
+		"http://console.sorbet.test/":       "https://console.sorbet.test:8443/",
+	}
+
+	for from, to := range redirects {
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(w, httptest.NewRequest("GET", from, nil))
+		if location := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || location != to {
+			t.Errorf("%s answered %d with %q, want a redirect to %s", from, w.Code, location, to)
+		}
+	}
+
+	// Hosts that aren't configured, including every interface, aren't
+	// redirected anywhere
+	for _, from := range []string{"http://evil.example.com/login", "http://0.0.0.0/"} {
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(w, httptest.NewRequest("GET", from, nil))
+		if w.Code != http.StatusMisdirectedRequest || w.Header().Get("Location") != "" {
+			t.Errorf("%s answered %d with %q, want it to be refused", from, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// An interface that is a real address is redirected to
+	*interfaceFlag = "::1"
+	w := httptest.NewRecorder()
+	RedirectToHTTPS(w, httptest.NewRequest("GET", "http://[::1]:80/", nil))
+	if location := w.Header().Get("Location"); location != "https://[::1]:6443/" {
+		t.Errorf("the interface was redirected to %q, want https://[::1]:6443/", location)
+	}
+}
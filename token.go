@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Purpose of tokens that invite somebody to create a user.
+	TokenInvite = "invite"
+
+	// Purpose of tokens that let a user choose a new password.
+	TokenReset = "reset"
+)
+
+// UserToken is a link that can be used once, before it expires, to
+// accept an invitation or to reset a password. Only a hash of the token
+// is saved so the links can't be taken from the database.
+type UserToken struct {
+	// Id is a uint64 that is the token's identification number.
+	Id uint64
+
+	// Purpose is what the token is for, which is either "invite" or
+	// "reset".
+	Purpose string `sql:"size:255"`
+
+	// Hash is a hex encoded SHA-256 hash of the token.
+	Hash string `sql:"size:255;unique"`
+
+	// UserId is the id of the user whose password is reset. It is 0
+	// for invitations since the user doesn't exist yet.
+	UserId uint64
+
+	// Username is the name of the user that is created when an
+	// invitation is accepted.
+	Username string `sql:"size:255"`
+
+	// Email is the address that the link was sent to.
+	Email string `sql:"size:255"`
+
+	// Admin is a bool that specifies if the user that is created
+	// when an invitation is accepted is an administrator.
+	Admin bool
+
+	// CreatedById is the id of the user that created the token.
+	CreatedById uint64
+
+	// Used is a bool that specifies if the token has been used.
+	Used bool
+
+	// ExpiresAt is a timestamp of when the token can't be used
+	// anymore.
+	ExpiresAt time.Time
+
+	// CreatedAt is a timestamp of when the specific
+	// token was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// token was last updated at.
+	UpdatedAt time.Time
+}
+
+// Hash Token hashes a token from a link the way it is saved.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// New User Token creates and saves a token. The token is returned so it
+// can be put in a link, since only its hash is saved.
+func NewUserToken(t *UserToken, expiry time.Duration) string {
+	// A user only ever has one reset link that works
+	if t.Purpose == TokenReset {
+		db.Where("purpose = ? AND user_id = ? AND used = ?", TokenReset, t.UserId, false).Delete(&UserToken{})
+	}
+
+	token := RandomToken()
+	t.Hash = HashToken(token)
+	t.ExpiresAt = time.Now().Add(expiry)
+	db.Create(t)
+
+	return token
+}
+
+// Find User Token returns the token for a purpose that hasn't been used
+// or expired yet, or nil if there is no such token.
+func FindUserToken(purpose string, token string) *UserToken {
+	var t UserToken
+	db.Where("purpose = ? AND hash = ? AND used = ? AND expires_at > ?", purpose, HashToken(token), false, time.Now()).First(&t)
+	if t.Id == 0 {
+		return nil
+	}
+
+	return &t
+}
+
+// Use marks the token as used. If somebody else used it first then
+// false is returned.
+func (t *UserToken) Use() bool {
+	update := db.Model(&UserToken{}).Where("id = ? AND used = ?", t.Id, false).UpdateColumn("used", true)
+	if update.Error != nil || update.RowsAffected == 0 {
+		return false
+	}
+
+	t.Used = true
+	return true
+}
+
+// Clean Tokens removes every token that has expired from the database.
+func CleanTokens() {
+	db.Where("expires_at <= ?", time.Now()).Delete(&UserToken{})
+}
+
+// Token Link returns the full link for a token, like
+// "http://localhost:6015/invite/abc".
+func TokenLink(purpose string, token string) string {
+	return BaseUrl() + "/" + purpose + "/" + token
+}
+
+// Base Url returns the URL that Sorbet is visited at, without a slash
+// at the end. If it wasn't given then it is guessed from the webserver
+// and TLS flags.
+func BaseUrl() string {
+	if *baseUrlFlag != "" {
+		return strings.TrimRight(*baseUrlFlag, "/")
+	} else if *acmeDomainsFlag != "" {
+		return "https://" + strings.TrimSpace(strings.Split(*acmeDomainsFlag, ",")[0]) + PortSuffix(443)
+	} else if TLSEnabled() {
+		return "https://" + *interfaceFlag + PortSuffix(443)
+	}
+
+	return "http://" + *interfaceFlag + PortSuffix(80)
+}
+
+// Port Suffix returns ":port" for the webserver port, or nothing if it
+// is the default port of the scheme.
+func PortSuffix(standard int) string {
+	if *portFlag == standard {
+		return ""
+	}
+
+	return ":" + strconv.Itoa(*portFlag)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/dgryski/dgoogauth"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// The number of recovery codes that are given to a user each time
+	// they are generated.
+	recoveryCodeCount = 10
+
+	// The number of random bytes in a 2fa secret. RFC 4226 asks for at
+	// least 128 bits and recommends 160 bits.
+	totpSecretSize = 20
+
+	// How many seconds each 2fa token is valid for.
+	totpPeriod = 30
+
+	// How many time steps before and after the current one are still
+	// accepted, to allow for clocks that are a little off.
+	totpSkew = 1
+
+	// How long a user has to verify their first token after they start
+	// setting up 2fa.
+	pendingTwofaMaxAge = 15 * time.Minute
+)
+
+// PendingTwofa is a 2fa secret that a user is setting up but has not
+// verified with a token yet. It is kept in the database instead of the
+// session so setting up 2fa can be finished after a restart.
+type PendingTwofa struct {
+	// Id is a uint64 that is the pending secret's identification
+	// number.
+	Id uint64
+
+	// UserId is the id of the user that is setting up 2fa. Each user
+	// only ever has one pending secret.
+	UserId uint64 `sql:"unique"`
+
+	// Secret is the base32 encoded 2fa secret.
+	Secret string `sql:"size:255"`
+
+	// ExpiresAt is a timestamp of when the secret can't be verified
+	// anymore.
+	ExpiresAt time.Time
+
+	// CreatedAt is a timestamp of when the specific
+	// secret was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// secret was last updated at.
+	UpdatedAt time.Time
+}
+
+// New Totp Secret creates a random base32 encoded 2fa secret.
+func NewTotpSecret() string {
+	sec := make([]byte, totpSecretSize)
+	_, err := rand.Read(sec)
+	if err != nil {
+		Warnf("Error creating random secret key: %s", err)
+	}
+
+	return base32.StdEncoding.EncodeToString(sec)
+}
+
+// Totp Uri creates the otpauth URI that is encoded as a QR image for
+// authenticator apps. The label is the issuer and the username so
+// users can tell their accounts apart.
+//
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+// otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example
+func TotpUri(issuer string, username string, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(username)
+
+	query := url.Values{}
+	query.Set("secret", strings.TrimRight(secret, "="))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", "6")
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Start Pending Twofa throws away any 2fa secret that the user was
+// already setting up and creates a new one.
+func StartPendingTwofa(u *User) *PendingTwofa {
+	db.Where("user_id = ?", u.Id).Delete(&PendingTwofa{})
+
+	pending := PendingTwofa{
+		UserId:    u.Id,
+		Secret:    NewTotpSecret(),
+		ExpiresAt: time.Now().Add(pendingTwofaMaxAge),
+	}
+
+	db.Create(&pending)
+	return &pending
+}
+
+// Find Pending Twofa returns the 2fa secret that the user is setting
+// up, or nil if they aren't setting one up or it has expired.
+func FindPendingTwofa(u *User) *PendingTwofa {
+	var pending PendingTwofa
+	db.Where("user_id = ? AND expires_at > ?", u.Id, time.Now()).First(&pending)
+	if pending.Id == 0 {
+		return nil
+	}
+
+	return &pending
+}
+
+// Check Totp checks if a token is right for a secret at the current
+// time and returns the time step that it matched, or -1 if it is not
+// right. Tokens from time steps that are not after the last step are
+// never accepted so each token can only be used once.
+func CheckTotp(secret string, token string, last int64) int64 {
+	token = strings.TrimSpace(token)
+	if len(token) != 6 {
+		return -1
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		code := fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, step))
+		if step > last && subtle.ConstantTimeCompare([]byte(code), []byte(token)) == 1 {
+			return step
+		}
+	}
+
+	return -1
+}
+
+// Use Totp checks if a token is right for the user's 2fa secret and
+// has not been used before. If it is right then the time step is saved
+// so the same token can't be used again.
+func UseTotp(u *User, token string) bool {
+	step := CheckTotp(u.TwofaSecret, token, u.TwofaLastStep)
+	if step < 0 {
+		return false
+	}
+
+	// Only save the step if nobody else used a token from the same step
+	// while we were checking this one.
+	update := db.Model(&User{}).Where("id = ? AND twofa_last_step < ?", u.Id, step).UpdateColumn("twofa_last_step", step)
+	if update.Error != nil || update.RowsAffected == 0 {
+		return false
+	}
+
+	users.Update(u.Id, func(v *User) {
+		v.TwofaLastStep = step
+	})
+
+	return true
+}
+
+// RecoveryCode is a single use code that can be used instead of a 2fa
+// token when a user has lost their phone.
+type RecoveryCode struct {
+	// Id is a uint64 that is the code's identification number.
+	Id uint64
+
+	// UserId is the id of the user that the code belongs to.
+	UserId uint64
+
+	// Hash is a hex encoded SHA-256 hash of the code. Codes are
+	// long and random so they don't need to be hashed with bcrypt,
+	// which would make checking ten of them on each login slow.
+	Hash string `sql:"size:255"`
+
+	// Used is a bool that specifies if the code has already been
+	// used to log in.
+	Used bool
+
+	// CreatedAt is a timestamp of when the specific
+	// code was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// code was last updated at, which is when it was used.
+	UpdatedAt time.Time
+}
+
+// Hash Recovery Code normalizes a recovery code the way a user might
+// type it and hashes it.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate Recovery Codes throws away every recovery code that the user
+// has and creates new ones. The codes are returned so they can be shown
+// to the user once, and only their hashes are saved.
+func GenerateRecoveryCodes(u *User) []string {
+	db.Where("user_id = ?", u.Id).Delete(&RecoveryCode{})
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		// 10 random characters of base32 are 50 bits
+		raw := make([]byte, 10)
+		_, err := rand.Read(raw)
+		if err != nil {
+			Warnf("Error creating random recovery code: %s", err)
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+
+		db.Create(&RecoveryCode{
+			UserId: u.Id,
+			Hash:   HashRecoveryCode(code),
+		})
+	}
+
+	return codes
+}
+
+// Use Recovery Code checks if the code is one of the user's recovery
+// codes that has not been used yet, and if it is then it is used up.
+func UseRecoveryCode(u *User, code string) bool {
+	var found RecoveryCode
+	db.Where("user_id = ? AND hash = ? AND used = ?", u.Id, HashRecoveryCode(code), false).First(&found)
+	if found.Id == 0 {
+		return false
+	}
+
+	// Only mark the code as used if it still isn't, so that a code
+	// that is used twice at the same time only works once
+	update := db.Model(&RecoveryCode{}).Where("id = ? AND used = ?", found.Id, false).UpdateColumn("used", true)
+	return update.Error == nil && update.RowsAffected == 1
+}
+
+// Recovery Codes Left returns the number of recovery codes that the
+// user has not used yet.
+func (u *User) RecoveryCodesLeft() int {
+	var count int
+	db.Model(&RecoveryCode{}).Where("user_id = ? AND used = ?", u.Id, false).Count(&count)
+	return count
+}
+
+// Disable Totp turns off 2fa tokens for a user. If the user doesn't
+// have any security keys either then their recovery codes are thrown
+// away too.
+func DisableTotp(u *User) {
+	// Update user in database
+	var user User
+	db.Table("users").Where("id = ?", u.Id).Find(&user)
+	user.Twofa = false
+	user.TwofaSecret = ""
+	user.TwofaLastStep = 0
+	db.Save(&user)
+	db.Where("user_id = ?", u.Id).Delete(&PendingTwofa{})
+
+	// Update user in memory
+	users.Update(u.Id, func(v *User) {
+		v.Twofa = false
+		v.TwofaSecret = ""
+		v.TwofaLastStep = 0
+	})
+
+	if !user.HasSecondFactor() {
+		db.Where("user_id = ?", u.Id).Delete(&RecoveryCode{})
+	}
+}
+
+// Reset Twofa turns off every second factor for a user, which is 2fa
+// tokens and security keys, and throws away their recovery codes.
+func ResetTwofa(u *User) {
+	DisableTotp(u)
+
+	db.Where("user_id = ?", u.Id).Delete(&SecurityKey{})
+	db.Where("user_id = ?", u.Id).Delete(&RecoveryCode{})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dgryski/dgoogauth"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Totp Code At returns the token that an authenticator app shows for
+// the secret at the time step.
+func TotpCodeAt(secret string, step int64) string {
+	return fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, step))
+}
+
+func TestUseRecoveryCodeOnlyWorksOnce(t *testing.T) {
+	user := NewTestUser(t, "twofa-recovery", false)
+	codes := GenerateRecoveryCodes(user)
+
+	if UseRecoveryCode(user, "not-a-code") {
+		t.Error("a code that was never made should not work")
+	}
+
+	// Use the same code many times at once, which should only work
+	// for one of them
+	var wait sync.WaitGroup
+	var worked int32
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if UseRecoveryCode(user, codes[0]) {
+				atomic.AddInt32(&worked, 1)
+			}
+		}()
+	}
+
+	wait.Wait()
+
+	if worked != 1 {
+		t.Errorf("the code worked %d times, want 1", worked)
+	}
+
+	if left := user.RecoveryCodesLeft(); left != len(codes)-1 {
+		t.Errorf("%d codes are left, want %d", left, len(codes)-1)
+	}
+}
+
+func TestTotpUri(t *testing.T) {
+	uri, err := url.Parse(TotpUri("Sorbet", "alice smith", "JBSWY3DPEHPK3PXP===="))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Sorbet:alice smith" {
+		t.Errorf("the URI is for %s://%s%s, want otpauth://totp/Sorbet:alice smith", uri.Scheme, uri.Host, uri.Path)
+	}
+
+	want := url.Values{
+		"secret":    {"JBSWY3DPEHPK3PXP"},
+		"issuer":    {"Sorbet"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	}
+
+	if query := uri.Query(); query.Encode() != want.Encode() {
+		t.Errorf("the URI asks for %s, want %s", query.Encode(), want.Encode())
+	}
+}
+
+func TestCheckTotp(t *testing.T) {
+	secret := NewTotpSecret()
+	now := time.Now().Unix() / totpPeriod
+
+	// The step is checked again in case the time moved on to the next
+	// one while the token was made
+	if step := CheckTotp(secret, " "+TotpCodeAt(secret, now)+" ", -1); step != now && step != now+1 {
+		t.Errorf("the token for now matched step %d, want %d", step, now)
+	}
+
+	if step := CheckTotp(secret, TotpCodeAt(secret, now-1), -1); step < 0 {
+		t.Error("the token from the step before should be allowed for clocks that are a little off")
+	}
+
+	if step := CheckTotp(secret, TotpCodeAt(secret, now-5), -1); step >= 0 {
+		t.Error("a token from minutes ago should not be allowed")
+	}
+
+	if step := CheckTotp(secret, "12345", -1); step >= 0 {
+		t.Error("a token that is too short should not be allowed")
+	}
+
+	if step := CheckTotp(NewTotpSecret(), TotpCodeAt(secret, now), -1); step >= 0 {
+		t.Error("a token for another secret should not be allowed")
+	}
+
+	// A token from a step that has already been used, or from before
+	// it, can't be used
+	if step := CheckTotp(secret, TotpCodeAt(secret, now), now+totpSkew); step >= 0 {
+		t.Error("a token from a step that has already been used should not be allowed")
+	}
+}
+
+func TestUseTotpOnlyWorksOncePerToken(t *testing.T) {
+	user := NewTestUser(t, "twofa-replay", false)
+	secret := NewTotpSecret()
+	db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{"twofa": true, "twofa_secret": secret})
+	users.Update(user.Id, func(v *User) {
+		v.Twofa = true
+		v.TwofaSecret = secret
+	})
+
+	before := FindUser(user.Id)
+	token := TotpCodeAt(secret, time.Now().Unix()/totpPeriod)
+	if !UseTotp(before, token) {
+		t.Fatal("the token for now should work")
+	}
+
+	if UseTotp(FindUser(user.Id), token) {
+		t.Error("a token should not work twice")
+	}
+
+	// Even with a copy of the user from before it was used, like a
+	// second request that was checking it at the same time
+	if UseTotp(before, token) {
+		t.Error("a token should not work twice from a user that was read before it was used")
+	}
+}
@@ -1,24 +1,13 @@
 package main
 
 import (
-	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/base64"
 	"github.com/gorilla/securecookie"
-	"github.com/gorilla/sessions"
-	"github.com/lukevers/golem"
+	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 )
 
-// Session store for users
-var store = sessions.NewFilesystemStore(
-	// Path
-	"app/sessions",
-	// Secret key with strength set to 64
-	[]byte(securecookie.GenerateRandomKey(64)),
-)
-
 type User struct {
 	// ID is a uint64 that is a users identification
 	// number.
@@ -29,11 +18,36 @@ type User struct {
 	// logging in to the web interface.
 	Username string `sql:"size:255;unique"`
 
+	// Email is a string with max-size set to 255 and
+	// is the address that password reset links are
+	// sent to. It can be blank.
+	Email string `sql:"size:255"`
+
 	// Password is a string with max-size set to 255
 	// and is the password that a user will use when
 	// logging in to the web interface.
 	Password string `sql:"size:255"`
 
+	// Source is where the user's password is checked,
+	// which is "local" for passwords that Sorbet keeps
+	// or the name of the authenticator that created
+	// the user, like "ldap".
+	Source string `sql:"size:255"`
+
+	// Issuer and Subject are the "iss" and "sub" claims
+	// of the identity provider that an OIDC user logs in
+	// with, which together are the only thing that OIDC
+	// users are matched by. They are blank for every
+	// other user.
+	Issuer  string `sql:"size:255"`
+	Subject string `sql:"size:255"`
+
+	// MustChangePassword is a bool that specifies if
+	// the user has to choose a new password before they
+	// can do anything else, because someone else knows
+	// their current one.
+	MustChangePassword bool
+
 	// Admin is a bool that specifies if the current
 	// user is an administrator or not.
 	Admin bool
@@ -46,6 +60,29 @@ type User struct {
 	// 2fa secret.
 	TwofaSecret string
 
+	// TwofaLastStep is the time step of the last 2fa
+	// token that was used, so that it can't be used
+	// again.
+	TwofaLastStep int64
+
+	// Disabled is a bool that specifies if the user has
+	// been stopped from logging in without being deleted.
+	Disabled bool
+
+	// LastLoginAt is a timestamp of when the user last
+	// finished logging in.
+	LastLoginAt time.Time
+
+	// LastLoginIp is the address that the user last
+	// finished logging in from.
+	LastLoginIp string `sql:"size:255"`
+
+	// SecurityStamp is a random string that is saved in
+	// every session of the user. It is changed whenever
+	// something about the user's security changes, which
+	// logs out every session that has the old stamp.
+	SecurityStamp string `sql:"size:255"`
+
 	// CreatedAt is a timestamp of when the specific
 	// user was created at.
 	CreatedAt time.Time
@@ -62,7 +99,7 @@ type User struct {
 func HashPassword(password string) string {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		golem.Warnf("Error hashing password: %s", err)
+		Warnf("Error hashing password: %s", err)
 	}
 
 	return string(hash)
@@ -79,26 +116,6 @@ func PasswordMatchesHash(password string, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-// Clean Sessions is a func that is ran when the app is started
-// and removes all the old session data from "app/sessions" because
-// the old sessions are useless since a secret key is randomly
-// generated on start.
-func CleanSessions() {
-	// Find all sessions
-	sessions, err := filepath.Glob("app/sessions/session_*")
-	if err != nil {
-		golem.Warnf("Error finding sessions: %s", err)
-	}
-
-	// Loop through sessions and delete
-	for _, s := range sessions {
-		err = os.Remove(s)
-		if err != nil {
-			golem.Warnf("Error deleting session: %s", err)
-		}
-	}
-}
-
 // Is Logged In checks if the user has a session or not.
 // If the user does not have a session that matches with
 // what we have, then the user is not logged in.
@@ -111,18 +128,18 @@ func IsLoggedIn(w http.ResponseWriter, req *http.Request) bool {
 
 	// Check if user has Twofa
 	user := WhoAmI(req)
-	if user == nil {
-		// If user is nil then the user probably deleted their own user.
-		// If we get here, we should remove the session immediately
-		http.SetCookie(w, &http.Cookie{
-			Name:   "user",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
+	if user == nil || user.Disabled {
+		// If user is nil then the user probably deleted their own user,
+		// and disabled users can't be logged in at all. If we get here,
+		// we should remove the session immediately
+		session.Options.MaxAge = -1
+		session.Save(req, w)
 		return false
 	} else {
-		if user.Twofa {
+		// Keep track of when the session was last used
+		TouchSession(req, session)
+
+		if user.HasSecondFactor() {
 			// Check if temporary session
 			if session.Values["temp"] == "true" {
 				return false
@@ -135,17 +152,125 @@ func IsLoggedIn(w http.ResponseWriter, req *http.Request) bool {
 	}
 }
 
+// Log In starts a new session for a user that has just been
+// authenticated and sends them on to the next page, which is
+// "/login/2fa" if they have a second factor or "/" if they don't.
+// If the browser already had a session then it is thrown away so
+// that nobody else can know the token of the session that we're
+// logging in.
+func LogIn(w http.ResponseWriter, req *http.Request, user *User) {
+	if user.Disabled {
+		// Disabled users can't log in at all
+		AuditAs(req, user, "login", user.Username, map[string]string{"error": "user is disabled"}, "denied")
+		http.Redirect(w, req, "/login?error=disabled", http.StatusSeeOther)
+	} else {
+		// Create new session
+		session, _ := store.New(req, "user")
+		if !session.IsNew {
+			db.Where("token = ?", session.ID).Delete(&UserSession{})
+			session.ID = ""
+			session.Values = map[interface{}]interface{}{}
+		}
+		session.Values["user_id"] = user.Id
+		session.Values["stamp"] = user.SecurityStamp
+
+		// Hand out a new CSRF token with the new session
+		RotateCSRFToken(w, req)
+
+		// Check if 2fa or security keys are enabled
+		if user.HasSecondFactor() {
+			session.Values["temp"] = "true"
+			session.Save(req, w)
+
+			// Redirect, check 2fa
+			http.Redirect(w, req, "/login/2fa", http.StatusSeeOther)
+		} else {
+			session.Save(req, w)
+			RecordLogin(req, user)
+
+			// Redirect, logged in ok
+			http.Redirect(w, req, "/", http.StatusSeeOther)
+		}
+	}
+}
+
+// Record Login saves when and where a user last finished logging in.
+func RecordLogin(req *http.Request, user *User) {
+	at := time.Now()
+	ip := RemoteIp(req)
+
+	// Update user in database
+	db.Table("users").Where("id = ?", user.Id).UpdateColumns(map[string]interface{}{
+		"last_login_at": at,
+		"last_login_ip": ip,
+	})
+
+	// Update user in memory
+	users.Update(user.Id, func(v *User) {
+		v.LastLoginAt = at
+		v.LastLoginIp = ip
+	})
+}
+
 // WhoAmI figures out who exactly is using the current
 // session (what user is), and it returns the *User from
-// the slice of Users that we have.
+// the slice of Users that we have. The session has to
+// have the id and the current security stamp of the user.
 func WhoAmI(req *http.Request) *User {
 	session, _ := store.Get(req, "user")
+	id, _ := session.Values["user_id"].(uint64)
+	stamp, _ := session.Values["stamp"].(string)
 
-	for _, user := range users {
-		if session.Values["username"] == user.Username {
-			return user
-		}
+	user := users.Find(id)
+	if user == nil || stamp == "" || stamp != user.SecurityStamp {
+		return nil
+	}
+
+	return user
+}
+
+// New Security Stamp returns a random string that is used as
+// the security stamp of a user.
+func NewSecurityStamp() string {
+	return base64.URLEncoding.EncodeToString(securecookie.GenerateRandomKey(24))
+}
+
+// Invalidate Sessions changes the security stamp of a user, which logs
+// out every session of the user, and deletes the sessions from the
+// database. If the request is from the user then the session for the
+// request is given the new stamp so that it stays logged in.
+func InvalidateSessions(w http.ResponseWriter, req *http.Request, u *User) {
+	session, _ := store.Get(req, "user")
+	me := WhoAmI(req)
+	current := me != nil && me.Id == u.Id
+
+	// Update user in the database and in memory
+	stamp := NewSecurityStamp()
+	db.Table("users").Where("id = ?", u.Id).UpdateColumn("security_stamp", stamp)
+	users.Update(u.Id, func(v *User) {
+		v.SecurityStamp = stamp
+	})
+
+	// Delete every other session
+	if current {
+		db.Where("user_id = ? AND token <> ?", u.Id, session.ID).Delete(&UserSession{})
+
+		session.Values["stamp"] = stamp
+		session.Save(req, w)
+	} else {
+		db.Where("user_id = ?", u.Id).Delete(&UserSession{})
 	}
+}
+
+// Revoke Sessions changes the security stamp of a user and deletes
+// every session of the user. It is used when there is no request, like
+// from a command.
+func RevokeSessions(u *User) {
+	stamp := NewSecurityStamp()
+	db.Table("users").Where("id = ?", u.Id).UpdateColumn("security_stamp", stamp)
+	users.Update(u.Id, func(v *User) {
+		v.SecurityStamp = stamp
+	})
 
-	return nil
+	db.Where("user_id = ?", u.Id).Delete(&UserSession{})
 }
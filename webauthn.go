@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"os"
+	"time"
+)
+
+// WebAuthn relying party that security keys are registered with
+var webAuthn *webauthn.WebAuthn
+
+// SecurityKey is a WebAuthn credential, like a USB security key or a
+// phone, that a user can log in with instead of a 2fa token.
+type SecurityKey struct {
+	// Id is a uint64 that is the key's identification number.
+	Id uint64
+
+	// UserId is the id of the user that the key belongs to.
+	UserId uint64
+
+	// Name is what the user called the key when they added it.
+	Name string `sql:"size:255"`
+
+	// CredentialId is the base64 encoded id that the authenticator
+	// gave the credential.
+	CredentialId string `sql:"size:255;unique"`
+
+	// PublicKey is the base64 encoded public key of the credential.
+	PublicKey string `sql:"type:text"`
+
+	// AttestationType is the type of attestation that the key was
+	// registered with.
+	AttestationType string `sql:"size:255"`
+
+	// Aaguid is the base64 encoded id of the model of authenticator.
+	Aaguid string `sql:"size:255"`
+
+	// SignCount is the signature counter that the authenticator sent
+	// the last time it was used. A counter that goes backwards means
+	// that the key may have been cloned.
+	SignCount uint32
+
+	// CloneWarning is a bool that specifies if the signature counter
+	// has ever gone backwards.
+	CloneWarning bool
+
+	// LastUsedAt is a timestamp of when the key was last used to log
+	// in.
+	LastUsedAt time.Time
+
+	// CreatedAt is a timestamp of when the specific
+	// key was created at.
+	CreatedAt time.Time
+
+	// UpdatedAt is a timestamp of when the specific
+	// key was last updated at.
+	UpdatedAt time.Time
+}
+
+// Initalize WebAuthn sets up the relying party that security keys are
+// registered with. If no origin is given then it is guessed from the
+// webserver flags.
+func initalizeWebAuthn() {
+	origin := *webauthnOriginFlag
+	if origin == "" && TLSEnabled() {
+		origin = "https://" + *webauthnIdFlag + PortSuffix(443)
+	} else if origin == "" {
+		origin = "http://" + *webauthnIdFlag + PortSuffix(80)
+	}
+
+	var err error
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: "Sorbet",
+		RPID:          *webauthnIdFlag,
+		RPOrigins:     []string{origin},
+	})
+
+	if err != nil {
+		Warnf("Error configuring WebAuthn: %s", err)
+		Warn("Exiting with exit status 1")
+		os.Exit(1)
+	}
+}
+
+// WebAuthn ID returns the user handle that is given to authenticators,
+// which is the user's id as 8 big endian bytes.
+func (u *User) WebAuthnID() []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, u.Id)
+	return id
+}
+
+// WebAuthn Name returns the name of the user that authenticators show.
+func (u *User) WebAuthnName() string {
+	return u.Username
+}
+
+// WebAuthn Display Name returns the name of the user that
+// authenticators show.
+func (u *User) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+// WebAuthn Icon is deprecated and always returns a blank string.
+func (u *User) WebAuthnIcon() string {
+	return ""
+}
+
+// WebAuthn Credentials returns every security key that the user has
+// in the form that the webauthn package uses.
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	list := []webauthn.Credential{}
+	for _, key := range u.SecurityKeys() {
+		credential, err := key.Credential()
+		if err != nil {
+			Warnf("Error decoding security key %d: %s", key.Id, err)
+		} else {
+			list = append(list, credential)
+		}
+	}
+
+	return list
+}
+
+// Security Keys returns every security key that the user has.
+func (u *User) SecurityKeys() []SecurityKey {
+	var keys []SecurityKey
+	db.Where("user_id = ?", u.Id).Order("id").Find(&keys)
+	return keys
+}
+
+// Has Second Factor checks if the user has to use a 2fa token or a
+// security key to log in.
+func (u *User) HasSecondFactor() bool {
+	if u.Twofa {
+		return true
+	}
+
+	var count int
+	db.Model(&SecurityKey{}).Where("user_id = ?", u.Id).Count(&count)
+	return count > 0
+}
+
+// Credential decodes the security key into the form that the webauthn
+// package uses.
+func (k *SecurityKey) Credential() (webauthn.Credential, error) {
+	id, err := base64.RawURLEncoding.DecodeString(k.CredentialId)
+	if err != nil {
+		return webauthn.Credential{}, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(k.PublicKey)
+	if err != nil {
+		return webauthn.Credential{}, err
+	}
+
+	aaguid, err := base64.StdEncoding.DecodeString(k.Aaguid)
+	if err != nil {
+		return webauthn.Credential{}, err
+	}
+
+	return webauthn.Credential{
+		ID:              id,
+		PublicKey:       key,
+		AttestationType: k.AttestationType,
+		Authenticator: webauthn.Authenticator{
+			AAGUID:       aaguid,
+			SignCount:    k.SignCount,
+			CloneWarning: k.CloneWarning,
+		},
+	}, nil
+}
+
+// New Security Key creates a security key for a user from a credential
+// that was just registered.
+func NewSecurityKey(u *User, name string, credential *webauthn.Credential) *SecurityKey {
+	return &SecurityKey{
+		UserId:          u.Id,
+		Name:            name,
+		CredentialId:    base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:       base64.StdEncoding.EncodeToString(credential.PublicKey),
+		AttestationType: credential.AttestationType,
+		Aaguid:          base64.StdEncoding.EncodeToString(credential.Authenticator.AAGUID),
+		SignCount:       credential.Authenticator.SignCount,
+	}
+}
+
+// Update Security Key saves the signature counter of a credential that
+// was just used to log in. If the authenticator's counter went
+// backwards then a warning is logged and kept on the key.
+func UpdateSecurityKey(credential *webauthn.Credential) {
+	var key SecurityKey
+	db.Where("credential_id = ?", base64.RawURLEncoding.EncodeToString(credential.ID)).First(&key)
+	if key.Id == 0 {
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		Warnf("Security key %d (%s) sent a signature counter that went backwards, it may have been cloned", key.Id, key.Name)
+		key.CloneWarning = true
+	}
+
+	key.SignCount = credential.Authenticator.SignCount
+	key.LastUsedAt = time.Now()
+	db.Save(&key)
+}
+
+// Save WebAuthn Session keeps the data for a registration or login
+// ceremony in the user's session until the browser finishes it.
+func SaveWebAuthnSession(session *sessions.Session, name string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	session.Values[name] = string(encoded)
+	return nil
+}
+
+// Load WebAuthn Session returns the data for a registration or login
+// ceremony from the user's session and removes it, so each ceremony
+// can only be finished once.
+func LoadWebAuthnSession(session *sessions.Session, name string) (webauthn.SessionData, error) {
+	var data webauthn.SessionData
+
+	encoded, ok := session.Values[name].(string)
+	if !ok || encoded == "" {
+		return data, errors.New("no WebAuthn ceremony has been started")
+	}
+
+	delete(session.Values, name)
+	err := json.Unmarshal([]byte(encoded), &data)
+	return data, err
+}
+
+// Security Key Exclusions returns the credentials that a user already
+// has so the browser doesn't register the same key twice.
+func SecurityKeyExclusions(u *User) []protocol.CredentialDescriptor {
+	list := []protocol.CredentialDescriptor{}
+	for _, credential := range u.WebAuthnCredentials() {
+		list = append(list, credential.Descriptor())
+	}
+
+	return list
+}
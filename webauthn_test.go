@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// SoftwareAuthenticator is a security key that lives in memory, which
+// makes and signs the same responses that a browser sends for a real
+// key.
+type SoftwareAuthenticator struct {
+	Key          *ecdsa.PrivateKey
+	CredentialId []byte
+	SignCount    uint32
+	Origin       string
+}
+
+// New Software Authenticator creates an authenticator with a new P-256
+// key for the relying party that the tests use.
+func NewSoftwareAuthenticator(t *testing.T) *SoftwareAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 32)
+	rand.Read(id)
+
+	return &SoftwareAuthenticator{Key: key, CredentialId: id, Origin: webAuthn.Config.RPOrigins[0]}
+}
+
+// Client Data returns the JSON that a browser signs for a ceremony.
+func (a *SoftwareAuthenticator) ClientData(kind, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": challenge,
+		"origin":    a.Origin,
+	})
+
+	return data
+}
+
+// Authenticator Data returns the data that the authenticator signs,
+// with the credential attached if it is being registered.
+func (a *SoftwareAuthenticator) AuthenticatorData(attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(webAuthn.Config.RPID))
+
+	// User present and user verified, and attested credential data if
+	// there is any
+	flags := byte(0x05)
+	if attested != nil {
+		flags |= 0x40
+	}
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.SignCount)
+	return append(data, attested...)
+}
+
+// Register answers a registration ceremony with a "none" attestation.
+func (a *SoftwareAuthenticator) Register(t *testing.T, challenge string) *http.Request {
+	t.Helper()
+
+	key, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: a.Key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.Key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.CredentialId)))
+	attested = append(attested, a.CredentialId...)
+	attested = append(attested, key...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.AuthenticatorData(attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.Response(map[string]string{
+		"clientDataJSON":    Base64Url(a.ClientData("webauthn.create", challenge)),
+		"attestationObject": Base64Url(attestation),
+	})
+}
+
+// Assert answers a login ceremony, counting up the signature counter
+// first like a real key does.
+func (a *SoftwareAuthenticator) Assert(t *testing.T, challenge string, user *User) *http.Request {
+	t.Helper()
+
+	a.SignCount++
+	data := a.AuthenticatorData(nil)
+	client := a.ClientData("webauthn.get", challenge)
+	hash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, data...), hash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.Key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.Response(map[string]string{
+		"clientDataJSON":    Base64Url(client),
+		"authenticatorData": Base64Url(data),
+		"signature":         Base64Url(signature),
+		"userHandle":        Base64Url(user.WebAuthnID()),
+	})
+}
+
+// Response returns the request that a browser sends to finish a
+// ceremony.
+func (a *SoftwareAuthenticator) Response(response map[string]string) *http.Request {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       Base64Url(a.CredentialId),
+		"rawId":    Base64Url(a.CredentialId),
+		"type":     "public-key",
+		"response": response,
+	})
+
+	return httptest.NewRequest("POST", "/", bytes.NewReader(body))
+}
+
+// Base64 Url encodes bytes the way WebAuthn sends them.
+func Base64Url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Register Test Security Key runs a registration ceremony with the
+// authenticator and saves the key for the user.
+func RegisterTestSecurityKey(t *testing.T, user *User, authenticator *SoftwareAuthenticator) {
+	t.Helper()
+
+	_, data, err := webAuthn.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := webAuthn.FinishRegistration(user, *data, authenticator.Register(t, data.Challenge))
+	if err != nil {
+		t.Fatalf("registering the security key: %s", err)
+	}
+
+	if err := db.Create(NewSecurityKey(user, "Software key", credential)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Login With Test Security Key runs a login ceremony with the
+// authenticator, keeping the ceremony in a session the way the login
+// handlers do.
+func LoginWithTestSecurityKey(t *testing.T, user *User, authenticator *SoftwareAuthenticator) (*webauthn.Credential, error) {
+	t.Helper()
+
+	_, data, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := sessions.NewSession(store, "user")
+	SaveWebAuthnSession(session, "webauthn_login", data)
+
+	loaded, err := LoadWebAuthnSession(session, "webauthn_login")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := webAuthn.FinishLogin(user, loaded, authenticator.Assert(t, data.Challenge, user))
+	if err == nil {
+		UpdateSecurityKey(credential)
+	}
+
+	return credential, err
+}
+
+func TestSecurityKeyRegistrationAndLogin(t *testing.T) {
+	initalizeWebAuthn()
+	user := NewTestUser(t, "webauthn-login", false)
+	authenticator := NewSoftwareAuthenticator(t)
+
+	RegisterTestSecurityKey(t, user, authenticator)
+	if !user.HasSecondFactor() {
+		t.Error("a user with a security key should have a second factor")
+	}
+
+	for i := 1; i <= 2; i++ {
+		if _, err := LoginWithTestSecurityKey(t, user, authenticator); err != nil {
+			t.Fatalf("logging in with the security key: %s", err)
+		}
+
+		key := user.SecurityKeys()[0]
+		if key.SignCount != uint32(i) || key.LastUsedAt.IsZero() {
+			t.Errorf("the key has sign count %d and was last used at %s, want %d and a time", key.SignCount, key.LastUsedAt, i)
+		}
+	}
+
+	// A key that belongs to someone else can't be used
+	other := NewSoftwareAuthenticator(t)
+	other.CredentialId = authenticator.CredentialId
+	if _, err := LoginWithTestSecurityKey(t, user, other); err == nil {
+		t.Error("a signature from a different key should not be accepted")
+	}
+}
+
+func TestSecurityKeyLoginCantBeReplayed(t *testing.T) {
+	initalizeWebAuthn()
+	user := NewTestUser(t, "webauthn-replay", false)
+	authenticator := NewSoftwareAuthenticator(t)
+	RegisterTestSecurityKey(t, user, authenticator)
+
+	_, data, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := sessions.NewSession(store, "user")
+	SaveWebAuthnSession(session, "webauthn_login", data)
+	loaded, _ := LoadWebAuthnSession(session, "webauthn_login")
+
+	// Keep the answer so that it can be sent again
+	answer, _ := io.ReadAll(authenticator.Assert(t, data.Challenge, user).Body)
+	replay := func() *http.Request {
+		return httptest.NewRequest("POST", "/", bytes.NewReader(answer))
+	}
+
+	if _, err := webAuthn.FinishLogin(user, loaded, replay()); err != nil {
+		t.Fatalf("logging in with the security key: %s", err)
+	}
+
+	// The ceremony is taken out of the session when it is finished, so
+	// the same answer can't finish it again
+	if _, err := LoadWebAuthnSession(session, "webauthn_login"); err == nil {
+		t.Error("a finished ceremony should not be loaded again")
+	}
+
+	// And a new ceremony has a new challenge, which the old answer
+	// didn't sign
+	_, next, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := webAuthn.FinishLogin(user, *next, replay()); err == nil {
+		t.Error("an answer to an old challenge should not be accepted")
+	}
+}
+
+func TestSecurityKeySignCountRollback(t *testing.T) {
+	initalizeWebAuthn()
+	user := NewTestUser(t, "webauthn-rollback", false)
+	authenticator := NewSoftwareAuthenticator(t)
+	RegisterTestSecurityKey(t, user, authenticator)
+
+	authenticator.SignCount = 10
+	if _, err := LoginWithTestSecurityKey(t, user, authenticator); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of the key that was made earlier still has a lower counter
+	authenticator.SignCount = 3
+	LoginWithTestSecurityKey(t, user, authenticator)
+
+	key := user.SecurityKeys()[0]
+	if !key.CloneWarning {
+		t.Error("a signature counter that goes backwards should warn that the key may be cloned")
+	}
+
+	if key.SignCount != 11 {
+		t.Errorf("the sign count is %d, want it to stay at 11", key.SignCount)
+	}
+}